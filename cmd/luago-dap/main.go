@@ -0,0 +1,61 @@
+// luago-dap 调试luago脚本的Debug Adapter Protocol服务器
+//
+// 默认通过标准输入输出与编辑器通信, 使用 -listen 时在TCP地址上监听, 每个连接为独立的调试会话
+// lua源码使用官方luac编译, 通过 -luac 指定luac的路径
+//
+//	luago-dap -luac ./lua-5.3.6/src/luac
+//	luago-dap -luac luac -listen 127.0.0.1:4711
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"luago/dap"
+	"net"
+	"os"
+	"os/exec"
+)
+
+func main() {
+	luac := flag.String("luac", "luac", "path of the luac executable used to compile lua sources and expressions")
+	listen := flag.String("listen", "", "serve DAP on this TCP address instead of stdin/stdout")
+	flag.Parse()
+
+	var cfg dap.Config
+	if path, err := exec.LookPath(*luac); err == nil {
+		cfg.Compiler = dap.LuacCompiler(path)
+	} else {
+		log.Printf("luac not found (%v), only binary chunks can be debugged", err)
+	}
+
+	if *listen == "" {
+		if err := dap.NewSession(stdio{os.Stdin, os.Stdout}, cfg).Serve(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			if err := dap.NewSession(conn, cfg).Serve(); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+}
+
+// stdio 组合标准输入输出作为客户端连接
+type stdio struct {
+	io.Reader
+	io.Writer
+}
@@ -0,0 +1,297 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"luago/vm"
+	"luago/vm/api"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const luac = "../lua-5.3.6/src/luac"
+
+// client 按脚本发送请求的DAP客户端
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	seq    int
+	msgs   chan map[string]interface{}
+	events []map[string]interface{} // 等待响应期间收到的事件
+}
+
+func newClient(t *testing.T, conn net.Conn) *client {
+	c := &client{t: t, conn: conn, msgs: make(chan map[string]interface{}, 100)}
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			data, err := readMessage(r)
+			if err != nil {
+				close(c.msgs)
+				return
+			}
+			var msg map[string]interface{}
+			json.Unmarshal(data, &msg)
+			c.msgs <- msg
+		}
+	}()
+	return c
+}
+
+func (c *client) next() map[string]interface{} {
+	select {
+	case msg, ok := <-c.msgs:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(10 * time.Second):
+		c.t.Fatal("timeout waiting for message")
+	}
+	return nil
+}
+
+// send 发送请求并等待响应
+func (c *client) send(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.seq++
+	if err := writeMessage(c.conn, map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args}); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.next()
+		if msg["type"] != "event" {
+			return msg
+		}
+		c.events = append(c.events, msg)
+	}
+}
+
+// request 发送请求并返回成功响应的body
+func (c *client) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	msg := c.send(command, args)
+	if msg["request_seq"] != float64(c.seq) || msg["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, msg)
+	}
+	body, _ := msg["body"].(map[string]interface{})
+	return body
+}
+
+// event 等待事件, 返回事件的body
+func (c *client) event(name string) map[string]interface{} {
+	c.t.Helper()
+	for len(c.events) > 0 {
+		msg := c.events[0]
+		c.events = c.events[1:]
+		if msg["event"] == name {
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+	for {
+		msg := c.next()
+		if msg["type"] == "event" && msg["event"] == name {
+			body, _ := msg["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+// stopped 等待stopped事件并返回暂停的原因和最内层栈帧的行号
+func (c *client) stopped() (string, int) {
+	c.t.Helper()
+	reason := c.event("stopped")["reason"].(string)
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	return reason, int(frames[0].(map[string]interface{})["line"].(float64))
+}
+
+func (c *client) evaluate(expr string, frameID int) string {
+	c.t.Helper()
+	return c.request("evaluate", map[string]interface{}{"expression": expr, "frameId": frameID})["result"].(string)
+}
+
+func TestLaunch(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "main.lua")
+	os.WriteFile(program, []byte(`local function add(a, b)
+  local sum = a + b
+  return sum
+end
+local t = {name = "x", 10}
+local total = 0
+for i = 1, 3 do
+  total = add(total, i)
+end
+print(total)
+`), 0600)
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	done := make(chan error)
+	go func() {
+		done <- NewSession(server, Config{Compiler: LuacCompiler(luac)}).Serve()
+	}()
+	c := newClient(t, conn)
+	if caps := c.request("initialize", map[string]interface{}{"adapterID": "luago"}); caps["supportsConditionalBreakpoints"] != true {
+		t.Fatalf("unexpected capabilities: %v", caps)
+	}
+	c.request("launch", map[string]interface{}{"program": program})
+	c.event("initialized")
+	bps := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": program},
+		"breakpoints": []interface{}{map[string]interface{}{"line": 2, "condition": "a == 3"}, map[string]interface{}{"line": 9}},
+	})["breakpoints"].([]interface{})
+	if bps[0].(map[string]interface{})["verified"] != true || bps[1].(map[string]interface{})["verified"] != false {
+		t.Fatalf("unexpected breakpoints: %v", bps)
+	}
+	c.request("configurationDone", nil)
+
+	// 条件断点在第三次调用add时暂停
+	if reason, line := c.stopped(); reason != "breakpoint" || line != 2 {
+		t.Fatalf("unexpected stop: %s %d", reason, line)
+	}
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	if len(frames) != 2 || frames[0].(map[string]interface{})["name"] != "add" || frames[1].(map[string]interface{})["name"] != "main chunk" ||
+		frames[1].(map[string]interface{})["line"] != 8.0 || frames[0].(map[string]interface{})["source"].(map[string]interface{})["path"] != program {
+		t.Fatalf("unexpected stack trace: %v", frames)
+	}
+	scopes := c.request("scopes", map[string]interface{}{"frameId": 1})["scopes"].([]interface{})
+	locals := c.request("variables", map[string]interface{}{"variablesReference": scopes[0].(map[string]interface{})["variablesReference"]})
+	vars := locals["variables"].([]interface{})
+	if len(vars) != 2 || vars[0].(map[string]interface{})["name"] != "a" || vars[0].(map[string]interface{})["value"] != "3" ||
+		vars[1].(map[string]interface{})["name"] != "b" || vars[1].(map[string]interface{})["value"] != "3" {
+		t.Fatalf("unexpected locals: %v", vars)
+	}
+	if v := c.evaluate("a + b", 1); v != "6" {
+		t.Fatalf("unexpected evaluate result: %s", v)
+	}
+	if v := c.evaluate("t.name .. total", 2); v != `"x3"` {
+		t.Fatalf("unexpected evaluate result: %s", v)
+	}
+	// 展开table
+	result := c.request("evaluate", map[string]interface{}{"expression": "t", "frameId": 2})
+	fields := c.request("variables", map[string]interface{}{"variablesReference": result["variablesReference"]})["variables"].([]interface{})
+	if len(fields) != 2 || fields[0].(map[string]interface{})["name"] != "[1]" || fields[1].(map[string]interface{})["value"] != `"x"` {
+		t.Fatalf("unexpected table fields: %v", fields)
+	}
+
+	c.request("next", map[string]interface{}{"threadId": threadID})
+	if reason, line := c.stopped(); reason != "step" || line != 3 {
+		t.Fatalf("unexpected stop: %s %d", reason, line)
+	}
+	c.request("stepOut", map[string]interface{}{"threadId": threadID})
+	if reason, line := c.stopped(); reason != "step" || line != 7 {
+		t.Fatalf("unexpected stop: %s %d", reason, line)
+	}
+	c.request("stepIn", map[string]interface{}{"threadId": threadID})
+	if reason, line := c.stopped(); reason != "step" || line != 10 {
+		t.Fatalf("unexpected stop: %s %d", reason, line)
+	}
+	c.request("continue", map[string]interface{}{"threadId": threadID})
+	if out := c.event("output"); out["output"] != "6\n" {
+		t.Fatalf("unexpected output: %v", out)
+	}
+	if exited := c.event("exited"); exited["exitCode"] != 0.0 {
+		t.Fatalf("unexpected exit: %v", exited)
+	}
+	c.event("terminated")
+	c.request("disconnect", nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAttach(t *testing.T) {
+	compile := LuacCompiler(luac)
+	proto, err := compile([]byte("local n = 0\nwhile running() do\n  n = n + 1\nend"), "=attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := vm.NewState()
+	var stop int32
+	state.Register("running", func(api.State, ...interface{}) []interface{} {
+		return []interface{}{atomic.LoadInt32(&stop) == 0}
+	})
+	main := state.Load(proto)
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+	session := NewSession(server, Config{}) // 没有编译器时只能对变量和字段求值
+	session.Attach(state)
+	done := make(chan error)
+	go func() {
+		done <- session.Serve()
+	}()
+	c := newClient(t, conn)
+	c.request("initialize", nil)
+	c.request("attach", nil)
+	c.event("initialized")
+	c.request("configurationDone", nil)
+
+	finished := make(chan error)
+	go func() { // 宿主运行脚本
+		_, err := state.CallFunction(main)
+		finished <- err
+	}()
+	c.request("pause", map[string]interface{}{"threadId": threadID})
+	if reason, _ := c.stopped(); reason != "pause" {
+		t.Fatalf("unexpected stop: %s", reason)
+	}
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": threadID})["stackFrames"].([]interface{})
+	if src := frames[0].(map[string]interface{})["source"].(map[string]interface{}); src["name"] != "attach" || src["path"] != nil {
+		t.Fatalf("unexpected source: %v", src)
+	}
+	if v := c.evaluate("n", 1); v == "0" {
+		t.Fatalf("unexpected evaluate result: %s", v)
+	}
+	if msg := c.send("evaluate", map[string]interface{}{"expression": "n + 1"}); msg["success"] != false ||
+		msg["message"] != "cannot evaluate 'n + 1' without a compiler" {
+		t.Fatalf("unexpected response: %v", msg)
+	}
+
+	// 断开连接后脚本继续运行, 不再暂停
+	c.request("disconnect", nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-finished:
+		t.Fatalf("script should keep running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	atomic.StoreInt32(&stop, 1)
+	if err := <-finished; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEvalPath(t *testing.T) {
+	inner := vm.GoMapToLuaTable(map[interface{}]interface{}{"key": "v"})
+	list := vm.GoMapToLuaTable(map[interface{}]interface{}{})
+	list.Put(1, inner)
+	env := vm.GoMapToLuaTable(map[interface{}]interface{}{"list": list})
+	for _, test := range []struct {
+		expr     string
+		expected interface{}
+		err      string
+	}{
+		{expr: "list[1].key", expected: "v"},
+		{expr: `list[1]["key"]`, expected: "v"},
+		{expr: "list[2]", expected: nil},
+		{expr: "list[1] . key", err: "cannot evaluate 'list[1] . key' without a compiler"},
+		{expr: "list[2].key", err: "attempt to index a non-table value"},
+	} {
+		v, err := evalPath(env, test.expr)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Fatalf("%s: unexpected error %v", test.expr, err)
+			}
+		} else if err != nil || v != test.expected {
+			t.Fatalf("%s: unexpected result %v %v", test.expr, v, err)
+		}
+	}
+}
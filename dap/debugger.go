@@ -0,0 +1,158 @@
+package dap
+
+import (
+	"errors"
+	"fmt"
+	"luago/vm"
+	"path/filepath"
+)
+
+// errNotStopped 脚本运行中时访问调用栈和变量的请求返回的错误
+var errNotStopped = errors.New("lua state is not stopped")
+
+// setBreakpoints 替换源文件的全部断点, launch加载的源文件中没有指令的行标记为未验证
+func (s *Session) setBreakpoints(args setBreakpointsArguments) []breakpoint {
+	path := args.Source.Path
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.breakpoints[path] {
+		if s.bpLines[b.line]--; s.bpLines[b.line] == 0 {
+			delete(s.bpLines, b.line)
+		}
+	}
+	bps := make([]*bp, 0, len(args.Breakpoints))
+	result := make([]breakpoint, 0, len(args.Breakpoints))
+	lines := s.lines[path]
+	for _, sb := range args.Breakpoints {
+		s.nextBpID++
+		r := breakpoint{ID: s.nextBpID, Verified: true, Line: sb.Line, Source: args.Source}
+		if lines != nil && !lines[sb.Line] {
+			r.Verified, r.Message = false, "no code at this line"
+		} else {
+			bps = append(bps, &bp{id: r.ID, line: sb.Line, condition: sb.Condition})
+			s.bpLines[sb.Line]++
+		}
+		result = append(result, r)
+	}
+	s.breakpoints[path] = bps
+	return result
+}
+
+// onLine line事件的钩子函数, 在虚拟机goroutine中运行
+// 判断是否需要暂停, 没有断点和单步请求时只需要检查行号
+func (s *Session) onLine(ev vm.HookEvent) {
+	s.mu.Lock()
+	if s.terminated {
+		s.mu.Unlock()
+		ev.State.SetHook(0, 0, nil)
+		return
+	}
+	mode, depth, entry, pause, nbp := s.step, s.stepDepth, s.entry, s.pause, s.bpLines[ev.Line]
+	s.mu.Unlock()
+
+	var reason string
+	var hits []int
+	switch {
+	case entry:
+		reason = "entry"
+	case pause:
+		reason = "pause"
+	case mode == stepIn,
+		mode == stepOver && ev.State.StackDepth() <= depth,
+		mode == stepOut && ev.State.StackDepth() < depth:
+		reason = "step"
+	}
+	if reason == "" && nbp > 0 {
+		if b := s.breakpointAt(ev); b != nil && s.checkCondition(ev.State, b) {
+			reason, hits = "breakpoint", []int{b.id}
+		}
+	}
+	if reason != "" {
+		s.stop(ev.State, reason, hits)
+	}
+}
+
+// breakpointAt 当前行上的断点
+func (s *Session) breakpointAt(ev vm.HookEvent) *bp {
+	path := sourcePath(ev.Info().Source)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.breakpoints[path] {
+		if b.line == ev.Line {
+			return b
+		}
+	}
+	return nil
+}
+
+// checkCondition 条件断点的条件是否成立, 求值出错时暂停并输出错误
+func (s *Session) checkCondition(state *vm.State, b *bp) bool {
+	if b.condition == "" {
+		return true
+	}
+	v, err := s.evaluate(state, 0, b.condition)
+	if err != nil {
+		s.sendEvent("output", outputEvent{
+			Category: "console",
+			Output:   fmt.Sprintf("error in breakpoint condition '%s': %v\n", b.condition, err),
+		})
+		return true
+	}
+	return v != nil && v != false
+}
+
+// stop 暂停脚本并通知客户端, 阻塞虚拟机goroutine直到客户端继续执行
+// 暂停期间执行其他请求转交的函数
+func (s *Session) stop(state *vm.State, reason string, hits []int) {
+	paused := make(chan func())
+	s.mu.Lock()
+	s.step, s.entry, s.pause = stepNone, false, false
+	s.paused = paused
+	s.mu.Unlock()
+	s.sendEvent("stopped", stoppedEvent{Reason: reason, ThreadID: threadID, AllThreadsStopped: true, HitBreakpointIds: hits})
+	for f := range paused {
+		f()
+	}
+	s.mu.Lock()
+	s.refs, s.tableRefs = nil, make(map[vm.LuaTable]int)
+	s.mu.Unlock()
+}
+
+// resume 继续执行暂停的脚本, mode为单步执行模式, 从当前调用栈深度开始计算
+func (s *Session) resume(mode stepMode) error {
+	depth := 0
+	if mode != stepNone {
+		if err := s.inVM(func(state *vm.State) { depth = state.StackDepth() }); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.paused == nil {
+		return errNotStopped
+	}
+	s.step, s.stepDepth = mode, depth
+	close(s.paused)
+	s.paused = nil
+	return nil
+}
+
+// inVM 在暂停的虚拟机goroutine中执行f并等待完成
+func (s *Session) inVM(f func(state *vm.State)) error {
+	s.mu.Lock()
+	paused, state := s.paused, s.state
+	s.mu.Unlock()
+	if paused == nil {
+		return errNotStopped
+	}
+	done := make(chan struct{})
+	paused <- func() {
+		defer close(done)
+		f(state)
+	}
+	<-done
+	return nil
+}
@@ -0,0 +1,59 @@
+package dap
+
+import (
+	"fmt"
+	"luago/chunk"
+	"luago/vm"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// LuacCompiler 使用官方luac编译lua源码的编译器, luac为可执行文件路径
+// 编译得到的函数原型的Source为chunkname, 错误信息中的临时文件名替换为chunkname
+func LuacCompiler(luac string) vm.Compiler {
+	return func(source []byte, chunkname string) (*chunk.Prototype, error) {
+		dir, err := os.MkdirTemp("", "luago-dap")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		luaFile, outFile := filepath.Join(dir, "chunk.lua"), filepath.Join(dir, "chunk.out")
+		if err := os.WriteFile(luaFile, source, 0600); err != nil {
+			return nil, err
+		}
+		if out, err := exec.Command(luac, "-o", outFile, luaFile).CombinedOutput(); err != nil {
+			msg := strings.TrimSpace(string(out))
+			if i := strings.Index(msg, luaFile); i >= 0 { // 去掉 "luac: " 前缀
+				msg = msg[i:]
+			}
+			if msg == "" {
+				msg = err.Error()
+			}
+			return nil, fmt.Errorf("%s", strings.ReplaceAll(msg, luaFile, chunkName(chunkname)))
+		}
+		data, err := os.ReadFile(outFile)
+		if err != nil {
+			return nil, err
+		}
+		proto := chunk.Undump(data)
+		var rename func(p *chunk.Prototype)
+		rename = func(p *chunk.Prototype) {
+			p.Source = chunkname
+			for _, sub := range p.Protos {
+				rename(sub)
+			}
+		}
+		rename(proto)
+		return proto, nil
+	}
+}
+
+// chunkName 错误信息中显示的chunk名称
+func chunkName(chunkname string) string {
+	if strings.HasPrefix(chunkname, "@") || strings.HasPrefix(chunkname, "=") {
+		return chunkname[1:]
+	}
+	return chunkname
+}
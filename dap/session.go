@@ -0,0 +1,409 @@
+// Package dap 实现luago脚本的Debug Adapter Protocol调试器, 可以在VS Code等编辑器中调试lua脚本
+//
+// 支持launch(加载并运行脚本)和attach(调试宿主创建的State), 行断点和条件断点, 单步执行(step in/over/out),
+// 调用栈, 局部变量/upvalue/全局变量和表达式求值
+package dap
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"luago/chunk"
+	"luago/vm"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Config 调试会话的配置
+type Config struct {
+	// Compiler 编译launch的lua源码和evaluate的表达式, 可以使用 LuacCompiler
+	// 为nil时launch只能加载二进制chunk, 表达式只能是变量名和字段访问(如 t.name, t[1])
+	Compiler vm.Compiler
+	// Options launch创建State时的额外选项, 标准输出和标准错误输出总是发送给客户端
+	Options []vm.Option
+}
+
+// Session 一个调试客户端的会话, 请求按顺序在Serve的goroutine中处理
+// 脚本暂停时虚拟机所在的goroutine阻塞在钩子函数中, 访问虚拟机的请求转交给它执行
+type Session struct {
+	cfg Config
+	r   *bufio.Reader
+	w   io.Writer
+	wmu sync.Mutex // 保护w和seq
+	seq int
+
+	mu          sync.Mutex
+	state       *vm.State
+	attached    bool                // 调试宿主创建的State
+	main        interface{}         // launch加载的主函数
+	args        []interface{}       // 主函数的参数
+	lines       map[string]lineSet  // launch加载的各个源文件中包含指令的行号
+	breakpoints map[string][]*bp    // 按源文件路径分组的断点
+	bpLines     map[int]int         // 各行上的断点数量, 用于快速跳过没有断点的行
+	nextBpID    int                 // 下一个断点的id
+	step        stepMode            // 单步执行模式
+	stepDepth   int                 // 开始单步执行时的调用栈深度
+	entry       bool                // 在第一行暂停
+	pause       bool                // 客户端请求暂停
+	paused      chan func()         // 暂停时在虚拟机goroutine上执行的请求, 运行中为nil
+	terminated  bool                // 会话结束, 不再暂停
+	cancel      context.CancelFunc  // 中断launch运行的脚本
+	done        chan struct{}       // launch运行的脚本结束
+	refs        []interface{}       // 暂停期间variablesReference对应的scope或者table, 下标加1为引用
+	tableRefs   map[vm.LuaTable]int // table已经分配的引用
+}
+
+type lineSet map[int]bool
+
+// bp 行断点
+type bp struct {
+	id        int
+	line      int
+	condition string
+}
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+// threadID 唯一的线程(虚拟机)id
+const threadID = 1
+
+// NewSession 创建调试会话, rw为与客户端的连接(如标准输入输出或者TCP连接)
+func NewSession(rw io.ReadWriter, cfg Config) *Session {
+	return &Session{
+		cfg:         cfg,
+		r:           bufio.NewReader(rw),
+		w:           rw,
+		breakpoints: make(map[string][]*bp),
+		bpLines:     make(map[int]int),
+		tableRefs:   make(map[vm.LuaTable]int),
+	}
+}
+
+// Attach 设置attach请求调试的State, 需在Serve之前调用
+// attach之后宿主在自己的goroutine中运行脚本, 脚本暂停时阻塞该goroutine
+func (s *Session) Attach(state *vm.State) {
+	s.state = state
+	s.attached = true
+}
+
+// Serve 处理客户端的请求, 直到客户端断开连接或者发送disconnect请求
+// launch运行的脚本在会话结束时被中断, attach的State移除钩子后继续运行
+func (s *Session) Serve() error {
+	defer s.shutdown()
+	for {
+		data, err := readMessage(s.r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return fmt.Errorf("dap: %w", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		if s.handle(&req) {
+			return nil
+		}
+	}
+}
+
+// handle 处理一个请求, 返回true表示会话结束
+func (s *Session) handle(req *request) bool {
+	var body interface{}
+	var err error
+	initialized := false // launch/attach之后通知客户端可以设置断点
+	switch req.Command {
+	case "initialize":
+		body = capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsConditionalBreakpoints:   true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		}
+	case "launch":
+		var args launchArguments
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			err = s.launch(args)
+		}
+		initialized = err == nil
+	case "attach":
+		var args attachArguments
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			err = s.attach(args)
+		}
+		initialized = err == nil
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			body = map[string]interface{}{"breakpoints": s.setBreakpoints(args)}
+		}
+	case "setExceptionBreakpoints":
+		body = map[string]interface{}{"breakpoints": []breakpoint{}}
+	case "configurationDone":
+		s.start()
+	case "threads":
+		body = map[string]interface{}{"threads": []thread{{ID: threadID, Name: "main"}}}
+	case "stackTrace":
+		var args stackTraceArguments
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			body, err = s.stackTrace(args)
+		}
+	case "scopes":
+		var args struct {
+			FrameID int `json:"frameId"`
+		}
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			body, err = s.scopes(args.FrameID)
+		}
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			body, err = s.variables(args.VariablesReference)
+		}
+	case "evaluate":
+		var args evaluateArguments
+		if err = unmarshal(req.Arguments, &args); err == nil {
+			body, err = s.evaluateRequest(args)
+		}
+	case "continue":
+		err = s.resume(stepNone)
+		body = map[string]interface{}{"allThreadsContinued": true}
+	case "next":
+		err = s.resume(stepOver)
+	case "stepIn":
+		err = s.resume(stepIn)
+	case "stepOut":
+		err = s.resume(stepOut)
+	case "pause":
+		s.mu.Lock()
+		s.pause = true
+		s.mu.Unlock()
+	case "disconnect", "terminate":
+		s.respond(req, nil, nil)
+		return true
+	default:
+		err = fmt.Errorf("unsupported request '%s'", req.Command)
+	}
+	s.respond(req, body, err)
+	if initialized {
+		s.sendEvent("initialized", nil)
+	}
+	return false
+}
+
+func unmarshal(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *Session) respond(req *request, body interface{}, err error) {
+	resp := response{Type: "response", RequestSeq: req.Seq, Success: err == nil, Command: req.Command, Body: body}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	s.send(&resp, &resp.Seq)
+}
+
+func (s *Session) sendEvent(name string, body interface{}) {
+	ev := event{Type: "event", Event: name, Body: body}
+	s.send(&ev, &ev.Seq)
+}
+
+// send 分配消息序号后发送, 可以在虚拟机goroutine中调用
+func (s *Session) send(msg interface{}, seq *int) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	*seq = s.seq
+	writeMessage(s.w, msg)
+}
+
+// outputWriter 将脚本的输出作为output事件发送给客户端
+type outputWriter struct {
+	s        *Session
+	category string
+}
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.s.sendEvent("output", outputEvent{Category: w.category, Output: string(p)})
+	return len(p), nil
+}
+
+// launch 创建State并加载脚本, 收到configurationDone之后开始运行
+func (s *Session) launch(args launchArguments) error {
+	if s.state != nil {
+		return errors.New("already launched or attached")
+	}
+	if args.Program == "" {
+		return errors.New("missing 'program' in launch arguments")
+	}
+	program, err := filepath.Abs(args.Program)
+	if err != nil {
+		return err
+	}
+	proto, err := s.loadProgram(program)
+	if err != nil {
+		return err
+	}
+	opts := []vm.Option{
+		vm.WithCompiler(s.cfg.Compiler),
+		vm.WithStdout(outputWriter{s, "stdout"}),
+		vm.WithStderr(outputWriter{s, "stderr"}),
+	}
+	state := vm.NewState(append(opts, s.cfg.Options...)...)
+	argTable := vm.GoMapToLuaTable(map[interface{}]interface{}{}) // 同lua命令行的arg
+	argTable.Put(0, args.Program)
+	for i, arg := range args.Args {
+		argTable.Put(i+1, arg)
+		s.args = append(s.args, arg)
+	}
+	state.Globals().Put("arg", argTable)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	s.main = state.Load(proto)
+	s.lines = make(map[string]lineSet)
+	collectLines(proto, s.lines)
+	if !args.NoDebug {
+		s.entry = args.StopOnEntry
+		state.SetHook(vm.HookLine, 0, s.onLine)
+	}
+	return nil
+}
+
+// loadProgram 加载二进制chunk或者使用Compiler编译源码, chunkname为 "@"+program
+func (s *Session) loadProgram(program string) (proto *chunk.Prototype, err error) {
+	data, err := os.ReadFile(program)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[0] == chunk.LUA_SIGNATURE[0] {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("%s: %v", program, p)
+			}
+		}()
+		return chunk.Undump(data), nil
+	}
+	if s.cfg.Compiler == nil {
+		return nil, fmt.Errorf("%s: cannot load lua source without a compiler", program)
+	}
+	return s.cfg.Compiler(data, "@"+program)
+}
+
+// collectLines 记录函数原型及其子函数中包含指令的行号
+func collectLines(p *chunk.Prototype, lines map[string]lineSet) {
+	path := sourcePath(p.Source)
+	if lines[path] == nil {
+		lines[path] = make(lineSet)
+	}
+	for _, line := range p.LineInfo {
+		lines[path][int(line)] = true
+	}
+	for _, sub := range p.Protos {
+		collectLines(sub, lines)
+	}
+}
+
+// attach 在宿主创建的State上设置钩子
+func (s *Session) attach(args attachArguments) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.attached || s.state == nil {
+		return errors.New("no lua state to attach to")
+	}
+	s.entry = args.StopOnEntry
+	s.state.SetHook(vm.HookLine, 0, s.onLine)
+	return nil
+}
+
+// start 客户端配置完成(断点已经设置), 开始运行launch加载的脚本
+func (s *Session) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.main == nil || s.done != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.run(ctx, s.state, s.main)
+}
+
+// run 在虚拟机goroutine中运行脚本, 结束后发送exited和terminated事件
+func (s *Session) run(ctx context.Context, state *vm.State, main interface{}) {
+	defer close(s.done)
+	exitCode := 0
+	if _, err := state.CallContext(ctx, main, s.args...); err != nil {
+		exitCode = 1
+		if !errors.Is(err, context.Canceled) {
+			s.sendEvent("output", outputEvent{Category: "stderr", Output: err.Error() + "\n"})
+		}
+	}
+	s.sendEvent("exited", map[string]interface{}{"exitCode": exitCode})
+	s.sendEvent("terminated", nil)
+}
+
+// shutdown 会话结束, 恢复暂停的脚本并且不再暂停, 中断launch运行的脚本
+func (s *Session) shutdown() {
+	s.mu.Lock()
+	s.terminated = true
+	paused, cancel, done := s.paused, s.cancel, s.done
+	s.paused = nil
+	s.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if paused != nil {
+		close(paused)
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+// sourcePath chunkname对应的文件路径, 不是文件时返回chunkname本身
+func sourcePath(chunkname string) string {
+	if !strings.HasPrefix(chunkname, "@") {
+		return chunkname
+	}
+	path, err := filepath.Abs(chunkname[1:])
+	if err != nil {
+		return chunkname[1:]
+	}
+	return path
+}
+
+// sourceOf 调用栈中显示的源文件
+func sourceOf(info *vm.DebugInfo) *source {
+	switch {
+	case info.What == "C":
+		return nil
+	case strings.HasPrefix(info.Source, "@"):
+		path := sourcePath(info.Source)
+		return &source{Name: filepath.Base(path), Path: path}
+	default:
+		return &source{Name: info.ShortSrc, PresentationHint: "deemphasize"}
+	}
+}
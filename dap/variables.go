@@ -0,0 +1,368 @@
+package dap
+
+import (
+	"errors"
+	"fmt"
+	"luago/vm"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scopeRef scopes请求返回的变量作用域, 栈帧层级level从0开始
+type scopeRef struct {
+	level int
+	kind  string // "Locals", "Upvalues" 或者 "Globals"
+}
+
+// frameLevel stackTrace返回的栈帧id为层级加1
+func frameLevel(frameID int) int {
+	return frameID - 1
+}
+
+// stackTrace 暂停时的调用栈, 栈帧id只在本次暂停期间有效
+func (s *Session) stackTrace(args stackTraceArguments) (interface{}, error) {
+	var frames []stackFrame
+	err := s.inVM(func(state *vm.State) {
+		for level := 0; ; level++ {
+			info, ok := state.GetInfo(level)
+			if !ok {
+				break
+			}
+			frame := stackFrame{ID: level + 1, Name: frameName(info), Source: sourceOf(info), Line: info.CurrentLine, Column: 1}
+			if frame.Line < 0 {
+				frame.Line, frame.Column = 0, 0
+			}
+			frames = append(frames, frame)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	total := len(frames)
+	if args.StartFrame > 0 && args.StartFrame <= len(frames) {
+		frames = frames[args.StartFrame:]
+	}
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": total}, nil
+}
+
+// frameName 同traceback中的函数描述
+func frameName(info *vm.DebugInfo) string {
+	switch {
+	case info.Name != "":
+		return info.Name
+	case info.What == "main":
+		return "main chunk"
+	case info.What == "C":
+		return "?"
+	default:
+		return fmt.Sprintf("function <%s:%d>", info.ShortSrc, info.LineDefined)
+	}
+}
+
+// scopes 栈帧的局部变量, upvalue和全局变量
+func (s *Session) scopes(frameID int) (interface{}, error) {
+	level := frameLevel(frameID)
+	var valid bool
+	if err := s.inVM(func(state *vm.State) { _, valid = state.GetInfo(level) }); err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid frame id %d", frameID)
+	}
+	var scopes []scope
+	for _, kind := range []string{"Locals", "Upvalues", "Globals"} {
+		scopes = append(scopes, scope{Name: kind, VariablesReference: s.newRef(scopeRef{level, kind}), Expensive: kind == "Globals"})
+	}
+	return map[string]interface{}{"scopes": scopes}, nil
+}
+
+// newRef 为作用域或者table分配variablesReference
+func (s *Session) newRef(v interface{}) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, isTable := v.(vm.LuaTable)
+	if ref, ok := s.tableRefs[t]; ok && isTable {
+		return ref
+	}
+	s.refs = append(s.refs, v)
+	if isTable {
+		s.tableRefs[t] = len(s.refs)
+	}
+	return len(s.refs)
+}
+
+// variables 作用域中的变量或者table的字段
+func (s *Session) variables(ref int) (interface{}, error) {
+	s.mu.Lock()
+	var target interface{}
+	if ref > 0 && ref <= len(s.refs) {
+		target = s.refs[ref-1]
+	}
+	s.mu.Unlock()
+	if target == nil {
+		return nil, fmt.Errorf("invalid variables reference %d", ref)
+	}
+	var vars []variable
+	err := s.inVM(func(state *vm.State) {
+		switch x := target.(type) {
+		case scopeRef:
+			for _, nv := range scopeVars(state, x) {
+				vars = append(vars, s.newVariable(state, nv.name, nv.value))
+			}
+		case vm.LuaTable:
+			for _, k := range tableKeys(x) {
+				vars = append(vars, s.newVariable(state, keyName(k), x.Get(k)))
+			}
+		}
+	})
+	if vars == nil {
+		vars = []variable{}
+	}
+	return map[string]interface{}{"variables": vars}, err
+}
+
+type namedValue struct {
+	name  string
+	value interface{}
+}
+
+// scopeVars 作用域中的变量, 局部变量只包含当前可见的具名变量
+func scopeVars(state *vm.State, ref scopeRef) []namedValue {
+	var vars []namedValue
+	switch ref.kind {
+	case "Locals":
+		for n := 1; ; n++ {
+			name, v, ok := state.GetLocal(ref.level, n)
+			if !ok {
+				break
+			}
+			if !strings.HasPrefix(name, "(") {
+				vars = append(vars, namedValue{name, v})
+			}
+		}
+	case "Upvalues":
+		if info, ok := state.GetInfo(ref.level); ok {
+			for n := 1; ; n++ {
+				name, v, ok := state.GetUpvalue(info.Func, n)
+				if !ok {
+					break
+				}
+				vars = append(vars, namedValue{name, v})
+			}
+		}
+	case "Globals":
+		g := state.Globals()
+		for _, k := range tableKeys(g) {
+			vars = append(vars, namedValue{keyName(k), g.Get(k)})
+		}
+	}
+	return vars
+}
+
+// tableKeys table的全部键, 整数键按大小排在前面, 字符串键按字典序排序
+func tableKeys(t vm.LuaTable) []interface{} {
+	var keys []interface{}
+	for k := t.Next(nil); k != nil; k = t.Next(k) {
+		keys = append(keys, k)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, aInt := keys[i].(int)
+		b, bInt := keys[j].(int)
+		if aInt || bInt {
+			return aInt && (!bInt || a < b)
+		}
+		as, aStr := keys[i].(string)
+		bs, bStr := keys[j].(string)
+		return aStr && bStr && as < bs
+	})
+	return keys
+}
+
+// keyName 变量列表中显示的键, 字符串键直接显示, 其他键显示为 [key]
+func keyName(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return "[" + formatValue(nil, k) + "]"
+}
+
+// newVariable 构造变量, table可以展开
+func (s *Session) newVariable(state *vm.State, name string, v interface{}) variable {
+	r := variable{Name: name, Value: formatValue(state, v), Type: state.TypeName(state.TypeOf(v))}
+	if t, ok := v.(vm.LuaTable); ok {
+		r.VariablesReference = s.newRef(t)
+	}
+	return r
+}
+
+// formatValue 显示的值, 字符串加引号, 其他值同tostring, state为nil时不调用元方法
+func formatValue(state *vm.State, v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return strconv.Quote(x)
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case int:
+		return strconv.Itoa(x)
+	}
+	if state == nil {
+		return fmt.Sprint(v)
+	}
+	str, err := state.ToStringMeta(v)
+	if err != nil {
+		return fmt.Sprintf("<error: %v>", err)
+	}
+	return str
+}
+
+// evaluateRequest 在栈帧中对表达式求值, 没有栈帧时在最内层函数中求值
+func (s *Session) evaluateRequest(args evaluateArguments) (interface{}, error) {
+	level := 0
+	if args.FrameID > 0 {
+		level = frameLevel(args.FrameID)
+	}
+	var result variable
+	var evalErr error
+	if err := s.inVM(func(state *vm.State) {
+		var v interface{}
+		if v, evalErr = s.evaluate(state, level, args.Expression); evalErr == nil {
+			result = s.newVariable(state, "", v)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if evalErr != nil {
+		return nil, evalErr
+	}
+	return map[string]interface{}{
+		"result":             result.Value,
+		"type":               result.Type,
+		"variablesReference": result.VariablesReference,
+	}, nil
+}
+
+// evaluate 在第level层栈帧中对表达式求值, 需在虚拟机goroutine中调用
+// 有Compiler时编译 "return "+expr 并以栈帧的可见局部变量和upvalue作为环境运行, 未定义的名称查找栈帧的_ENV
+// 否则只支持变量名和字段访问
+func (s *Session) evaluate(state *vm.State, level int, expr string) (interface{}, error) {
+	env, ok := frameEnv(state, level)
+	if !ok {
+		return nil, fmt.Errorf("invalid frame level %d", level)
+	}
+	if s.cfg.Compiler == nil {
+		return evalPath(env, expr)
+	}
+	proto, err := s.cfg.Compiler([]byte("return "+expr), "=(eval)")
+	if err != nil {
+		return nil, err
+	}
+	results, err := state.CallFunction(state.NewFunction(proto, env))
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return results[0], nil
+}
+
+// frameEnv 表达式求值的环境, 包含栈帧中可见的局部变量和upvalue, 其他名称通过元表查找栈帧的_ENV
+func frameEnv(state *vm.State, level int) (vm.LuaTable, bool) {
+	if _, ok := state.GetInfo(level); !ok {
+		return nil, false
+	}
+	vars := map[interface{}]interface{}{}
+	var global interface{} = state.Globals()
+	for _, nv := range scopeVars(state, scopeRef{level, "Upvalues"}) {
+		if nv.name == "_ENV" {
+			global = nv.value
+		} else if nv.value != nil {
+			vars[nv.name] = nv.value
+		}
+	}
+	for _, nv := range scopeVars(state, scopeRef{level, "Locals"}) { // 后声明的局部变量覆盖之前的同名变量
+		if nv.name == "_ENV" {
+			global = nv.value
+		} else if nv.value != nil {
+			vars[nv.name] = nv.value
+		} else {
+			delete(vars, nv.name)
+		}
+	}
+	env := vm.GoMapToLuaTable(vars)
+	env.SetMeta(vm.GoMapToLuaTable(map[interface{}]interface{}{"__index": global}))
+	return env, true
+}
+
+// evalPath 不使用编译器求值 "name", "name.field", "name[1]", `name["key"]` 形式的表达式
+func evalPath(env vm.LuaTable, expr string) (interface{}, error) {
+	errSyntax := fmt.Errorf("cannot evaluate '%s' without a compiler", expr)
+	p := strings.TrimSpace(expr)
+	name, rest := splitName(p)
+	if name == "" {
+		return nil, errSyntax
+	}
+	v := rawIndex(env, name)
+	for rest != "" {
+		var key interface{}
+		switch rest[0] {
+		case '.':
+			key, rest = splitName(rest[1:])
+			if key == "" {
+				return nil, errSyntax
+			}
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, errSyntax
+			}
+			k := strings.TrimSpace(rest[1:end])
+			if n, err := strconv.Atoi(k); err == nil {
+				key = n
+			} else if s, err := strconv.Unquote(k); err == nil {
+				key = s
+			} else {
+				return nil, errSyntax
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, errSyntax
+		}
+		t, ok := v.(vm.LuaTable)
+		if !ok {
+			return nil, errors.New("attempt to index a non-table value")
+		}
+		v = rawIndex(t, key)
+	}
+	return v, nil
+}
+
+// rawIndex 不调用元方法索引table, 但是沿着__index指向的table查找
+func rawIndex(t vm.LuaTable, key interface{}) interface{} {
+	for i := 0; t != nil && i < 100; i++ {
+		if v := t.Get(key); v != nil {
+			return v
+		}
+		mt := t.Meta()
+		if mt == nil {
+			return nil
+		}
+		t, _ = mt.Get("__index").(vm.LuaTable)
+	}
+	return nil
+}
+
+// splitName 拆分开头的lua标识符
+func splitName(s string) (string, string) {
+	i := 0
+	for i < len(s) && (s[i] == '_' || 'a' <= s[i] && s[i] <= 'z' || 'A' <= s[i] && s[i] <= 'Z' || i > 0 && '0' <= s[i] && s[i] <= '9') {
+		i++
+	}
+	return s[:i], s[i:]
+}
@@ -1,5 +1,5 @@
 module luago
 
-go 1.18
+go 1.20
 
 require github.com/yuin/gopher-lua v1.1.1
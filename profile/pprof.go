@@ -0,0 +1,179 @@
+package profile
+
+import (
+	"compress/gzip"
+	"io"
+)
+
+// pprof的protobuf格式(profile.proto)中使用的字段编号
+// 参考 https://github.com/google/pprof/blob/main/proto/profile.proto
+const (
+	profileSampleType        = 1
+	profileSample            = 2
+	profileLocation          = 4
+	profileFunction          = 5
+	profileStringTable       = 6
+	profileTimeNanos         = 9
+	profileDurationNanos     = 10
+	profilePeriodType        = 11
+	profilePeriod            = 12
+	profileDefaultSampleType = 14
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+
+	locationID   = 1
+	locationLine = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// protoBuffer protobuf编码, 只包含pprof使用的varint和length-delimited类型
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(x uint64) {
+	for x >= 0x80 {
+		b.data = append(b.data, byte(x)|0x80)
+		x >>= 7
+	}
+	b.data = append(b.data, byte(x))
+}
+
+func (b *protoBuffer) tag(field, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+// uint64 varint类型的字段, 0为默认值不需要编码
+func (b *protoBuffer) uint64(field int, x uint64) {
+	if x != 0 {
+		b.tag(field, 0)
+		b.varint(x)
+	}
+}
+
+func (b *protoBuffer) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) string(field int, s string) {
+	b.bytes(field, []byte(s))
+}
+
+// packed 编码为packed格式的repeated varint字段
+func (b *protoBuffer) packed(field int, xs []uint64) {
+	var p protoBuffer
+	for _, x := range xs {
+		p.varint(x)
+	}
+	b.bytes(field, p.data)
+}
+
+// message 嵌套的消息
+func (b *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	b.bytes(field, m.data)
+}
+
+// WriteTo 以gzip压缩的pprof格式写入w, 可以使用 go tool pprof 查看
+func (p *Profile) WriteTo(w io.Writer) (int64, error) {
+	strs := map[string]int{"": 0}
+	table := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(table)
+			strs[s] = i
+			table = append(table, s)
+		}
+		return uint64(i)
+	}
+
+	var b protoBuffer
+	valueType := func(field int, vt valueType) {
+		b.message(field, func(m *protoBuffer) {
+			m.uint64(valueTypeType, str(vt.typ))
+			m.uint64(valueTypeUnit, str(vt.unit))
+		})
+	}
+	for _, vt := range sampleTypes {
+		valueType(profileSampleType, vt)
+	}
+	for _, s := range p.Samples {
+		b.message(profileSample, func(m *protoBuffer) {
+			m.packed(sampleLocationID, s.Locations)
+			m.packed(sampleValue, []uint64{uint64(s.Instructions), uint64(s.Nanoseconds)})
+		})
+	}
+	for i, loc := range p.Locations {
+		b.message(profileLocation, func(m *protoBuffer) {
+			m.uint64(locationID, uint64(i+1))
+			m.message(locationLine, func(l *protoBuffer) {
+				l.uint64(lineFunctionID, loc.Function)
+				l.int64(lineLine, int64(loc.Line))
+			})
+		})
+	}
+	for i, fn := range p.Functions {
+		b.message(profileFunction, func(m *protoBuffer) {
+			m.uint64(functionID, uint64(i+1))
+			m.uint64(functionName, str(fn.Name))
+			m.uint64(functionSystemName, str(fn.Name))
+			m.uint64(functionFilename, str(fn.Filename))
+			m.int64(functionStartLine, int64(fn.StartLine))
+		})
+	}
+	b.int64(profileTimeNanos, p.Start.UnixNano())
+	b.int64(profileDurationNanos, int64(p.Duration))
+	period := sampleTypes[0] // 按指令数采样时默认显示指令数, 按时间采样时默认显示时间
+	if p.Period > 0 {
+		period = sampleTypes[1]
+	}
+	b.uint64(profileDefaultSampleType, str(period.typ))
+	valueType(profilePeriodType, period)
+	if p.Period > 0 {
+		b.int64(profilePeriod, int64(p.Period))
+	} else {
+		b.int64(profilePeriod, int64(p.Instructions))
+	}
+	for _, s := range table { // 字符串表必须在最后编码, 之前的字段会添加字符串
+		b.string(profileStringTable, s)
+	}
+
+	cw := &countWriter{w: w}
+	zw := gzip.NewWriter(cw)
+	if _, err := zw.Write(b.data); err != nil {
+		return cw.n, err
+	}
+	err := zw.Close()
+	return cw.n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,222 @@
+// Package profile 统计lua函数和源码行执行的指令数和时间, 输出pprof格式供 go tool pprof 分析(如火焰图)
+//
+//	p := profile.Start(state, profile.Options{})
+//	state.Run()
+//	p.Stop().WriteTo(f)
+//
+// 默认按指令数确定性地统计每条指令, Options.Period 大于0时按时间间隔采样, 对脚本运行速度的影响较小
+package profile
+
+import (
+	"encoding/binary"
+	"luago/vm"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options 性能分析的配置
+type Options struct {
+	// Period 按时间采样的间隔, 为0时按照指令数确定性地采样
+	Period time.Duration
+	// Instructions 按指令数采样时每次采样间隔的指令数, 默认为1(统计每一条指令)
+	Instructions int
+}
+
+// sampleCheckInterval 按时间采样时检查是否到达采样时间的指令间隔
+const sampleCheckInterval = 100
+
+type valueType struct {
+	typ, unit string
+}
+
+// sampleTypes 每个采样记录的值
+var sampleTypes = []valueType{{"instructions", "count"}, {"time", "nanoseconds"}}
+
+// Profile 分析结果, id为Functions和Locations的下标加1(同pprof)
+type Profile struct {
+	Start        time.Time
+	Duration     time.Duration
+	Period       time.Duration // 按时间采样的间隔, 0表示按指令数采样
+	Instructions int           // 按指令数采样的间隔
+	Functions    []Function
+	Locations    []Location
+	Samples      []*Sample
+}
+
+// Function lua函数或者go函数
+type Function struct {
+	Name      string // 同traceback中的函数名称, 如 "add", "main chunk", "function <a.lua:12>"
+	Filename  string // 源文件, go函数为 "[C]"
+	StartLine int
+}
+
+// Location 函数中的一行
+type Location struct {
+	Function uint64
+	Line     int
+}
+
+// Sample 相同调用栈的采样汇总
+type Sample struct {
+	Locations    []uint64 // 调用栈, 正在执行的函数在前
+	Instructions int64    // 执行的指令数
+	Nanoseconds  int64    // 经过的时间
+}
+
+// Profiler 正在进行的性能分析
+type Profiler struct {
+	state    *vm.State
+	interval int           // count事件的指令间隔
+	period   time.Duration // 按时间采样的间隔
+	next     time.Time     // 按时间采样时下一次采样的时间
+	last     time.Time     // 上一次采样的时间
+	pending  int           // 上一次采样之后执行的指令数
+	stack    []vm.StackEntry
+	funcs    map[interface{}]uint64 // 按lua函数原型或者go函数区分的函数id
+	locs     map[Location]uint64
+	samples  map[string]*Sample // 按调用栈汇总的采样
+	sample   *Sample            // 最近一次采样计入的调用栈
+	profile  *Profile
+}
+
+// Start 开始分析state上运行的lua代码, 替换state已有的钩子(如debug.sethook)
+// Start和Stop需要在脚本没有运行时或者在运行脚本的goroutine中调用
+// 按时间采样不使用额外的goroutine, 每sampleCheckInterval条指令检查一次时间
+func Start(state *vm.State, opts Options) *Profiler {
+	if opts.Instructions <= 0 {
+		opts.Instructions = 1
+	}
+	now := time.Now()
+	p := &Profiler{
+		state:    state,
+		interval: opts.Instructions,
+		period:   opts.Period,
+		next:     now.Add(opts.Period),
+		last:     now,
+		funcs:    make(map[interface{}]uint64),
+		locs:     make(map[Location]uint64),
+		samples:  make(map[string]*Sample),
+		profile:  &Profile{Start: now, Period: opts.Period, Instructions: opts.Instructions},
+	}
+	if opts.Period > 0 {
+		p.interval = sampleCheckInterval
+	}
+	state.SetHook(vm.HookCount|vm.HookReturn, p.interval, p.hook)
+	return p
+}
+
+// Stop 结束分析, 移除钩子并返回分析结果
+// 最后一次采样之后计数的指令计入当前调用栈, 脚本已经运行结束时计入最近一次采样的调用栈
+func (p *Profiler) Stop() *Profile {
+	if p.pending > 0 {
+		if p.state.StackDepth() > 0 {
+			p.record(p.state, int64(p.pending), 0)
+		} else if p.sample != nil {
+			p.sample.Instructions += int64(p.pending)
+		}
+		p.pending = 0
+	}
+	p.state.SetHook(0, 0, nil)
+	p.profile.Duration = time.Since(p.profile.Start)
+	return p.profile
+}
+
+// hook 每执行interval条指令采样一次, go函数返回时采样以统计go函数运行的时间
+// 按时间采样时只在到达采样时间后记录, 期间的指令数和时间都计入采样时的调用栈
+func (p *Profiler) hook(ev vm.HookEvent) {
+	if ev.Event == vm.HookCount {
+		p.pending += p.interval
+	} else if !ev.IsGoFunction() {
+		return
+	}
+	now := time.Now()
+	if p.period > 0 {
+		if now.Before(p.next) {
+			return
+		}
+		p.next = now.Add(p.period)
+	}
+	instructions := 0
+	if ev.Event == vm.HookCount { // go函数返回时的指令属于调用者
+		instructions, p.pending = p.pending, 0
+	}
+	p.record(ev.State, int64(instructions), int64(now.Sub(p.last)))
+	p.last = now
+}
+
+// record 将指令数和时间计入当前调用栈
+func (p *Profiler) record(state *vm.State, instructions, nanoseconds int64) {
+	p.stack = state.CallStack(p.stack[:0])
+	locs := make([]uint64, len(p.stack))
+	key := make([]byte, 0, len(p.stack)*2)
+	var buf [binary.MaxVarintLen64]byte
+	for level, entry := range p.stack {
+		locs[level] = p.location(state, level, entry)
+		key = append(key, buf[:binary.PutUvarint(buf[:], locs[level])]...)
+	}
+	s, ok := p.samples[string(key)]
+	if !ok {
+		s = &Sample{Locations: locs}
+		p.samples[string(key)] = s
+		p.profile.Samples = append(p.profile.Samples, s)
+	}
+	s.Instructions += instructions
+	s.Nanoseconds += nanoseconds
+	p.sample = s
+}
+
+// location 第level层栈帧对应的位置id
+func (p *Profiler) location(state *vm.State, level int, entry vm.StackEntry) uint64 {
+	var key interface{} = entry.Func
+	if entry.Proto != nil {
+		key = entry.Proto
+	}
+	fn, ok := p.funcs[key]
+	if !ok {
+		info, _ := state.GetInfo(level)
+		p.profile.Functions = append(p.profile.Functions, Function{
+			Name:      funcName(info),
+			Filename:  fileName(info),
+			StartLine: info.LineDefined,
+		})
+		fn = uint64(len(p.profile.Functions))
+		p.funcs[key] = fn
+	}
+	loc := Location{Function: fn, Line: entry.Line}
+	if loc.Line < 0 {
+		loc.Line = 0
+	}
+	id, ok := p.locs[loc]
+	if !ok {
+		p.profile.Locations = append(p.profile.Locations, loc)
+		id = uint64(len(p.profile.Locations))
+		p.locs[loc] = id
+	}
+	return id
+}
+
+// funcName 同traceback中的函数描述, 以第一次采样时推断的名称为准
+func funcName(info *vm.DebugInfo) string {
+	switch {
+	case info.Name != "":
+		return info.Name
+	case info.What == "main":
+		return "main chunk"
+	case info.What == "C":
+		return "?"
+	default:
+		return "function <" + info.ShortSrc + ":" + strconv.Itoa(info.LineDefined) + ">"
+	}
+}
+
+// fileName 源文件名称, 去掉chunkname开头的'@'或者'='
+func fileName(info *vm.DebugInfo) string {
+	if info.What == "C" {
+		return "[C]"
+	}
+	if strings.HasPrefix(info.Source, "@") || strings.HasPrefix(info.Source, "=") {
+		return info.Source[1:]
+	}
+	return info.ShortSrc
+}
@@ -0,0 +1,161 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"luago/chunk"
+	"luago/vm"
+	"luago/vm/api"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const script = `local function fib(n)
+  if n < 2 then return n end
+  return fib(n - 1) + fib(n - 2)
+end
+local function work()
+  local s = string.rep("x", 100000)
+  return #s
+end
+for i = 1, 10 do work() end
+return fib(15)
+`
+
+// loadScript 使用官方luac编译source, 在临时目录中编译使源文件名为bench.lua
+func loadScript(t *testing.T, source string) *vm.State {
+	luac, err := filepath.Abs("../lua-5.3.6/src/luac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bench.lua"), []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(luac, "-o", "bench.out", "bench.lua")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "bench.out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := vm.NewState()
+	state.Load(chunk.Undump(data))
+	return state
+}
+
+// countInstructions 运行source执行的指令数
+func countInstructions(t *testing.T, source string) int64 {
+	state := loadScript(t, source)
+	state.Register("stop", func(api.State, ...interface{}) []interface{} { return nil })
+	var total int64
+	state.SetHook(vm.HookCount, 1, func(vm.HookEvent) { total++ })
+	state.Run()
+	return total
+}
+
+func TestProfile(t *testing.T) {
+	total := countInstructions(t, script)
+	state := loadScript(t, script)
+	p := Start(state, Options{})
+	state.Run()
+	prof := p.Stop()
+
+	var instructions int64
+	lines := map[string]int64{} // 按 "函数:行" 汇总正在执行的指令数
+	var goCalls int
+	for _, s := range prof.Samples {
+		instructions += s.Instructions
+		loc := prof.Locations[s.Locations[0]-1]
+		fn := prof.Functions[loc.Function-1]
+		if fn.Filename == "[C]" {
+			if fn.Name != "rep" || s.Instructions != 0 || prof.Functions[prof.Locations[s.Locations[1]-1].Function-1].Name != "work" {
+				t.Fatalf("unexpected go function sample: %v %v", fn, s)
+			}
+			goCalls++
+		} else if fn.Filename != "bench.lua" {
+			t.Fatalf("unexpected function: %v", fn)
+		}
+		lines[fn.Name+":"+strconv.Itoa(loc.Line)] += s.Instructions
+	}
+	if instructions != total {
+		t.Fatalf("expected %d instructions, got %d", total, instructions)
+	}
+	if goCalls != 1 {
+		t.Fatalf("expected one go function stack, got %d", goCalls)
+	}
+	if lines["fib:3"] <= lines["work:6"] || lines["fib:2"] == 0 || lines["main chunk:9"] == 0 {
+		t.Fatalf("unexpected line profile: %v", lines)
+	}
+
+	var buf bytes.Buffer
+	if n, err := prof.WriteTo(&buf); err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo: %d %v", n, err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data bytes.Buffer
+	if _, err := data.ReadFrom(zr); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data.Bytes(), []byte("instructions")) || !bytes.Contains(data.Bytes(), []byte("bench.lua")) {
+		t.Fatal("missing strings in profile")
+	}
+	// 按指令数采样时默认显示指令数: default_sample_type(14)为字符串表中"instructions"的下标
+	if !bytes.Contains(data.Bytes(), []byte{profileDefaultSampleType << 3, 1}) {
+		t.Fatal("missing default sample type")
+	}
+}
+
+// TestProfileStop 最后一次采样之后计数的指令在Stop时计入
+func TestProfileStop(t *testing.T) {
+	// 在脚本中Stop, 计入当前调用栈
+	source := "local n = 0\nfor i = 1, 1000 do n = n + i end\nstop()\n"
+	total := countInstructions(t, source)
+	state := loadScript(t, source)
+	var p *Profiler
+	var prof *Profile
+	state.Register("stop", func(api.State, ...interface{}) []interface{} {
+		prof = p.Stop()
+		return nil
+	})
+	p = Start(state, Options{Period: time.Hour})
+	state.Run()
+	if n := sumInstructions(prof); n != total/sampleCheckInterval*sampleCheckInterval || len(prof.Samples) != 1 ||
+		prof.Functions[prof.Locations[prof.Samples[0].Locations[1]-1].Function-1].Name != "main chunk" {
+		t.Fatalf("unexpected profile: %d %v %v", n, prof.Samples, prof.Functions)
+	}
+}
+
+func sumInstructions(prof *Profile) int64 {
+	var n int64
+	for _, s := range prof.Samples {
+		n += s.Instructions
+	}
+	return n
+}
+
+func TestProfilePeriod(t *testing.T) {
+	state := loadScript(t, script)
+	p := Start(state, Options{Period: time.Microsecond})
+	state.Run()
+	prof := p.Stop()
+	if prof.Period != time.Microsecond || len(prof.Samples) == 0 {
+		t.Fatalf("unexpected profile: %v", prof)
+	}
+	var nanoseconds int64
+	for _, s := range prof.Samples {
+		nanoseconds += s.Nanoseconds
+	}
+	if nanoseconds <= 0 || nanoseconds > int64(prof.Duration) {
+		t.Fatalf("unexpected sampled time %d of %v", nanoseconds, prof.Duration)
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+/* basic types */
+const (
+	LUA_TNONE = iota - 1 // -1
+	LUA_TNIL
+	LUA_TBOOLEAN
+	LUA_TLIGHTUSERDATA
+	LUA_TNUMBER
+	LUA_TSTRING
+	LUA_TTABLE
+	LUA_TFUNCTION
+	LUA_TUSERDATA
+	LUA_TTHREAD
+	LUA_NUMTAGS
+)
+
+/* thread status */
+const (
+	LUA_OK = iota
+	LUA_YIELD
+	LUA_ERRRUN
+	LUA_ERRSYNTAX
+	LUA_ERRMEM
+	LUA_ERRGCMM
+	LUA_ERRERR
+	LUA_ERRFILE
+)
+
+/* comparison functions */
+const (
+	LUA_OPEQ = iota // ==
+	LUA_OPLT        // <
+	LUA_OPLE        // <=
+)
+
+const LUA_MULTRET = -1  // Call/PCall 返回全部结果
+const LUA_MINSTACK = 20 // go函数可以直接使用的最少栈空间
+const LUAI_MAXSTACK = 1000000
+const LUA_REGISTRYINDEX = -LUAI_MAXSTACK - 1000 // 注册表伪索引
+
+/* predefined values in the registry */
+const (
+	LUA_RIDX_MAINTHREAD = 1
+	LUA_RIDX_GLOBALS    = 2
+	LUA_RIDX_LAST       = LUA_RIDX_GLOBALS
+)
+
+/* reference system */
+const (
+	LUA_NOREF  = -2 // 无效引用
+	LUA_REFNIL = -1 // nil值的引用
+)
+
+// UpvalueIndex 当前go闭包第i个(从1开始)upvalue的伪索引
+func UpvalueIndex(i int) int {
+	return LUA_REGISTRYINDEX - i
+}
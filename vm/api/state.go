@@ -1,16 +1,110 @@
 package api
 
-import "luago/chunk"
+import (
+	"context"
+	"luago/chunk"
+	"unsafe"
+)
 
 // lua调用的go函数
+// 调用时参数同时位于go函数独立的栈帧中(索引1..n), 可以通过args或者栈操作接口获取
 type GoFunc func(State, ...interface{}) []interface{}
 
 // 暴露给外部使用的虚拟机状态
 type State interface {
-	// Pop() interface{} //Pop a value from lua vm stack
-	// Push(interface{})        //Push a value to lua vm stack
-	Load(proto *chunk.Prototype)
-	Register(string, GoFunc) //Register a Go function to lua vm
-	Run()
-	CallByParam(funcName string, args ...interface{}) ([]interface{}, error) //Call global function
+	BasicAPI
+	Load(proto *chunk.Prototype, env ...interface{}) interface{}                                //Load a chunk, returns its main function
+	Register(string, GoFunc)                                                                    //Register a Go function to lua vm
+	Run()                                                                                       //Run the last loaded chunk
+	CallByParam(funcName string, args ...interface{}) ([]interface{}, error)                    //Call global function
+	CallFunction(f interface{}, args ...interface{}) ([]interface{}, error)                     //Call function value in protected mode
+	RunContext(ctx context.Context) error                                                       //Run the last loaded chunk until ctx is done
+	CallContext(ctx context.Context, f interface{}, args ...interface{}) ([]interface{}, error) //Call function value until ctx is done
+}
+
+// BasicAPI 参照lua C API的栈操作接口
+// 索引规则同C API: 正数为栈底开始的绝对索引(从1开始), 负数为栈顶开始的相对索引(-1为栈顶),
+// LUA_REGISTRYINDEX 为注册表伪索引, UpvalueIndex(i) 为当前go闭包upvalue伪索引
+type BasicAPI interface {
+	/* basic stack manipulation */
+	GetTop() int
+	AbsIndex(idx int) int
+	CheckStack(n int) bool
+	Pop(n int)
+	Copy(fromIdx, toIdx int)
+	PushValue(idx int)
+	Replace(idx int)
+	Insert(idx int)
+	Remove(idx int)
+	Rotate(idx, n int)
+	SetTop(idx int)
+	/* access functions (stack -> Go) */
+	TypeName(tp int) string
+	Type(idx int) int
+	IsNone(idx int) bool
+	IsNil(idx int) bool
+	IsNoneOrNil(idx int) bool
+	IsBoolean(idx int) bool
+	IsInteger(idx int) bool
+	IsNumber(idx int) bool
+	IsString(idx int) bool
+	IsTable(idx int) bool
+	IsFunction(idx int) bool
+	IsGoFunction(idx int) bool
+	IsUserData(idx int) bool
+	ToBoolean(idx int) bool
+	ToInteger(idx int) int
+	ToIntegerX(idx int) (int, bool)
+	ToNumber(idx int) float64
+	ToNumberX(idx int) (float64, bool)
+	ToString(idx int) string
+	ToStringX(idx int) (string, bool)
+	ToGoFunction(idx int) GoFunc
+	ToUserData(idx int) interface{}
+	ToValue(idx int) interface{}
+	RawLen(idx int) int
+	RawEqual(idx1, idx2 int) bool
+	Compare(idx1, idx2 int, op int) bool
+	/* push functions (Go -> stack) */
+	PushNil()
+	PushBoolean(b bool)
+	PushInteger(n int)
+	PushNumber(n float64)
+	PushString(s string)
+	PushFString(fmt string, args ...interface{}) string
+	PushGoFunction(f GoFunc)
+	PushGoClosure(f GoFunc, n int)
+	PushLightUserData(p unsafe.Pointer)
+	PushUserData(v interface{})
+	PushGlobalTable()
+	Push(v interface{})
+	/* get functions (Lua -> stack) */
+	NewTable()
+	CreateTable(nArr, nRec int)
+	GetTable(idx int) int
+	GetField(idx int, k string) int
+	GetI(idx int, i int) int
+	RawGet(idx int) int
+	RawGetI(idx int, i int) int
+	GetMetatable(idx int) bool
+	GetGlobal(name string) int
+	/* set functions (stack -> Lua) */
+	SetTable(idx int)
+	SetField(idx int, k string)
+	SetI(idx int, i int)
+	RawSet(idx int)
+	RawSetI(idx int, i int)
+	SetMetatable(idx int)
+	SetGlobal(name string, v ...interface{})
+	/* 'load' and 'call' functions */
+	Call(nArgs, nResults int)
+	PCall(nArgs, nResults, msgh int) int
+	/* miscellaneous functions */
+	Error() int
+	Next(idx int) bool
+	Len(idx int)
+	Concat(n int)
+	/* reference system */
+	Ref(t int) int
+	Unref(t, ref int)
 }
@@ -0,0 +1,98 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+)
+
+/* 'load' and 'call' functions */
+
+// Call 调用函数: 依次弹出nArgs个参数和函数, 压入nResults个返回值(LUA_MULTRET返回全部)
+func (vm *State) Call(nArgs, nResults int) {
+	stack := vm.stack
+	args := stack.popN(nArgs)
+	f := stack.pop()
+	results := vm.callValue(f, args)
+	stack.pushN(results, nResults)
+}
+
+// PCall 保护模式调用函数, 成功时同Call并返回 LUA_OK
+// 出错时压入错误对象并返回错误状态码, msgh不为0时为消息处理函数的索引, 在出错位置调用处理错误对象
+func (vm *State) PCall(nArgs, nResults, msgh int) int {
+	stack := vm.stack
+	var handler luaValue
+	if msgh != 0 {
+		handler = stack.get(msgh)
+	}
+	args := stack.popN(nArgs)
+	f := stack.pop()
+	if results, err := vm.pcall(f, args, handler); err != nil {
+		stack.push(err.Value)
+		return err.Status
+	} else {
+		stack.pushN(results, nResults)
+		return api.LUA_OK
+	}
+}
+
+/* miscellaneous functions */
+
+// Error 以栈顶值作为错误对象抛出错误, 不会返回
+func (vm *State) Error() int {
+	panic(&LuaError{Value: vm.stack.pop(), Status: api.LUA_ERRRUN})
+}
+
+// Next 弹出key, 压入table中的下一组key-value, 遍历结束时返回false并且不压入任何值
+func (vm *State) Next(idx int) bool {
+	t := vm.checkTable(idx)
+	k := vm.stack.pop()
+	if nextKey := t.Next(k); nextKey != nil {
+		vm.stack.push(nextKey)
+		vm.stack.push(t.Get(nextKey))
+		return true
+	}
+	return false
+}
+
+// Len 压入idx处值的长度(可能调用元方法 __len)
+func (vm *State) Len(idx int) {
+	vm.stack.push(vm.length(vm.stack.get(idx)))
+}
+
+// Concat 弹出n个值拼接后压栈(可能调用元方法 __concat), n为0时压入空字符串
+func (vm *State) Concat(n int) {
+	if n < 0 {
+		panic(fmt.Sprintf("invalid concat count %d", n))
+	}
+	vm.stack.push(vm.concat(vm.stack.popN(n)))
+}
+
+/* reference system */
+
+// Ref 弹出栈顶值, 在idx处的table(通常是注册表)中为其创建唯一的整数引用并返回
+// 栈顶值为nil时返回 LUA_REFNIL, 释放的引用通过t[0]组成的空闲链表复用
+func (vm *State) Ref(t int) int {
+	tb := vm.checkTable(t)
+	val := vm.stack.pop()
+	if val == nil {
+		return api.LUA_REFNIL
+	}
+	var ref int
+	if free, _ := tb.Get(0).(int); free != 0 {
+		ref = free
+		tb.Put(0, tb.Get(ref))
+	} else {
+		ref = tb.Len() + 1
+	}
+	tb.Put(ref, val)
+	return ref
+}
+
+// Unref 释放idx处table中的引用ref, 之后该引用可以被Ref复用
+func (vm *State) Unref(t, ref int) {
+	if ref >= 0 {
+		tb := vm.checkTable(t)
+		tb.Put(ref, tb.Get(0))
+		tb.Put(0, ref)
+	}
+}
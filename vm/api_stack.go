@@ -0,0 +1,317 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"unsafe"
+)
+
+/* basic stack manipulation */
+
+// GetTop 栈顶索引(栈中元素个数)
+func (vm *State) GetTop() int {
+	return vm.stack.top
+}
+
+// AbsIndex 转换为绝对索引
+func (vm *State) AbsIndex(idx int) int {
+	return vm.stack.absIndex(idx)
+}
+
+// CheckStack 确保栈中还有至少n个空闲位置
+func (vm *State) CheckStack(n int) bool {
+	vm.stack.check(vm.stack.top + n)
+	return true
+}
+
+// Pop 弹出n个值
+func (vm *State) Pop(n int) {
+	vm.SetTop(-n - 1)
+}
+
+// Copy 将fromIdx处的值复制到toIdx
+func (vm *State) Copy(fromIdx, toIdx int) {
+	vm.stack.set(toIdx, vm.stack.get(fromIdx))
+}
+
+// PushValue 将idx处的值复制到栈顶
+func (vm *State) PushValue(idx int) {
+	vm.stack.push(vm.stack.get(idx))
+}
+
+// Replace 弹出栈顶值并写入idx
+func (vm *State) Replace(idx int) {
+	val := vm.stack.pop()
+	vm.stack.set(idx, val)
+}
+
+// Insert 将栈顶值移动到idx, idx之上的值上移
+func (vm *State) Insert(idx int) {
+	vm.Rotate(idx, 1)
+}
+
+// Remove 删除idx处的值, idx之上的值下移
+func (vm *State) Remove(idx int) {
+	vm.Rotate(idx, -1)
+	vm.Pop(1)
+}
+
+// Rotate 将[idx, top]区间内的值向栈顶方向旋转n个位置(n为负数时向栈底方向)
+func (vm *State) Rotate(idx, n int) {
+	t := vm.stack.top - 1
+	p := vm.stack.absIndex(idx) - 1
+	var m int
+	if n >= 0 {
+		m = t - n
+	} else {
+		m = p - n - 1
+	}
+	vm.stack.reverse(p, m)
+	vm.stack.reverse(m+1, t)
+	vm.stack.reverse(p, t)
+}
+
+// SetTop 设置栈顶索引, 多余的值被弹出, 不足的位置填充nil
+func (vm *State) SetTop(idx int) {
+	newTop := vm.stack.absIndex(idx)
+	if newTop < 0 {
+		panic("stack underflow!")
+	}
+	if n := vm.stack.top - newTop; n > 0 {
+		vm.stack.popN(n)
+	} else {
+		for ; n < 0; n++ {
+			vm.stack.push(nil)
+		}
+	}
+}
+
+/* access functions (stack -> Go) */
+
+func (vm *State) TypeName(tp int) string {
+	return typeName(tp)
+}
+
+// Type idx处值的类型, 无效索引返回 LUA_TNONE
+func (vm *State) Type(idx int) int {
+	if vm.stack.isValid(idx) {
+		return typeOf(vm.stack.get(idx))
+	}
+	return LUA_TNONE
+}
+
+// TypeOf 值v的类型, 如ToValue或者GetLocal获取的值
+func (vm *State) TypeOf(v interface{}) int {
+	return typeOf(v)
+}
+
+func (vm *State) IsNone(idx int) bool {
+	return vm.Type(idx) == LUA_TNONE
+}
+
+func (vm *State) IsNil(idx int) bool {
+	return vm.Type(idx) == LUA_TNIL
+}
+
+func (vm *State) IsNoneOrNil(idx int) bool {
+	return vm.Type(idx) <= LUA_TNIL
+}
+
+func (vm *State) IsBoolean(idx int) bool {
+	return vm.Type(idx) == LUA_TBOOLEAN
+}
+
+func (vm *State) IsInteger(idx int) bool {
+	_, ok := vm.stack.get(idx).(int)
+	return ok
+}
+
+// IsNumber 是否为数字或者可以转换为数字的字符串
+func (vm *State) IsNumber(idx int) bool {
+	_, ok := vm.ToNumberX(idx)
+	return ok
+}
+
+// IsString 是否为字符串或者数字
+func (vm *State) IsString(idx int) bool {
+	tp := vm.Type(idx)
+	return tp == LUA_TSTRING || tp == LUA_TNUMBER
+}
+
+func (vm *State) IsTable(idx int) bool {
+	return vm.Type(idx) == LUA_TTABLE
+}
+
+func (vm *State) IsFunction(idx int) bool {
+	return vm.Type(idx) == LUA_TFUNCTION
+}
+
+func (vm *State) IsGoFunction(idx int) bool {
+	c, ok := vm.stack.get(idx).(*closure)
+	return ok && c.goFunc != nil
+}
+
+// IsUserData 是否为userdata(full或light)
+func (vm *State) IsUserData(idx int) bool {
+	tp := vm.Type(idx)
+	return tp == LUA_TUSERDATA || tp == LUA_TLIGHTUSERDATA
+}
+
+func (vm *State) ToBoolean(idx int) bool {
+	return toBool(vm.stack.get(idx))
+}
+
+func (vm *State) ToInteger(idx int) int {
+	i, _ := vm.ToIntegerX(idx)
+	return i
+}
+
+// ToIntegerX 转换为整数, 浮点数必须没有小数部分, 字符串必须是合法数字
+func (vm *State) ToIntegerX(idx int) (int, bool) {
+	return convertToInteger(vm.stack.get(idx))
+}
+
+func (vm *State) ToNumber(idx int) float64 {
+	n, _ := vm.ToNumberX(idx)
+	return n
+}
+
+// ToNumberX 转换为浮点数, 字符串必须是合法数字
+func (vm *State) ToNumberX(idx int) (float64, bool) {
+	return convertToFloat(vm.stack.get(idx))
+}
+
+func (vm *State) ToString(idx int) string {
+	s, _ := vm.ToStringX(idx)
+	return s
+}
+
+// ToStringX 转换为字符串, 只有字符串和数字可以转换
+func (vm *State) ToStringX(idx int) (string, bool) {
+	return toString(vm.stack.get(idx))
+}
+
+// ToGoFunction 获取go函数, 不是go函数返回nil
+func (vm *State) ToGoFunction(idx int) api.GoFunc {
+	if c, ok := vm.stack.get(idx).(*closure); ok {
+		return c.goFunc
+	}
+	return nil
+}
+
+// ToUserData 获取full userdata包装的golang值或者light userdata的指针
+func (vm *State) ToUserData(idx int) interface{} {
+	switch x := vm.stack.get(idx).(type) {
+	case *UserData:
+		return x.Value
+	case LightUserData:
+		return unsafe.Pointer(x)
+	}
+	return nil
+}
+
+// ToValue 获取idx处原始的lua值
+func (vm *State) ToValue(idx int) interface{} {
+	return vm.stack.get(idx)
+}
+
+// RawLen 不调用元方法获取长度
+func (vm *State) RawLen(idx int) int {
+	switch x := vm.stack.get(idx).(type) {
+	case string:
+		return len(x)
+	case LuaTable:
+		return x.Len()
+	default:
+		return 0
+	}
+}
+
+// RawEqual 不调用元方法比较是否相等
+func (vm *State) RawEqual(idx1, idx2 int) bool {
+	if !vm.stack.isValid(idx1) || !vm.stack.isValid(idx2) {
+		return false
+	}
+	return rawEqual(vm.stack.get(idx1), vm.stack.get(idx2))
+}
+
+// Compare 比较两个值, op为 LUA_OPEQ/LUA_OPLT/LUA_OPLE, 会调用元方法
+func (vm *State) Compare(idx1, idx2 int, op int) bool {
+	if !vm.stack.isValid(idx1) || !vm.stack.isValid(idx2) {
+		return false
+	}
+	a, b := vm.stack.get(idx1), vm.stack.get(idx2)
+	var result bool
+	var err error
+	switch op {
+	case api.LUA_OPEQ:
+		return vm.compareEq(a, b)
+	case api.LUA_OPLT:
+		result, err = vm.compareLt(a, b)
+	case api.LUA_OPLE:
+		result, err = vm.compareLe(a, b)
+	default:
+		panic("invalid compare op!")
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	return result
+}
+
+/* push functions (Go -> stack) */
+
+func (vm *State) PushNil() {
+	vm.stack.push(nil)
+}
+
+func (vm *State) PushBoolean(b bool) {
+	vm.stack.push(b)
+}
+
+func (vm *State) PushInteger(n int) {
+	vm.stack.push(n)
+}
+
+func (vm *State) PushNumber(n float64) {
+	vm.stack.push(n)
+}
+
+func (vm *State) PushString(s string) {
+	vm.stack.push(s)
+}
+
+// PushFString 压入格式化后的字符串并返回
+func (vm *State) PushFString(format string, args ...interface{}) string {
+	s := fmt.Sprintf(format, args...)
+	vm.stack.push(s)
+	return s
+}
+
+func (vm *State) PushGoFunction(f api.GoFunc) {
+	vm.stack.push(newGoClosure(f))
+}
+
+// PushGoClosure 弹出n个值作为upvalue, 压入go闭包
+func (vm *State) PushGoClosure(f api.GoFunc, n int) {
+	upvals := vm.stack.popN(n)
+	vm.stack.push(newGoClosure(f, upvals...))
+}
+
+func (vm *State) PushLightUserData(p unsafe.Pointer) {
+	vm.stack.push(LightUserData(p))
+}
+
+// PushUserData 压入包装golang值v的full userdata(没有元表)
+func (vm *State) PushUserData(v interface{}) {
+	vm.stack.push(NewUserData(v, nil))
+}
+
+func (vm *State) PushGlobalTable() {
+	vm.stack.push(vm.registry.Get(api.LUA_RIDX_GLOBALS))
+}
+
+// Push 压入任意值, golang值通过反射转换为lua值(见 ToLuaValue)
+func (vm *State) Push(v interface{}) {
+	vm.stack.push(vm.ToLuaValue(v))
+}
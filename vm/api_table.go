@@ -0,0 +1,135 @@
+package vm
+
+import "luago/vm/api"
+
+/* get functions (Lua -> stack) */
+
+func (vm *State) NewTable() {
+	vm.CreateTable(0, 0)
+}
+
+// CreateTable 创建预分配nArr个数组元素和nRec个哈希元素空间的table并压栈
+func (vm *State) CreateTable(nArr, nRec int) {
+	vm.stack.push(newLuaTable(nArr, nRec))
+}
+
+// GetTable 弹出key, 压入t[key](可能调用元方法), 返回值类型
+func (vm *State) GetTable(idx int) int {
+	t := vm.stack.get(idx)
+	k := vm.stack.pop()
+	return vm.pushIndex(t, k)
+}
+
+// GetField 压入t[k](可能调用元方法), 返回值类型
+func (vm *State) GetField(idx int, k string) int {
+	return vm.pushIndex(vm.stack.get(idx), k)
+}
+
+// GetI 压入t[i](可能调用元方法), 返回值类型
+func (vm *State) GetI(idx int, i int) int {
+	return vm.pushIndex(vm.stack.get(idx), i)
+}
+
+// RawGet 弹出key, 压入t[key](不调用元方法), 返回值类型
+func (vm *State) RawGet(idx int) int {
+	t := vm.checkTable(idx)
+	k := vm.stack.pop()
+	v := t.Get(k)
+	vm.stack.push(v)
+	return typeOf(v)
+}
+
+// RawGetI 压入t[i](不调用元方法), 返回值类型
+func (vm *State) RawGetI(idx int, i int) int {
+	v := vm.checkTable(idx).Get(i)
+	vm.stack.push(v)
+	return typeOf(v)
+}
+
+// GetMetatable 值有元表时压入元表并返回true
+func (vm *State) GetMetatable(idx int) bool {
+	if mt := vm.getMetatable(vm.stack.get(idx)); mt != nil {
+		vm.stack.push(mt)
+		return true
+	}
+	return false
+}
+
+// GetGlobal 压入全局变量name, 返回值类型
+func (vm *State) GetGlobal(name string) int {
+	return vm.pushIndex(vm.registry.Get(api.LUA_RIDX_GLOBALS), name)
+}
+
+func (vm *State) pushIndex(t, k luaValue) int {
+	v := vm.index(t, k)
+	vm.stack.push(v)
+	return typeOf(v)
+}
+
+/* set functions (stack -> Lua) */
+
+// SetTable 弹出value和key, 执行t[key]=value(可能调用元方法)
+func (vm *State) SetTable(idx int) {
+	t := vm.stack.get(idx)
+	v := vm.stack.pop()
+	k := vm.stack.pop()
+	vm.setIndex(t, k, v)
+}
+
+// SetField 弹出value, 执行t[k]=value(可能调用元方法)
+func (vm *State) SetField(idx int, k string) {
+	t := vm.stack.get(idx)
+	vm.setIndex(t, k, vm.stack.pop())
+}
+
+// SetI 弹出value, 执行t[i]=value(可能调用元方法)
+func (vm *State) SetI(idx int, i int) {
+	t := vm.stack.get(idx)
+	vm.setIndex(t, i, vm.stack.pop())
+}
+
+// RawSet 弹出value和key, 执行t[key]=value(不调用元方法)
+func (vm *State) RawSet(idx int) {
+	t := vm.checkTable(idx)
+	v := vm.stack.pop()
+	k := vm.stack.pop()
+	t.Put(k, v)
+}
+
+// RawSetI 弹出value, 执行t[i]=value(不调用元方法)
+func (vm *State) RawSetI(idx int, i int) {
+	t := vm.checkTable(idx)
+	t.Put(i, vm.stack.pop())
+}
+
+// SetMetatable 弹出table或nil设置为idx处值的元表
+func (vm *State) SetMetatable(idx int) {
+	val := vm.stack.get(idx)
+	switch mt := vm.stack.pop().(type) {
+	case nil:
+		vm.setMetatable(val, nil)
+	case LuaTable:
+		vm.setMetatable(val, mt)
+	default:
+		panic("table expected")
+	}
+}
+
+// SetGlobal 设置全局变量name(可能调用元方法)
+// 传入v时使用v的值(golang值通过反射转换, 见 ToLuaValue), 否则同lua_setglobal弹出栈顶值
+func (vm *State) SetGlobal(name string, v ...interface{}) {
+	var val luaValue
+	if len(v) > 0 {
+		val = vm.ToLuaValue(v[0])
+	} else {
+		val = vm.stack.pop()
+	}
+	vm.setIndex(vm.registry.Get(api.LUA_RIDX_GLOBALS), name, val)
+}
+
+func (vm *State) checkTable(idx int) LuaTable {
+	if t, ok := vm.stack.get(idx).(LuaTable); ok {
+		return t
+	}
+	panic("table expected")
+}
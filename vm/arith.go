@@ -3,6 +3,7 @@ package vm
 import (
 	"fmt"
 	"math"
+	"strings"
 )
 
 // add 加
@@ -79,6 +80,9 @@ func (vm *State) div(a, b luaValue) (luaValue, bool) {
 func (vm *State) idiv(a, b luaValue) (luaValue, bool) {
 	if x, ok := a.(int); ok {
 		if y, ok := b.(int); ok {
+			if y == 0 {
+				panic("attempt to divide by zero")
+			}
 			return _iFloorDiv(x, y), true
 		}
 	}
@@ -98,6 +102,9 @@ func (vm *State) idiv(a, b luaValue) (luaValue, bool) {
 func (vm *State) mod(a, b luaValue) (luaValue, bool) {
 	if x, ok := a.(int); ok {
 		if y, ok := b.(int); ok {
+			if y == 0 {
+				panic("attempt to perform 'n%0'") // 同lua 5.3的错误信息
+			}
 			return _iMod(x, y), true
 		}
 	}
@@ -164,6 +171,21 @@ func (vm *State) shiftR(a, n int) int {
 	}
 }
 
+// rawEqual 不调用元方法比较是否相等
+func rawEqual(a, b luaValue) bool {
+	switch x := a.(type) {
+	case int:
+		if y, ok := b.(float64); ok {
+			return float64(x) == y
+		}
+	case float64:
+		if y, ok := b.(int); ok {
+			return x == float64(y)
+		}
+	}
+	return a == b
+}
+
 func (vm *State) compareEq(a, b luaValue) bool {
 	switch x := a.(type) {
 	case nil:
@@ -210,8 +232,6 @@ func (vm *State) compareLt(a, b luaValue) (bool, error) {
 	case string:
 		if y, ok := b.(string); ok {
 			return x < y, nil
-		} else {
-			return false, fmt.Errorf("attempt to compare string with %T", b)
 		}
 	case int:
 		switch y := b.(type) {
@@ -219,8 +239,6 @@ func (vm *State) compareLt(a, b luaValue) (bool, error) {
 			return x < y, nil
 		case float64:
 			return float64(x) < y, nil
-		default:
-			return false, fmt.Errorf("attempt to compare number with %T", b)
 		}
 	case float64:
 		switch y := b.(type) {
@@ -228,16 +246,12 @@ func (vm *State) compareLt(a, b luaValue) (bool, error) {
 			return x < y, nil
 		case int:
 			return x < float64(y), nil
-		default:
-			return false, fmt.Errorf("attempt to compare number with %T", b)
-		}
-	default:
-		if v, ok := vm.callMetaMethod("__lt", a, b); ok {
-			return toBool(v), nil
-		} else {
-			return false, fmt.Errorf("attempt to compare %T with %T", a, b)
 		}
 	}
+	if v, ok := vm.callMetaMethod("__lt", a, b); ok {
+		return toBool(v), nil
+	}
+	return false, compareError(a, b)
 }
 
 func (vm *State) compareLe(a, b luaValue) (bool, error) {
@@ -245,8 +259,6 @@ func (vm *State) compareLe(a, b luaValue) (bool, error) {
 	case string:
 		if y, ok := b.(string); ok {
 			return x <= y, nil
-		} else {
-			return false, fmt.Errorf("attempt to compare string with %T", b)
 		}
 	case int:
 		switch y := b.(type) {
@@ -254,8 +266,6 @@ func (vm *State) compareLe(a, b luaValue) (bool, error) {
 			return x <= y, nil
 		case float64:
 			return float64(x) <= y, nil
-		default:
-			return false, fmt.Errorf("attempt to compare number with %T", b)
 		}
 	case float64:
 		switch y := b.(type) {
@@ -263,15 +273,69 @@ func (vm *State) compareLe(a, b luaValue) (bool, error) {
 			return x <= y, nil
 		case int:
 			return x <= float64(y), nil
-		default:
-			return false, fmt.Errorf("attempt to compare number with %T", b)
 		}
-	default:
-		if v, ok := vm.callMetaMethod("__le", a, b); ok {
-			return toBool(v), nil
+	}
+	if v, ok := vm.callMetaMethod("__le", a, b); ok {
+		return toBool(v), nil
+	} else if v, ok := vm.callMetaMethod("__lt", b, a); ok { // a <= b 等价于 not (b < a)
+		return !toBool(v), nil
+	}
+	return false, compareError(a, b)
+}
+
+// compareError 无法比较大小的错误
+func compareError(a, b luaValue) error {
+	t1, t2 := _userTypeName(a), _userTypeName(b)
+	if t1 == t2 {
+		return fmt.Errorf("attempt to compare two %s values", t1)
+	}
+	return fmt.Errorf("attempt to compare %s with %s", t1, t2)
+}
+
+// length 取长度运算(#)
+func (vm *State) length(val luaValue) luaValue {
+	if s, ok := val.(string); ok {
+		return len(s)
+	} else if v, ok := vm.callMetaMethod("__len", val, val); ok {
+		return v
+	} else if t, ok := val.(LuaTable); ok {
+		return t.Len()
+	}
+	panic(fmt.Sprintf("attempt to get length of a %s value", typeName(typeOf(val))))
+}
+
+// concat 字符串拼接运算(..), 右结合, 非字符串(数字)值调用元方法 __concat
+func (vm *State) concat(vals []luaValue) luaValue {
+	strs := make([]string, 0, len(vals))
+	n := 0
+	for _, v := range vals {
+		s, ok := toString(v)
+		if !ok {
+			break
+		}
+		strs = append(strs, s)
+		n += len(s)
+	}
+	if len(strs) == len(vals) {
+		vm.allocMem(stringSize(n))
+		return strings.Join(strs, "")
+	}
+	result := vals[len(vals)-1]
+	for j := len(vals) - 2; j >= 0; j-- {
+		a, b := vals[j], result
+		x, ok1 := toString(a)
+		y, ok2 := toString(b)
+		if ok1 && ok2 {
+			vm.allocMem(stringSize(len(x) + len(y)))
+			result = x + y
+		} else if v, ok := vm.callMetaMethod("__concat", a, b); ok {
+			result = v
 		} else {
-			return false, fmt.Errorf("attempt to compare %T with %T", a, b)
+			if ok1 {
+				a = b
+			}
+			panic(fmt.Sprintf("attempt to concatenate a %s value", typeName(typeOf(a))))
 		}
 	}
-
+	return result
 }
@@ -0,0 +1,149 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+// 标准库函数参数检查辅助函数(参照lauxlib), 参数序号n从1开始, 检查失败时抛出lua错误
+
+// argAt 获取第n个参数, 不存在时返回nil
+func argAt(args []luaValue, n int) luaValue {
+	if n <= len(args) {
+		return args[n-1]
+	}
+	return nil
+}
+
+// argError 抛出参数错误 "bad argument #n to 'fname' (msg)"
+func argError(n int, fname, msg string) {
+	panic(fmt.Sprintf("bad argument #%d to '%s' (%s)", n, fname, msg))
+}
+
+// typeError 抛出参数类型错误
+func typeError(args []luaValue, n int, fname, expected string) {
+	got := "no value"
+	if n <= len(args) {
+		got = _userTypeName(args[n-1])
+	}
+	argError(n, fname, fmt.Sprintf("%s expected, got %s", expected, got))
+}
+
+// checkAny 第n个参数必须存在(可以为nil)
+func checkAny(args []luaValue, n int, fname string) luaValue {
+	if n > len(args) {
+		argError(n, fname, "value expected")
+	}
+	return args[n-1]
+}
+
+// checkTable 第n个参数必须为table
+func checkTable(args []luaValue, n int, fname string) LuaTable {
+	if t, ok := argAt(args, n).(LuaTable); ok {
+		return t
+	}
+	typeError(args, n, fname, "table")
+	return nil
+}
+
+// checkFunction 第n个参数必须为函数
+func checkFunction(args []luaValue, n int, fname string) *closure {
+	if c, ok := argAt(args, n).(*closure); ok {
+		return c
+	}
+	typeError(args, n, fname, "function")
+	return nil
+}
+
+// checkInteger 第n个参数必须为整数(或者可以无损转换为整数的浮点数/字符串)
+func checkInteger(args []luaValue, n int, fname string) int {
+	arg := argAt(args, n)
+	if i, ok := convertToInteger(arg); ok {
+		return i
+	}
+	if _, ok := convertToFloat(arg); ok {
+		argError(n, fname, "number has no integer representation")
+	}
+	typeError(args, n, fname, "number")
+	return 0
+}
+
+// optInteger 第n个参数为nil或者不存在时返回默认值d
+func optInteger(args []luaValue, n int, fname string, d int) int {
+	if argAt(args, n) == nil {
+		return d
+	}
+	return checkInteger(args, n, fname)
+}
+
+// checkNumber 第n个参数必须为数字(或者可以转换为数字的字符串)
+func checkNumber(args []luaValue, n int, fname string) float64 {
+	if f, ok := convertToFloat(argAt(args, n)); ok {
+		return f
+	}
+	typeError(args, n, fname, "number")
+	return 0
+}
+
+// optNumber 第n个参数为nil或者不存在时返回默认值d
+func optNumber(args []luaValue, n int, fname string, d float64) float64 {
+	if argAt(args, n) == nil {
+		return d
+	}
+	return checkNumber(args, n, fname)
+}
+
+// checkString 第n个参数必须为字符串, number会被转换为string
+func checkString(args []luaValue, n int, fname string) string {
+	if s, ok := toString(argAt(args, n)); ok {
+		return s
+	}
+	typeError(args, n, fname, "string")
+	return ""
+}
+
+// optString 第n个参数为nil或者不存在时返回默认值d
+func optString(args []luaValue, n int, fname string, d string) string {
+	if argAt(args, n) == nil {
+		return d
+	}
+	return checkString(args, n, fname)
+}
+
+// fileResult 同luaL_fileresult: 成功时返回true, 失败时返回 nil, 错误信息, 错误码
+func fileResult(err error, fname string) []interface{} {
+	if err == nil {
+		return []interface{}{true}
+	}
+	msg, code := osError(err)
+	if fname != "" {
+		msg = fname + ": " + msg
+	}
+	return []interface{}{nil, msg, code}
+}
+
+// osError 文件操作错误对应的错误信息(同C语言的strerror)和错误码, 无法对应错误码时为0
+func osError(err error) (string, int) {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) { // FileSystem实现可以只返回fs.ErrNotExist等通用错误
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			errno = syscall.ENOENT
+		case errors.Is(err, fs.ErrExist):
+			errno = syscall.EEXIST
+		case errors.Is(err, fs.ErrPermission):
+			errno = syscall.EACCES
+		case errors.Is(err, fs.ErrInvalid):
+			errno = syscall.EINVAL
+		case errors.Is(err, fs.ErrClosed):
+			errno = syscall.EBADF
+		default:
+			return err.Error(), 0
+		}
+	}
+	msg := errno.Error()
+	return strings.ToUpper(msg[:1]) + msg[1:], int(errno) // 与strerror一致, 首字母大写
+}
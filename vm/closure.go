@@ -10,19 +10,27 @@ type closure struct {
 	proto  *chunk.Prototype // lua函数原型
 	goFunc api.GoFunc       // go函数
 
-	upvals []updateValue // 构造closure时确定upvalue
+	upvals []*updateValue // 构造closure时确定upvalue, 捕获同一个变量的闭包共享同一个updateValue
 }
 
 func newClosure(proto *chunk.Prototype) *closure {
 	return &closure{
 		proto:  proto,
-		upvals: make([]updateValue, len(proto.Upvalues)),
+		upvals: make([]*updateValue, len(proto.Upvalues)),
 	}
 }
-func newGoClosure(f api.GoFunc) *closure {
-	return &closure{
-		goFunc: f, // TODO: 设置upvalue
+
+// newGoClosure 构造go闭包, upvals为闭包的upvalue初始值, go函数中通过 api.UpvalueIndex(i) 访问
+func newGoClosure(f api.GoFunc, upvals ...luaValue) *closure {
+	c := &closure{goFunc: f}
+	if len(upvals) > 0 {
+		c.upvals = make([]*updateValue, len(upvals))
+		for i := range upvals {
+			val := upvals[i]
+			c.upvals[i] = &updateValue{&val}
+		}
 	}
+	return c
 }
 
 // callClosure, in 'vm' state call closure 'c' with params 'args'
@@ -31,9 +39,11 @@ func _callClosure(vm *State, c *closure, args ...luaValue) []luaValue {
 		// lua 函数
 		f := c.proto
 		// fmt.Printf("call %s<%d,%d>\n", f.Source, f.LineDefined, f.LastLineDefined)
-		nParams := f.NumParams         //函数固定参数个数
-		varargs := []luaValue{}        //新栈帧的变长参数
-		top := f.MaxStackSize          //数据栈顶
+		nParams := f.NumParams  //函数固定参数个数
+		varargs := []luaValue{} //新栈帧的变长参数
+		top := f.MaxStackSize   //数据栈顶
+		size := frameSize(int(top), len(args))
+		vm.allocMem(size)
 		slots := make([]luaValue, top) //数据栈(寄存器) //XXX:初始slots比top大一些是否会有性能提升
 
 		if len(args) > int(nParams) && f.IsVararg == 1 {
@@ -44,15 +54,36 @@ func _callClosure(vm *State, c *closure, args ...luaValue) []luaValue {
 		}
 		// 构造新的函数栈帧
 		subStack := newStackFrame(vm, slots, vm.stack, c, varargs)
+		subStack.memSize = size
 
 		vm.pushStack(subStack) // 压栈
-		vm.Run()               // 运行新栈帧
-		vm.popStack()          // 出栈
+		if vm.hookMask&maskCall != 0 {
+			vm.runHook(hookCall, -1)
+		}
+		vm.execute() // 运行新栈帧
+		if vm.hookMask&maskReturn != 0 {
+			vm.runHook(hookReturn, -1)
+		}
+		vm.popStack() // 出栈
+		vm.freeMem(size)
 
 		return subStack.results
 	} else {
-		// go 函数
-		f := c.goFunc
-		return f(vm, args...)
+		// go 函数, 使用独立栈帧以支持栈操作接口
+		size := frameSize(len(args)+api.LUA_MINSTACK, 0)
+		vm.allocMem(size)
+		frame := newGoStackFrame(vm, args, vm.stack, c)
+		frame.memSize = size
+		vm.pushStack(frame)
+		if vm.hookMask&maskCall != 0 {
+			vm.runHook(hookCall, -1)
+		}
+		results := c.goFunc(vm, args...)
+		if vm.hookMask&maskReturn != 0 {
+			vm.runHook(hookReturn, -1)
+		}
+		vm.popStack()
+		vm.freeMem(size)
+		return results
 	}
 }
@@ -0,0 +1,72 @@
+package vm
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrInstructionLimit 一次RunContext/CallContext执行的指令数超过 WithInstructionLimit 设置的上限
+var ErrInstructionLimit = errors.New("instruction limit exceeded")
+
+// interruptCheckInterval 两次检查ctx是否取消之间的指令数
+const interruptCheckInterval = 1024
+
+// interrupt 中断执行时panic的值, 不能被脚本中的pcall捕获
+type interrupt struct {
+	err error
+}
+
+// RunContext 以保护模式运行最近一次Load加载的主函数, ctx取消或者超过指令数上限时中断执行
+// 中断时返回ctx.Err()或者ErrInstructionLimit, 运行时错误以*LuaError返回
+func (vm *State) RunContext(ctx context.Context) error {
+	if vm.main == nil {
+		panic("no lua chunk loaded")
+	}
+	_, err := vm.CallContext(ctx, vm.main)
+	return err
+}
+
+// CallContext 同CallFunction, ctx取消或者超过指令数上限时中断执行
+// 中断时返回ctx.Err()或者ErrInstructionLimit, 可以通过errors.Is区分
+func (vm *State) CallContext(ctx context.Context, f interface{}, args ...interface{}) (results []interface{}, err error) {
+	frame := vm.stack
+	oldCtx, oldSteps, oldNext := vm.ctx, vm.steps, vm.nextCheck
+	vm.ctx, vm.steps, vm.nextCheck = ctx, 0, 0
+	defer func() {
+		vm.ctx, vm.steps, vm.nextCheck = oldCtx, oldSteps, oldNext
+		if p := recover(); p != nil {
+			i, ok := p.(interrupt)
+			if !ok {
+				panic(p)
+			}
+			vm.unwindStack(frame)
+			results, err = nil, i.err
+		}
+	}()
+	return vm.CallFunction(f, args...)
+}
+
+// charge 计入n条指令, go库函数按照循环次数计入, 超过指令数上限或者ctx取消时中断执行
+// 不是通过RunContext/CallContext运行时不做任何检查
+func (vm *State) charge(n int) {
+	if vm.ctx == nil {
+		return
+	}
+	if vm.steps += n; vm.steps >= vm.nextCheck {
+		vm.checkInterrupt()
+	}
+}
+
+// checkInterrupt 检查指令数上限和ctx, 并计算下一次检查的位置
+func (vm *State) checkInterrupt() {
+	if vm.instLimit > 0 && vm.steps > vm.instLimit {
+		panic(interrupt{ErrInstructionLimit})
+	}
+	if err := vm.ctx.Err(); err != nil {
+		panic(interrupt{err})
+	}
+	vm.nextCheck = vm.steps + interruptCheckInterval
+	if vm.instLimit > 0 && vm.nextCheck > vm.instLimit+1 {
+		vm.nextCheck = vm.instLimit + 1
+	}
+}
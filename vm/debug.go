@@ -0,0 +1,523 @@
+package vm
+
+import (
+	"fmt"
+	"luago/chunk"
+	"strings"
+)
+
+// 调试信息与钩子(参照ldebug), 栈帧层级level从0开始, 0为当前运行的函数, 基础栈帧不计入层级
+
+// 钩子事件(同LUA_HOOKCALL等)
+const (
+	hookCall = iota
+	hookReturn
+	hookLine
+	hookCount
+	hookTailCall
+)
+
+// 钩子事件掩码(同LUA_MASKCALL等)
+const (
+	maskCall   = 1 << hookCall
+	maskReturn = 1 << hookReturn
+	maskLine   = 1 << hookLine
+	maskCount  = 1 << hookCount
+)
+
+var hookNames = [...]string{"call", "return", "line", "count", "tail call"}
+
+// hookFunc 钩子函数, line为line事件的行号, 其他事件为-1
+type hookFunc func(vm *State, event, line int)
+
+// DebugInfo 函数或者栈帧的调试信息(同lua_Debug)
+type DebugInfo struct {
+	Source          string // 函数所在chunk的名称, 如 "@main.lua"
+	ShortSrc        string // 用于错误信息的简短chunk名称
+	What            string // "Lua", "C" 或者 "main"
+	LineDefined     int
+	LastLineDefined int
+	CurrentLine     int // 当前执行到的行号, 不是运行中的函数或者没有行号信息时为-1
+	NUps            int
+	NParams         int
+	IsVararg        bool
+	Name            string
+	NameWhat        string      // "global", "local", "method", "field", "upvalue" 或者 ""
+	Func            interface{} // 函数值
+}
+
+// getFrame 获取第level层栈帧, 不存在时返回nil
+func (vm *State) getFrame(level int) *stackFrame {
+	if level < 0 {
+		return nil
+	}
+	frame := vm.stack
+	for ; frame != nil && frame.c != nil; frame = frame.prev {
+		if level == 0 {
+			return frame
+		}
+		level--
+	}
+	return nil
+}
+
+// callStack 当前调用栈的全部栈帧, 下标即层级
+func (vm *State) callStack() []*stackFrame {
+	var frames []*stackFrame
+	for frame := vm.stack; frame != nil && frame.c != nil; frame = frame.prev {
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// funcInfo 获取函数c的调试信息, frame为c正在运行的栈帧(可以为nil)
+func (vm *State) funcInfo(c *closure, frame *stackFrame) *DebugInfo {
+	ar := &DebugInfo{CurrentLine: -1, NUps: len(c.upvals), Func: c}
+	if p := c.proto; p != nil {
+		ar.Source = p.Source
+		if ar.Source == "" { // 去除调试信息的chunk
+			ar.Source = "=?"
+		}
+		ar.LineDefined = int(p.LineDefined)
+		ar.LastLineDefined = int(p.LastLineDefined)
+		if ar.What = "Lua"; ar.LineDefined == 0 {
+			ar.What = "main"
+		}
+		ar.NParams = int(p.NumParams)
+		ar.IsVararg = p.IsVararg != 0
+	} else {
+		ar.Source = "=[C]"
+		ar.LineDefined, ar.LastLineDefined = -1, -1
+		ar.What = "C"
+		ar.IsVararg = true
+	}
+	ar.ShortSrc = chunkID(ar.Source)
+	if frame != nil {
+		ar.CurrentLine = frame.currentLine()
+		ar.Name, ar.NameWhat = funcName(frame)
+	}
+	return ar
+}
+
+// GetInfo 获取第level层(0为当前运行的函数)栈帧中函数的调试信息, 层级超出范围时返回false
+func (vm *State) GetInfo(level int) (*DebugInfo, bool) {
+	frame := vm.getFrame(level)
+	if frame == nil {
+		return nil, false
+	}
+	return vm.funcInfo(frame.c, frame), true
+}
+
+// StackDepth 当前调用栈的层数, 不在函数中运行时为0
+func (vm *State) StackDepth() int {
+	n := 0
+	for frame := vm.stack; frame != nil && frame.c != nil; frame = frame.prev {
+		n++
+	}
+	return n
+}
+
+// StackEntry 调用栈中的一层栈帧, 不包含需要推断的函数名称, 可以快速获取完整的调用栈(如性能分析)
+type StackEntry struct {
+	Func  interface{}      // 函数值
+	Proto *chunk.Prototype // lua函数的原型, go函数为nil
+	Line  int              // 当前执行到的行号, go函数或者没有行号信息时为-1
+}
+
+// CallStack 将当前调用栈的全部栈帧(层级0在前)追加到buf后返回
+func (vm *State) CallStack(buf []StackEntry) []StackEntry {
+	for frame := vm.stack; frame != nil && frame.c != nil; frame = frame.prev {
+		buf = append(buf, StackEntry{Func: frame.c, Proto: frame.c.proto, Line: frame.currentLine()})
+	}
+	return buf
+}
+
+// GetLocal 同lua_getlocal, 第level层栈帧中第n个(从1开始)局部变量的名称和值, 不存在时返回false
+// 临时变量的名称以'('开头, n为负数时获取lua函数的第-n个变长参数
+func (vm *State) GetLocal(level, n int) (string, interface{}, bool) {
+	frame := vm.getFrame(level)
+	if frame == nil {
+		return "", nil, false
+	}
+	name, v := frame.findLocal(n)
+	if v == nil {
+		return "", nil, false
+	}
+	return name, *v, true
+}
+
+// GetUpvalue 同lua_getupvalue, 函数f的第n个(从1开始)upvalue的名称和值, 不存在时返回false
+func (vm *State) GetUpvalue(f interface{}, n int) (string, interface{}, bool) {
+	c, ok := f.(*closure)
+	if !ok {
+		return "", nil, false
+	}
+	name, uv, ok := getUpvalue(c, n)
+	if !ok {
+		return "", nil, false
+	}
+	return name, *uv.val, true
+}
+
+// activeLines lua函数包含指令的所有行号, go函数返回nil
+func activeLines(c *closure) LuaTable {
+	if c.proto == nil {
+		return nil
+	}
+	lines := newLuaTable(0, 0)
+	for _, line := range c.proto.LineInfo {
+		lines.Put(int(line), true)
+	}
+	return lines
+}
+
+// getFuncLine 指令pc对应的源码行号, 没有行号信息返回-1
+func getFuncLine(p *chunk.Prototype, pc int) int {
+	if pc >= 0 && pc < len(p.LineInfo) {
+		return int(p.LineInfo[pc])
+	}
+	return -1
+}
+
+// localName 同lfunc的luaF_getlocalname, 指令pc处第n个(从1开始)活动局部变量的名称, 不存在时返回空字符串
+func localName(p *chunk.Prototype, n, pc int) string {
+	for _, v := range p.LocVars {
+		if int(v.StartPC) > pc {
+			break
+		}
+		if pc < int(v.EndPC) { // 变量在pc处有效
+			if n--; n == 0 {
+				return v.VarName
+			}
+		}
+	}
+	return ""
+}
+
+// upvalName 第i个upvalue的名称
+func upvalName(p *chunk.Prototype, i int) string {
+	if i < len(p.UpvalueNames) && p.UpvalueNames[i] != "" {
+		return p.UpvalueNames[i]
+	}
+	return "?"
+}
+
+// findLocal 同ldebug的luaG_findlocal, 获取栈帧中第n个局部变量的名称和存储位置, 不存在时返回空名称
+// n为负数时获取lua函数的第-n个变长参数
+func (frame *stackFrame) findLocal(n int) (string, *luaValue) {
+	limit := frame.top
+	if p := frame.c.proto; p != nil {
+		if n < 0 {
+			if -n <= len(frame.varargs) {
+				return "(*vararg)", &frame.varargs[-n-1]
+			}
+			return "", nil
+		}
+		pc := frame.pc - 1
+		if name := localName(p, n, pc); name != "" {
+			return name, &frame.slots[n-1]
+		}
+		// 正在调用其他函数时, 被调用函数所在寄存器之前的都是临时变量
+		limit = int(p.MaxStackSize)
+		if pc >= 0 {
+			switch i := Instruction(p.Code[pc]); i.Opcode() {
+			case OP_CALL, OP_TAILCALL:
+				limit, _, _ = i.ABC()
+			case OP_TFORCALL:
+				a, _, _ := i.ABC()
+				limit = a + 3
+			}
+		}
+	}
+	if n <= 0 || n > limit || n > len(frame.slots) {
+		return "", nil
+	}
+	if frame.c.proto != nil {
+		return "(*temporary)", &frame.slots[n-1]
+	}
+	return "(*C temporary)", &frame.slots[n-1]
+}
+
+// getUpvalue 获取函数c的第n个(从1开始)upvalue的名称和引用, 不存在时返回空名称, go函数的upvalue名称为空字符串
+func getUpvalue(c *closure, n int) (string, *updateValue, bool) {
+	if n < 1 || n > len(c.upvals) {
+		return "", nil, false
+	}
+	if c.upvals[n-1] == nil { // 未初始化的upvalue
+		c.upvals[n-1] = &updateValue{new(luaValue)}
+	}
+	if c.proto == nil {
+		return "", c.upvals[n-1], true
+	}
+	if n-1 < len(c.proto.UpvalueNames) && c.proto.UpvalueNames[n-1] != "" {
+		return c.proto.UpvalueNames[n-1], c.upvals[n-1], true
+	}
+	return "(*no name)", c.upvals[n-1], true
+}
+
+// funcName 同ldebug的getfuncname, 根据调用者正在执行的指令推断栈帧中函数的名称
+func funcName(frame *stackFrame) (name, nameWhat string) {
+	caller := frame.prev
+	if caller == nil {
+		return "", ""
+	}
+	if caller.hooked { // 钩子函数
+		return "?", "hook"
+	}
+	if caller.c == nil || caller.c.proto == nil || caller.pc < 1 {
+		return "", ""
+	}
+	p := caller.c.proto
+	pc := caller.pc - 1
+	i := Instruction(p.Code[pc])
+	var event string
+	switch op := i.Opcode(); op {
+	case OP_CALL, OP_TAILCALL:
+		a, _, _ := i.ABC()
+		return objName(p, pc, a)
+	case OP_TFORCALL:
+		return "for iterator", "for iterator"
+	// 其他指令可能通过元方法调用函数
+	case OP_SELF, OP_GETTABUP, OP_GETTABLE:
+		event = "index"
+	case OP_SETTABUP, OP_SETTABLE:
+		event = "newindex"
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR, OP_UNM, OP_BNOT:
+		event = strings.ToLower(strings.TrimSpace(opcodes[op].name))
+	case OP_LEN:
+		event = "len"
+	case OP_CONCAT:
+		event = "concat"
+	case OP_EQ:
+		event = "eq"
+	case OP_LT:
+		event = "lt"
+	case OP_LE:
+		event = "le"
+	default:
+		return "", ""
+	}
+	return "__" + event, "metamethod"
+}
+
+// objName 同ldebug的getobjname, 通过符号执行推断指令lastpc处寄存器reg中值的名称
+func objName(p *chunk.Prototype, lastpc, reg int) (name, nameWhat string) {
+	if name = localName(p, reg+1, lastpc); name != "" {
+		return name, "local"
+	}
+	pc := findSetReg(p, lastpc, reg)
+	if pc < 0 {
+		return "", ""
+	}
+	i := Instruction(p.Code[pc])
+	switch op := i.Opcode(); op {
+	case OP_MOVE:
+		a, b, _ := i.ABC()
+		if b < a {
+			return objName(p, pc, b)
+		}
+	case OP_GETTABUP, OP_GETTABLE:
+		_, b, c := i.ABC()
+		var vn string // 被索引的变量名
+		if op == OP_GETTABLE {
+			vn = localName(p, b+1, pc)
+		} else {
+			vn = upvalName(p, b)
+		}
+		if vn == "_ENV" {
+			return constName(p, pc, c), "global"
+		}
+		return constName(p, pc, c), "field"
+	case OP_GETUPVAL:
+		_, b, _ := i.ABC()
+		return upvalName(p, b), "upvalue"
+	case OP_LOADK, OP_LOADKX:
+		_, bx := i.ABx()
+		if op == OP_LOADKX {
+			bx = Instruction(p.Code[pc+1]).Ax()
+		}
+		if s, ok := p.Constants[bx].(string); ok {
+			return s, "constant"
+		}
+	case OP_SELF:
+		_, _, c := i.ABC()
+		return constName(p, pc, c), "method"
+	}
+	return "", ""
+}
+
+// constName 同ldebug的kname, rk为字符串常量(或者保存字符串常量的寄存器)时返回该字符串, 否则返回"?"
+func constName(p *chunk.Prototype, pc, rk int) string {
+	if rk > 0xFF {
+		if s, ok := p.Constants[rk&0xFF].(string); ok {
+			return s
+		}
+	} else if name, what := objName(p, pc, rk); what == "constant" {
+		return name
+	}
+	return "?"
+}
+
+// findSetReg 同ldebug的findsetreg, 查找lastpc之前最后一条修改寄存器reg的指令, 位于条件分支中时返回-1
+func findSetReg(p *chunk.Prototype, lastpc, reg int) int {
+	setreg := -1   // 最后一条修改reg的指令
+	jmptarget := 0 // 此位置之前的代码都是条件执行的
+	filter := func(pc int) int {
+		if pc < jmptarget {
+			return -1
+		}
+		return pc
+	}
+	for pc := 0; pc < lastpc; pc++ {
+		i := Instruction(p.Code[pc])
+		a, b, _ := i.ABC()
+		switch op := i.Opcode(); op {
+		case OP_LOADNIL:
+			if a <= reg && reg <= a+b {
+				setreg = filter(pc)
+			}
+		case OP_TFORCALL:
+			if reg >= a+2 {
+				setreg = filter(pc)
+			}
+		case OP_CALL, OP_TAILCALL:
+			if reg >= a {
+				setreg = filter(pc)
+			}
+		case OP_JMP:
+			_, sBx := i.AsBx()
+			// 向前跳转并且没有跳过lastpc
+			if dest := pc + 1 + sBx; pc < dest && dest <= lastpc && dest > jmptarget {
+				jmptarget = dest
+			}
+		default:
+			if opcodes[op].setAFlag != 0 && reg == a {
+				setreg = filter(pc)
+			}
+		}
+	}
+	return setreg
+}
+
+// globalFuncName 同lauxlib的pushglobalfuncname, 在已加载模块中查找函数f的名称, 如 "string.format"
+// 全局函数去掉 "_G." 前缀
+func (vm *State) globalFuncName(f luaValue) (string, bool) {
+	loaded, _ := vm.registry.Get(loadedKey).(LuaTable)
+	name, ok := findField(loaded, f, 2)
+	return strings.TrimPrefix(name, "_G."), ok
+}
+
+// findField 在table t中最多level层深度查找值obj, 返回以'.'连接的字符串键
+func findField(t LuaTable, obj luaValue, level int) (string, bool) {
+	if level == 0 || t == nil {
+		return "", false
+	}
+	for k := t.Next(nil); k != nil; k = t.Next(k) {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		v := t.Get(k)
+		if rawEqual(v, obj) {
+			return key, true
+		}
+		if sub, ok := v.(LuaTable); ok {
+			if name, ok := findField(sub, obj, level-1); ok {
+				return key + "." + name, true
+			}
+		}
+	}
+	return "", false
+}
+
+const (
+	tracebackLevels1 = 10 // 调用栈过深时显示前10层
+	tracebackLevels2 = 11 // 和最后11层
+)
+
+// traceback 同luaL_traceback, 从第level层开始的调用栈信息
+func (vm *State) traceback(level int) string {
+	var b strings.Builder
+	b.WriteString("stack traceback:")
+	frames := vm.callStack()
+	last := len(frames) - 1
+	n1 := -1
+	if last-level > tracebackLevels1+tracebackLevels2 {
+		n1 = tracebackLevels1
+	}
+	for ; level >= 0 && level <= last; level++ {
+		if n1 == 0 {
+			b.WriteString("\n\t...")
+			level = last - tracebackLevels2 + 1
+		}
+		n1--
+		frame := frames[level]
+		ar := vm.funcInfo(frame.c, frame)
+		fmt.Fprintf(&b, "\n\t%s:", ar.ShortSrc)
+		if ar.CurrentLine > 0 {
+			fmt.Fprintf(&b, "%d:", ar.CurrentLine)
+		}
+		b.WriteString(" in ")
+		if name, ok := vm.globalFuncName(frame.c); ok {
+			fmt.Fprintf(&b, "function '%s'", name)
+		} else if ar.NameWhat != "" {
+			fmt.Fprintf(&b, "%s '%s'", ar.NameWhat, ar.Name)
+		} else if ar.What == "main" {
+			b.WriteString("main chunk")
+		} else if ar.What != "C" {
+			fmt.Fprintf(&b, "function <%s:%d>", ar.ShortSrc, ar.LineDefined)
+		} else {
+			b.WriteString("?")
+		}
+	}
+	return b.String()
+}
+
+// setHook 设置钩子函数, f为nil或者mask为0时关闭钩子
+func (vm *State) setHook(f hookFunc, mask, count int) {
+	if f == nil || mask == 0 {
+		f, mask = nil, 0
+	}
+	vm.hook = f
+	vm.hookMask = mask
+	vm.baseHookCount = count
+	vm.hookCount = count
+	if vm.stack.c != nil && vm.stack.c.proto != nil {
+		vm.stack.oldpc = vm.stack.pc - 1
+	}
+}
+
+// runHook 在当前栈帧上调用钩子函数, 钩子函数运行期间不再触发钩子
+func (vm *State) runHook(event, line int) {
+	if vm.hook == nil || vm.inHook {
+		return
+	}
+	frame := vm.stack
+	vm.inHook, frame.hooked = true, true
+	defer func() {
+		vm.inHook, frame.hooked = false, false
+	}()
+	vm.hook(vm, event, line)
+}
+
+// traceExec 同ldebug的luaG_traceexec, 执行每条指令前触发count和line事件
+// 进入函数, 向后跳转(循环)或者进入新的一行时触发line事件
+func (vm *State) traceExec() {
+	frame := vm.stack
+	if vm.hookMask&maskCount != 0 {
+		if vm.hookCount--; vm.hookCount == 0 {
+			vm.hookCount = vm.baseHookCount
+			vm.runHook(hookCount, -1)
+		}
+	}
+	npc := frame.pc - 1 // 即将执行的指令
+	if vm.hookMask&maskLine != 0 {
+		p := frame.c.proto
+		newLine := getFuncLine(p, npc)
+		if npc == 0 || npc <= frame.oldpc || newLine != getFuncLine(p, frame.oldpc) {
+			vm.runHook(hookLine, newLine)
+		}
+	}
+	frame.oldpc = npc
+}
@@ -9,3 +9,19 @@ func ExampleGoFuncAdd(state api.State, args ...interface{}) []interface{} {
 }
 
 var _ api.GoFunc = api.GoFunc(ExampleGoFuncAdd)
+
+// ExampleGoFuncSum 使用栈操作接口实现的golang函数示例, 参数位于go函数栈帧索引1..n
+func ExampleGoFuncSum(state api.State, _ ...interface{}) []interface{} {
+	sum := 0.0
+	for i := 1; i <= state.GetTop(); i++ {
+		if n, ok := state.ToNumberX(i); ok {
+			sum += n
+		} else {
+			state.PushFString("bad argument #%d to 'sum' (number expected, got %s)", i, state.TypeName(state.Type(i)))
+			state.Error()
+		}
+	}
+	return []interface{}{sum}
+}
+
+var _ api.GoFunc = api.GoFunc(ExampleGoFuncSum)
@@ -0,0 +1,168 @@
+package vm
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// File io库文件句柄使用的文件, 不支持的操作(如只读文件的写入)返回错误
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Name() string
+}
+
+// FileSystem io库和os库访问文件系统的接口, 通过 WithFileSystem 替换
+// 文件不存在等错误应当可以通过errors.Is与fs.ErrNotExist等比较, 以便转换为C语言的错误码
+type FileSystem interface {
+	// OpenFile 同os.OpenFile, flag为os.O_RDONLY等的组合
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	// Remove 删除文件或者空目录
+	Remove(name string) error
+	// Rename 重命名文件
+	Rename(oldpath, newpath string) error
+	// TempFile 创建一个新的临时文件, 以读写模式打开
+	TempFile() (File, error)
+}
+
+// OSFileSystem 直接访问宿主文件系统, 是默认的FileSystem
+var OSFileSystem FileSystem = osFS{}
+
+type osFS struct{}
+
+func (osFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err // 避免返回包含nil指针的接口
+	}
+	return f, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) TempFile() (File, error) {
+	f, err := os.CreateTemp("", "lua_")
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewReadOnlyFS 使用fs.FS(如embed.FS, os.DirFS)构造只读的FileSystem
+// 路径中开头的"/"和"./"会被忽略, 所有写操作返回fs.ErrPermission
+func NewReadOnlyFS(fsys fs.FS) FileSystem {
+	return readOnlyFS{fsys}
+}
+
+type readOnlyFS struct {
+	fsys fs.FS
+}
+
+// fsPath 将lua脚本使用的路径转换为fs.FS要求的相对路径
+func fsPath(name string) string {
+	name = strings.TrimLeft(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (r readOnlyFS) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	f, err := r.fsys.Open(fsPath(name))
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyFile{File: f, name: name}, nil
+}
+
+func (readOnlyFS) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (readOnlyFS) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrPermission}
+}
+
+func (readOnlyFS) TempFile() (File, error) {
+	return nil, &fs.PathError{Op: "createtemp", Path: "lua_", Err: fs.ErrPermission}
+}
+
+// readOnlyFile 包装fs.File, 底层文件实现了io.Seeker时支持seek
+type readOnlyFile struct {
+	fs.File
+	name string
+}
+
+func (f *readOnlyFile) Name() string {
+	return f.name
+}
+
+func (f *readOnlyFile) Write([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+}
+
+func (f *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := f.File.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.ESPIPE}
+}
+
+// streamFile 将标准输入输出等流包装为File, 不支持seek
+type streamFile struct {
+	r    io.Reader
+	w    io.Writer
+	name string
+}
+
+// newStreamFile 使用r和w(可以为nil)构造File, r或者w已经实现File时直接返回
+func newStreamFile(name string, r io.Reader, w io.Writer) File {
+	if f, ok := r.(File); ok && w == nil {
+		return f
+	}
+	if f, ok := w.(File); ok && r == nil {
+		return f
+	}
+	return &streamFile{r: r, w: w, name: name}
+}
+
+func (f *streamFile) Name() string {
+	return f.name
+}
+
+func (f *streamFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.r.Read(b)
+}
+
+func (f *streamFile) Write(b []byte) (int, error) {
+	if f.w == nil {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.w.Write(b)
+}
+
+func (f *streamFile) Seek(int64, int) (int64, error) {
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.ESPIPE}
+}
+
+func (f *streamFile) Close() error {
+	return nil
+}
@@ -0,0 +1,208 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// MemFS 内存文件系统, 可以作为沙箱中脚本唯一可见的虚拟目录, 可以被多个State共享
+// 不区分目录, 路径经过path.Clean规范化后作为文件名, 如 "a/../b.txt" 与 "/b.txt" 为同一个文件
+type MemFS struct {
+	mu     sync.Mutex
+	files  map[string]*memData
+	tmpSeq int
+}
+
+type memData struct {
+	data []byte
+}
+
+// NewMemFS 构造空的内存文件系统
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string]*memData)}
+}
+
+func memPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// WriteFile 宿主写入文件内容, 文件存在时覆盖
+func (m *MemFS) WriteFile(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[memPath(name)] = &memData{append([]byte(nil), data...)}
+}
+
+// ReadFile 宿主读取文件内容
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.files[memPath(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), d.data...), nil
+}
+
+func (m *MemFS) OpenFile(name string, flag int, _ fs.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := memPath(name)
+	d, ok := m.files[p]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case !ok:
+		d = &memData{}
+		m.files[p] = d
+	}
+	f := &memFile{fs: m, name: name, d: d, append: flag&os.O_APPEND != 0}
+	switch flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR) {
+	case os.O_RDONLY:
+		f.readable = true
+	case os.O_WRONLY:
+		f.writable = true
+	default:
+		f.readable, f.writable = true, true
+	}
+	if f.writable && flag&os.O_TRUNC != 0 {
+		d.data = nil
+	}
+	return f, nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := memPath(name)
+	if _, ok := m.files[p]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, p)
+	return nil
+}
+
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	op, np := memPath(oldpath), memPath(newpath)
+	d, ok := m.files[op]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrNotExist}
+	}
+	delete(m.files, op)
+	m.files[np] = d
+	return nil
+}
+
+func (m *MemFS) TempFile() (File, error) {
+	m.mu.Lock()
+	var name string
+	for {
+		m.tmpSeq++
+		if name = fmt.Sprintf("/tmp/lua_%06d", m.tmpSeq); m.files[name] == nil {
+			break
+		}
+	}
+	m.mu.Unlock()
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// memFile MemFS中打开的文件, 删除或者重命名不影响已经打开的文件
+type memFile struct {
+	fs       *MemFS
+	name     string
+	d        *memData
+	off      int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string, allowed bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	}
+	if !allowed {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *memFile) Read(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("read", f.readable); err != nil {
+		return 0, err
+	}
+	if f.off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.d.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(b []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("write", f.writable); err != nil {
+		return 0, err
+	}
+	if f.append {
+		f.off = int64(len(f.d.data))
+	}
+	if end := f.off + int64(len(b)); end > int64(len(f.d.data)) {
+		if end > int64(cap(f.d.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.d.data)
+			f.d.data = data
+		} else {
+			f.d.data = f.d.data[:end]
+		}
+	}
+	n := copy(f.d.data[f.off:], b)
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("seek", true); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.d.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if err := f.check("close", true); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,60 @@
+package vm
+
+import "strings"
+
+// HookMask 宿主钩子的事件掩码, 可以按位组合
+type HookMask int
+
+const (
+	HookCall   HookMask = maskCall   // 调用函数(包括go函数)之后, 第一条指令执行之前
+	HookReturn HookMask = maskReturn // 函数返回之前
+	HookLine   HookMask = maskLine   // 进入新的一行或者向后跳转(循环)时, 执行该行指令之前
+	HookCount  HookMask = maskCount  // 每执行count条指令
+)
+
+// String 事件名称, 同debug.sethook传给钩子函数的事件名, 多个事件以'|'连接
+func (m HookMask) String() string {
+	var names []string
+	for event := hookCall; event <= hookCount; event++ {
+		if m&(1<<event) != 0 {
+			names = append(names, hookNames[event])
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// HookEvent 传给宿主钩子函数的事件, 只在钩子函数运行期间有效
+type HookEvent struct {
+	Event HookMask // 触发的事件, 为单个事件
+	Line  int      // line事件的新行号, 其他事件为-1
+	State *State   // 可以通过GetInfo, StackDepth等获取调用栈信息, 层级0为触发事件的函数
+}
+
+// Info 触发事件的函数的调试信息
+func (ev HookEvent) Info() *DebugInfo {
+	ar, _ := ev.State.GetInfo(0)
+	return ar
+}
+
+// IsGoFunction 触发事件的函数是否是go函数(只有call和return事件), 不需要获取调试信息
+func (ev HookEvent) IsGoFunction() bool {
+	return ev.State.stack.c != nil && ev.State.stack.c.proto == nil
+}
+
+// SetHook 设置宿主钩子函数, 替换debug.sethook设置的钩子(之后debug.gethook返回 "external hook")
+// mask包含HookCount并且count大于0时每执行count条指令触发count事件, f为nil或者mask为0时移除钩子
+// 钩子函数运行期间不再触发钩子, 钩子函数中panic等同于在触发事件的位置抛出错误
+// 没有设置钩子时执行指令只需要检查事件掩码
+func (vm *State) SetHook(mask HookMask, count int, f func(ev HookEvent)) {
+	if count <= 0 {
+		mask &^= HookCount
+	}
+	vm.hookValue = nil
+	if f == nil {
+		vm.setHook(nil, 0, 0)
+		return
+	}
+	vm.setHook(func(vm *State, event, line int) {
+		f(HookEvent{Event: 1 << event, Line: line, State: vm})
+	}, int(mask&(HookCall|HookReturn|HookLine|HookCount)), count)
+}
@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"luago/chunk"
+	"os"
+	"strings"
+)
+
+// Compiler 将lua源码编译为函数原型, chunkname为chunk名称(如 "@file.lua"), 编译错误通过error返回
+// 虚拟机本身只能加载二进制chunk, 加载源码需要通过 WithCompiler 配置编译器
+type Compiler func(source []byte, chunkname string) (*chunk.Prototype, error)
+
+// loadChunk 同lua_load, 加载二进制chunk或者lua源码, 返回以全局变量表为_ENV的主函数闭包
+// mode为"b"(只允许二进制chunk), "t"(只允许源码)或者"bt", 沙箱禁止二进制chunk时不受mode影响
+func (vm *State) loadChunk(data []byte, chunkname, mode string) (*closure, error) {
+	var proto *chunk.Prototype
+	var err error
+	binary := len(data) > 0 && data[0] == chunk.LUA_SIGNATURE[0]
+	if binary && !vm.allowBinary {
+		err = errors.New("attempt to load a binary chunk (not allowed in sandbox)")
+	} else if binary && !strings.ContainsRune(mode, 'b') {
+		err = fmt.Errorf("attempt to load a binary chunk (mode is '%s')", mode)
+	} else if !binary && !strings.ContainsRune(mode, 't') {
+		err = fmt.Errorf("attempt to load a text chunk (mode is '%s')", mode)
+	} else if binary {
+		proto, err = undump(data, chunkname)
+	} else if vm.compiler == nil {
+		err = errors.New("attempt to load a text chunk (no compiler available)")
+	} else {
+		proto, err = vm.compiler(data, chunkname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return vm.newMainClosure(proto), nil
+}
+
+// loadReader 同luaL_loadfilex, 读取r的全部内容并加载, 跳过开头的BOM和'#'注释行
+// chunkname以'@'或者'='开头, 读取失败时的错误信息使用去掉前缀的名称
+func (vm *State) loadReader(r io.Reader, chunkname, mode string) (*closure, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		msg, _ := osError(err)
+		return nil, fmt.Errorf("cannot read %s: %s", chunkname[1:], msg)
+	}
+	return vm.loadChunk(skipComment(data), chunkname, mode)
+}
+
+// loadFile 加载fs中的文件, filename为空时读取标准输入
+func (vm *State) loadFile(filename, mode string) (*closure, error) {
+	if filename == "" {
+		return vm.loadReader(vm.stdin, "=stdin", mode)
+	}
+	f, err := vm.fs.OpenFile(filename, os.O_RDONLY, 0)
+	if err != nil {
+		msg, _ := osError(err)
+		return nil, fmt.Errorf("cannot open %s: %s", filename, msg)
+	}
+	defer f.Close()
+	return vm.loadReader(f, "@"+filename, mode)
+}
+
+// newMainClosure 构造主函数闭包, 第一个upvalue(_ENV)为全局变量表
+func (vm *State) newMainClosure(proto *chunk.Prototype) *closure {
+	c := newClosure(proto)
+	for i := range c.upvals {
+		c.upvals[i] = &updateValue{new(luaValue)}
+	}
+	if len(c.upvals) > 0 {
+		*c.upvals[0].val = vm.global
+	}
+	return c
+}
+
+// undump 解析二进制chunk, 格式错误时返回error, 错误信息中的名称同lundump
+func undump(data []byte, chunkname string) (proto *chunk.Prototype, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			why := "truncated precompiled chunk"
+			if s, ok := p.(string); ok {
+				why = strings.TrimSuffix(s, "!")
+			}
+			name := chunkname
+			if strings.HasPrefix(name, "@") || strings.HasPrefix(name, "=") {
+				name = name[1:]
+			} else if strings.HasPrefix(name, chunk.LUA_SIGNATURE[:1]) {
+				name = "binary string"
+			}
+			err = fmt.Errorf("%s: %s", name, why)
+		}
+	}()
+	return chunk.Undump(data), nil
+}
+
+// skipComment 同lauxlib的skipcomment, 跳过文件开头的UTF-8 BOM和以'#'开始的第一行(如unix的 #!)
+// 源码保留换行符以保持行号不变
+func skipComment(data []byte) []byte {
+	data = bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))
+	if len(data) == 0 || data[0] != '#' {
+		return data
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil
+	}
+	if i+1 < len(data) && data[i+1] == chunk.LUA_SIGNATURE[0] { // 二进制chunk
+		return data[i+1:]
+	}
+	return data[i:]
+}
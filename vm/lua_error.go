@@ -0,0 +1,125 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"runtime"
+	"strings"
+)
+
+// LuaError lua运行时错误, 在虚拟机内部通过panic传递, 由pcall/PCall捕获
+type LuaError struct {
+	Value  interface{} // 错误对象, 可以是任意lua值
+	Status int         // 错误状态码 api.LUA_ERRRUN 等
+}
+
+func (e *LuaError) Error() string {
+	if s, ok := toString(e.Value); ok {
+		return s
+	}
+	return fmt.Sprintf("(error object is a %s value)", typeName(typeOf(e.Value)))
+}
+
+// toLuaError 将panic的值转换为lua错误
+// 虚拟机和go函数抛出的非LuaError错误, 在错误信息前添加出错位置(出错时的lua函数或者调用go函数的lua函数)
+// go运行时错误(如空指针, 下标越界)是虚拟机或者go函数的bug, 不转换为lua错误, 继续panic
+func (vm *State) toLuaError(p interface{}) *LuaError {
+	var msg string
+	switch x := p.(type) {
+	case *LuaError:
+		return x
+	case runtime.Error:
+		panic(x)
+	case string:
+		msg = x
+	case error:
+		msg = x.Error()
+	default:
+		msg = fmt.Sprint(x)
+	}
+	level := 0
+	if vm.stack.c == nil || vm.stack.c.proto == nil {
+		level = 1
+	}
+	return &LuaError{Value: vm.where(level) + msg, Status: api.LUA_ERRRUN}
+}
+
+// where 第level层函数(0为当前运行的函数)的当前位置 "chunkname:currentline: ", 非lua函数返回空字符串
+func (vm *State) where(level int) string {
+	frame := vm.stack
+	for ; level > 0 && frame != nil; level-- {
+		frame = frame.prev
+	}
+	if frame != nil {
+		if line := frame.currentLine(); line > 0 {
+			return fmt.Sprintf("%s:%d: ", chunkID(frame.c.proto.Source), line)
+		}
+	}
+	return ""
+}
+
+const LUA_IDSIZE = 60 // chunkID最大长度
+
+// chunkID 根据chunk名称生成用于错误信息的源码描述(同luaO_chunkid)
+//
+//	"=stdin" -> "stdin"
+//	"@file.lua" -> "file.lua"
+//	"print(1)" -> [string "print(1)"]
+func chunkID(source string) string {
+	switch {
+	case strings.HasPrefix(source, "="):
+		if len(source) > LUA_IDSIZE {
+			return source[1:LUA_IDSIZE]
+		}
+		return source[1:]
+	case strings.HasPrefix(source, "@"):
+		if len(source) > LUA_IDSIZE {
+			return "..." + source[len(source)-LUA_IDSIZE+4:]
+		}
+		return source[1:]
+	default:
+		const pre, post = "[string \"", "\"]"
+		line, truncated := source, false
+		if i := strings.IndexByte(line, '\n'); i >= 0 {
+			line, truncated = line[:i], true
+		}
+		if max := LUA_IDSIZE - len(pre) - len("...") - len(post) - 1; len(line) >= max {
+			line, truncated = line[:max], true
+		}
+		if truncated {
+			return pre + line + "..." + post
+		}
+		return pre + line + post
+	}
+}
+
+// pcall 保护模式调用函数f, 出错时在出错位置调用消息处理函数handler(可以为nil)并恢复栈帧
+func (vm *State) pcall(f luaValue, args []luaValue, handler luaValue) (results []luaValue, err *LuaError) {
+	frame := vm.stack
+	defer func() {
+		if p := recover(); p != nil {
+			if _, ok := p.(interrupt); ok { // 中断不能被捕获
+				panic(p)
+			}
+			err = vm.toLuaError(p)
+			if handler != nil {
+				err = vm.callHandler(handler, err)
+			}
+			vm.unwindStack(frame)
+		}
+	}()
+	return vm.callValue(f, args), nil
+}
+
+// callHandler 调用消息处理函数, 处理函数自身出错时返回 LUA_ERRERR
+func (vm *State) callHandler(handler luaValue, err *LuaError) (result *LuaError) {
+	defer func() {
+		if p := recover(); p != nil {
+			if _, ok := p.(interrupt); ok {
+				panic(p)
+			}
+			result = &LuaError{Value: vm.toLuaError(p).Value, Status: api.LUA_ERRERR}
+		}
+	}()
+	return &LuaError{Value: _first(vm.callValue(handler, []luaValue{err.Value})), Status: err.Status}
+}
@@ -20,6 +20,8 @@ type luaTable struct {
 	meta   LuaTable              //元表
 	keys   map[luaValue]luaValue //used by next() 使用map将luaTable所有key组成单向链表
 	change bool                  //used by next()
+
+	readonly bool //只读table(沙箱共享的库table), 修改时抛出错误
 }
 
 var _ LuaTable = (*luaTable)(nil)
@@ -38,10 +40,8 @@ func newLuaTable(nArr, nRec int) *luaTable {
 	}
 }
 
+// Meta 获取元表, 未设置元表返回nil
 func (t *luaTable) Meta() LuaTable {
-	if t.meta == nil {
-		t.meta = newLuaTable(0, 0)
-	}
 	return t.meta
 }
 func (t *luaTable) SetMeta(meta LuaTable) {
@@ -59,9 +59,15 @@ func (t luaTable) Get(key luaValue) luaValue {
 }
 
 func (t *luaTable) Put(key, val luaValue) {
+	if t.readonly {
+		panic("attempt to modify a read-only table")
+	}
 	if key == nil {
 		panic("table index is nil")
 	}
+	if f, ok := key.(float64); ok && f != f {
+		panic("table index is NaN")
+	}
 	t.change = true
 	key = _tryToInteger(key)
 	if idx, ok := key.(int); ok && idx >= 1 {
@@ -97,19 +103,44 @@ func (t *luaTable) Next(key luaValue) luaValue {
 		t._initKeys()
 		t.change = false
 	}
-	return t.keys[key]
+	return t.keys[_tryToInteger(key)]
 }
-func (t luaTable) INext(key luaValue) luaValue {
+
+// isNextKey key是否可以作为next的参数: nil或者table中的键(包括遍历期间被赋值为nil的键)
+func (t *luaTable) isNextKey(key luaValue) bool {
 	if key == nil {
-		return t.arr[0]
-	} else {
-		if k, ok := toNumber(key); ok {
-			nextKey := int(k) + 1
-			if nextKey < len(t.arr) {
-				return t.arr[nextKey]
-			}
+		return true
+	}
+	key = _tryToInteger(key)
+	if t.keys == nil {
+		t._initKeys()
+		t.change = false
+	}
+	if _, ok := t.keys[key]; ok {
+		return true
+	}
+	if t.change { // 遍历开始之后新增的键
+		t._initKeys()
+		t.change = false
+		_, ok := t.keys[key]
+		return ok
+	}
+	return false
+}
+
+// INext 数组遍历的下一个key(key+1), 对应值为nil时返回nil, key为nil时从1开始
+func (t luaTable) INext(key luaValue) luaValue {
+	i := 0
+	if key != nil {
+		if k, ok := toInteger(key); ok {
+			i = k
+		} else {
+			return nil
 		}
 	}
+	if t.Get(i+1) != nil {
+		return i + 1
+	}
 	return nil
 }
 
@@ -128,7 +159,7 @@ func (t *luaTable) _initKeys() {
 			beforeKey = k
 		}
 	}
-
+	t.keys[beforeKey] = nil // 最后一个键, 用于判断键是否有效
 }
 
 func _tryToInteger(key luaValue) luaValue {
@@ -2,37 +2,113 @@ package vm
 
 import (
 	"fmt"
+	"luago/vm/api"
+	"math"
 	"strconv"
+	"strings"
 )
 
 /* basic types */
 const (
-	LUA_TNONE = iota - 1 // -1
-	LUA_TNIL
-	LUA_TBOOLEAN
-	LUA_TLIGHTUSERDATA
-	LUA_TNUMBER
-	LUA_TSTRING
-	LUA_TTABLE
-	LUA_TFUNCTION
-	LUA_TUSERDATA
-	LUA_TTHREAD
+	LUA_TNONE          = api.LUA_TNONE
+	LUA_TNIL           = api.LUA_TNIL
+	LUA_TBOOLEAN       = api.LUA_TBOOLEAN
+	LUA_TLIGHTUSERDATA = api.LUA_TLIGHTUSERDATA
+	LUA_TNUMBER        = api.LUA_TNUMBER
+	LUA_TSTRING        = api.LUA_TSTRING
+	LUA_TTABLE         = api.LUA_TTABLE
+	LUA_TFUNCTION      = api.LUA_TFUNCTION
+	LUA_TUSERDATA      = api.LUA_TUSERDATA
+	LUA_TTHREAD        = api.LUA_TTHREAD
+	LUA_NUMTAGS        = api.LUA_NUMTAGS
 )
 
 // lua 变量
 type luaValue = interface{}
 
+// typeOf 获取lua变量的基础类型
+func typeOf(v luaValue) int {
+	switch v.(type) {
+	case nil:
+		return LUA_TNIL
+	case bool:
+		return LUA_TBOOLEAN
+	case int, int64, float64:
+		return LUA_TNUMBER
+	case string:
+		return LUA_TSTRING
+	case LuaTable:
+		return LUA_TTABLE
+	case *closure:
+		return LUA_TFUNCTION
+	case LightUserData:
+		return LUA_TLIGHTUSERDATA
+	case *UserData:
+		return LUA_TUSERDATA
+	case *State:
+		return LUA_TTHREAD
+	default:
+		return LUA_TUSERDATA // 其他宿主(golang)类型的值
+	}
+}
+
+// typeName 基础类型名称
+func typeName(tp int) string {
+	switch tp {
+	case LUA_TNONE:
+		return "no value"
+	case LUA_TNIL:
+		return "nil"
+	case LUA_TBOOLEAN:
+		return "boolean"
+	case LUA_TNUMBER:
+		return "number"
+	case LUA_TSTRING:
+		return "string"
+	case LUA_TTABLE:
+		return "table"
+	case LUA_TFUNCTION:
+		return "function"
+	case LUA_TTHREAD:
+		return "thread"
+	default:
+		return "userdata"
+	}
+}
+
 func toString(v luaValue) (string, bool) {
 	switch x := v.(type) {
 	case string:
 		return x, true
-	case int, int64, float64:
-		return fmt.Sprintf("%v", x), true // TODO: check lua float to string
+	case int, int64:
+		return fmt.Sprintf("%d", x), true
+	case float64:
+		return floatToString(x), true
 	default:
 		return "", false
 	}
 }
 
+// floatToString 同官方实现使用"%.14g"格式, 看起来像整数时添加".0"
+func floatToString(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		if math.Signbit(f) {
+			return "-nan"
+		}
+		return "nan"
+	}
+	s := strconv.FormatFloat(f, 'g', 14, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
+
 func toBool(v luaValue) bool {
 	switch x := v.(type) {
 	case nil:
@@ -66,6 +142,29 @@ func argK(vm *State, rk int) luaValue {
 	}
 }
 
+// toInteger 数字转换为整数, 浮点数必须没有小数部分
+func toInteger(v luaValue) (int, bool) {
+	switch x := v.(type) {
+	case int:
+		return x, true
+	case int64:
+		return int(x), true
+	case float64:
+		return floatToInteger(x)
+	}
+	return 0, false
+}
+
+// floatToInteger 浮点数转换为整数, 必须没有小数部分且在整数范围内
+func floatToInteger(f float64) (int, bool) {
+	if f >= -(1<<63) && f < 1<<63 {
+		if i := int(f); float64(i) == f {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 // luaValue to float
 func convertToFloat(val luaValue) (float64, bool) {
 	switch v := val.(type) {
@@ -76,9 +175,107 @@ func convertToFloat(val luaValue) (float64, bool) {
 	case int64:
 		return float64(v), true
 	case string:
-		fv, err := strconv.ParseFloat(v, 64)
-		return fv, err == nil
+		if n, ok := stringToNumber(v); ok {
+			return toNumber(n)
+		}
+		return 0, false
 	default:
 		return 0, false
 	}
 }
+
+// luaValue to integer
+func convertToInteger(val luaValue) (int, bool) {
+	if s, ok := val.(string); ok {
+		if n, ok := stringToNumber(s); ok {
+			return toInteger(n)
+		}
+		return 0, false
+	}
+	return toInteger(val)
+}
+
+// stringToNumber 按lua语法将字符串转换为整数或浮点数(支持十六进制), 允许前后空白
+func stringToNumber(s string) (luaValue, bool) {
+	s = strings.Trim(s, " \f\n\r\t\v")
+	if s == "" {
+		return nil, false
+	}
+	body, neg := s, false
+	if body[0] == '-' || body[0] == '+' {
+		neg, body = body[0] == '-', body[1:]
+	}
+	if len(body) > 2 && body[0] == '0' && (body[1] == 'x' || body[1] == 'X') {
+		return hexToNumber(body[2:], neg)
+	}
+	if body == "" || strings.IndexFunc(body, func(r rune) bool {
+		return !(r >= '0' && r <= '9' || r == '.' || r == 'e' || r == 'E' || r == '+' || r == '-')
+	}) >= 0 {
+		return nil, false
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int(i), true
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil || isRangeError(err) {
+		return f, true
+	}
+	return nil, false
+}
+
+// hexToNumber 十六进制数字, 整数溢出时回绕(同官方实现), 可以包含小数部分和二进制指数(p)
+func hexToNumber(s string, neg bool) (luaValue, bool) {
+	if s == "" {
+		return nil, false
+	}
+	isInt := true
+	for _, c := range s {
+		if !isHexDigit(byte(c)) {
+			isInt = false
+			break
+		}
+	}
+	if isInt {
+		var n uint
+		for i := 0; i < len(s); i++ {
+			n = n<<4 | uint(hexDigitValue(s[i]))
+		}
+		if neg {
+			return -int(n), true
+		}
+		return int(n), true
+	}
+	if !strings.ContainsAny(s, "pP") {
+		s += "p0"
+	}
+	if strings.ContainsAny(s, "_") {
+		return nil, false
+	}
+	f, err := strconv.ParseFloat("0x"+s, 64)
+	if err != nil && !isRangeError(err) {
+		return nil, false
+	}
+	if neg {
+		f = -f
+	}
+	return f, true
+}
+
+func isRangeError(err error) bool {
+	e, ok := err.(*strconv.NumError)
+	return ok && e.Err == strconv.ErrRange
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func hexDigitValue(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'f':
+		return int(c-'a') + 10
+	default:
+		return int(c-'A') + 10
+	}
+}
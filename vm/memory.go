@@ -0,0 +1,230 @@
+package vm
+
+import (
+	"luago/chunk"
+	"luago/vm/api"
+	"strings"
+	"unsafe"
+)
+
+// 内存统计使用的近似大小(字节), 按64位平台上golang的内存布局估算
+const (
+	valueSize       = 16  // luaValue(interface{})
+	stringOverhead  = 16  // 字符串头
+	tableOverhead   = 96  // luaTable结构和map头
+	tableEntrySize  = 48  // 哈希部分每个键值对
+	closureOverhead = 48  // closure结构
+	upvalueSize     = 24  // 每个upvalue的指针和装箱的值
+	userdataSize    = 64  // UserData结构
+	frameOverhead   = 160 // stackFrame结构和openuvs
+	protoOverhead   = 160 // Prototype结构
+)
+
+// errNotEnoughMemory 超过内存上限时抛出的错误, 与lua一样不带位置信息, 可以被pcall捕获
+var errNotEnoughMemory = &LuaError{Value: "not enough memory", Status: api.LUA_ERRMEM}
+
+// MemoryUsage 返回State当前统计的近似内存占用(字节), 包括table, 字符串, 闭包和函数栈帧
+// 统计值在分配时增加, 在重新统计(内存超过上限或者collectgarbage("collect"))时减去不再可达的对象
+func (vm *State) MemoryUsage() int {
+	return vm.memUsed
+}
+
+// memScanRatio 两次重新统计之间至少新分配上限的1/memScanRatio, 避免接近上限时每次分配都重新统计
+const memScanRatio = 8
+
+// allocMem 计入即将分配的n字节内存, 需在新对象可以从根访问到之前调用
+// 超过 WithMemoryLimit 设置的上限时先重新统计可达对象, 仍然超过时抛出 "not enough memory" 错误
+// 上一次重新统计之后新分配的内存不足上限的1/memScanRatio时不再重新统计, 直接抛出错误
+func (vm *State) allocMem(n int) {
+	vm.memUsed += n
+	vm.memAllocated += n
+	if vm.memLimit <= 0 || vm.memUsed <= vm.memLimit {
+		return
+	}
+	if vm.memAllocated >= vm.memLimit/memScanRatio {
+		vm.collectMem()
+		vm.memUsed += n
+	}
+	if vm.memUsed > vm.memLimit {
+		vm.memUsed -= n
+		vm.memAllocated = vm.memLimit // 出错时展开的栈帧和对象可能不再可达, 下一次超过上限时重新统计
+		panic(errNotEnoughMemory)
+	}
+}
+
+// allocPending 计入go函数正在生成的结果(如strings.Builder)新增的n字节
+// 生成中的结果从根不可达, 重新统计时计入当前栈帧的memPending, 函数返回或者出错时随栈帧一起丢弃
+func (vm *State) allocPending(n int) {
+	vm.allocMem(n)
+	vm.stack.memPending += n
+}
+
+// freeMem 减去确定已经释放的n字节内存, 如弹出的函数栈帧
+func (vm *State) freeMem(n int) {
+	if vm.memUsed -= n; vm.memUsed < 0 {
+		vm.memUsed = 0
+	}
+}
+
+// unwindStack 出错时弹出frame之上的全部栈帧, 并释放栈帧占用的内存
+func (vm *State) unwindStack(frame *stackFrame) {
+	for f := vm.stack; f != nil && f != frame; f = f.prev {
+		vm.freeMem(f.memSize)
+	}
+	vm.stack = frame
+}
+
+// memWriter 逐块生成的字符串(如读取的文件内容), 每块写入之前通过allocPending计入内存统计, 超过上限时抛出错误
+type memWriter struct {
+	vm *State
+	b  strings.Builder
+}
+
+func newMemWriter(vm *State) *memWriter {
+	vm.allocPending(stringOverhead)
+	return &memWriter{vm: vm}
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	w.vm.allocPending(len(p))
+	return w.b.Write(p)
+}
+
+func (w *memWriter) Len() int {
+	return w.b.Len()
+}
+
+func (w *memWriter) String() string {
+	return w.b.String()
+}
+
+func stringSize(n int) int {
+	return stringOverhead + n
+}
+
+func frameSize(slots, varargs int) int {
+	return frameOverhead + (slots+varargs)*valueSize
+}
+
+// collectMem 从注册表, 全局变量表, 类型元表和虚拟机栈出发重新统计可达对象占用的内存
+func (vm *State) collectMem() {
+	m := memScanner{seen: map[interface{}]bool{}, strs: map[uintptr]bool{}}
+	m.add(vm.registry)
+	m.add(vm.global)
+	for _, mt := range vm.metas {
+		m.add(mt)
+	}
+	for _, mt := range vm.goMetas {
+		m.add(mt)
+	}
+	for _, mt := range vm.reflectMetas {
+		m.add(mt)
+	}
+	if vm.main != nil {
+		m.add(vm.main)
+	}
+	if vm.sandbox != nil {
+		m.add(vm.sandbox)
+	}
+	m.add(vm.hookValue)
+	for f := vm.stack; f != nil; f = f.prev {
+		m.size += frameSize(cap(f.slots), len(f.varargs)) + f.memPending
+		m.addAll(f.slots)
+		m.addAll(f.varargs)
+		m.addAll(f.results)
+		if f.c != nil {
+			m.add(f.c)
+		}
+	}
+	m.scan()
+	vm.memUsed = m.size
+	vm.memAllocated = 0
+}
+
+// memScanner 遍历可达对象并累计大小, 使用显式的工作队列避免深层嵌套的table耗尽go栈
+type memScanner struct {
+	seen  map[interface{}]bool // 已经访问过的table, 闭包, userdata和函数原型
+	strs  map[uintptr]bool     // 已经计入的字符串(按底层数据地址去重)
+	queue []interface{}
+	size  int
+}
+
+func (m *memScanner) addAll(vals []luaValue) {
+	for _, v := range vals {
+		m.add(v)
+	}
+}
+
+// add 计入字符串, 将尚未访问的引用类型放入工作队列
+func (m *memScanner) add(v luaValue) {
+	switch x := v.(type) {
+	case string:
+		if len(x) == 0 {
+			return
+		}
+		p := uintptr(unsafe.Pointer(unsafe.StringData(x)))
+		if !m.strs[p] {
+			m.strs[p] = true
+			m.size += stringSize(len(x))
+		}
+	case LuaTable, *closure, *UserData, *chunk.Prototype:
+		if x != nil && !m.seen[x] {
+			m.seen[x] = true
+			m.queue = append(m.queue, x)
+		}
+	}
+}
+
+func (m *memScanner) scan() {
+	for len(m.queue) > 0 {
+		v := m.queue[len(m.queue)-1]
+		m.queue = m.queue[:len(m.queue)-1]
+		switch x := v.(type) {
+		case *luaTable:
+			m.size += tableOverhead + cap(x.arr)*valueSize + len(x._map)*tableEntrySize
+			m.addAll(x.arr)
+			for k, v := range x._map {
+				m.add(k)
+				m.add(v)
+			}
+			if x.keys != nil {
+				m.size += len(x.keys) * tableEntrySize
+			}
+			if x.meta != nil {
+				m.add(x.meta)
+			}
+		case LuaTable:
+			m.size += tableOverhead
+			for k := x.Next(nil); k != nil; k = x.Next(k) {
+				m.size += tableEntrySize
+				m.add(k)
+				m.add(x.Get(k))
+			}
+			if mt := x.Meta(); mt != nil {
+				m.add(mt)
+			}
+		case *closure:
+			m.size += closureOverhead + len(x.upvals)*upvalueSize
+			for _, uv := range x.upvals {
+				if uv != nil && uv.val != nil {
+					m.add(*uv.val)
+				}
+			}
+			if x.proto != nil {
+				m.add(x.proto)
+			}
+		case *UserData:
+			m.size += userdataSize
+			m.add(x.userValue)
+			if x.meta != nil {
+				m.add(x.meta)
+			}
+		case *chunk.Prototype:
+			m.size += protoOverhead + len(x.Code)*4 + len(x.Constants)*valueSize + len(x.LineInfo)*4
+			m.addAll(x.Constants)
+			for _, p := range x.Protos {
+				m.add(p)
+			}
+		}
+	}
+}
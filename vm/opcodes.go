@@ -148,12 +148,9 @@ func opLoadBool(i Instruction, vm *State) {
 // loadNil 寄存器a开始设置b个nil
 func opLoadNil(i Instruction, vm *State) {
 	a, b, _ := i.ABC()
-	for j := a + b; j >= a; j-- {
-		if j < len(vm.stack.slots) {
-			vm.stack.slots[j] = nil
-		} else {
-			vm.stack.slots = append(vm.stack.slots, nil)
-		}
+	vm.stack.check(a + b)
+	for j := a; j <= a+b; j++ {
+		vm.stack.slots[j] = nil
 	}
 }
 
@@ -166,30 +163,18 @@ func opGetUpval(i Instruction, vm *State) {
 func opGetTabup(i Instruction, vm *State) {
 	a, b, c := i.ABC()
 	k := argK(vm, c)
-	if t, ok := (*vm.stack.c.upvals[b].val).(LuaTable); ok {
-		vm.stack.slots[a] = t.Get(k) //XXX:考虑是否需要调用元方法
-	} else {
-		panic(fmt.Sprintf("op getTabup r[%d] not table", b))
-	}
+	vm.stack.slots[a] = vm.index(*vm.stack.c.upvals[b].val, k) // _ENV可以是load指定的任意值
 }
 func opGetTable(i Instruction, vm *State) {
 	a, b, c := i.ABC()
 	k := argK(vm, c)
-	if v, ok := vm.getTable(vm.stack.slots[b], k); ok {
-		vm.stack.slots[a] = v
-	} else {
-		panic(fmt.Sprintf("op getTable r[%d] not table", b))
-	}
+	vm.stack.slots[a] = vm.index(vm.stack.slots[b], k)
 }
 func opSetTabup(i Instruction, vm *State) {
 	a, b, c := i.ABC()
 	k := argK(vm, b)
 	v := argK(vm, c)
-	if t, ok := (*vm.stack.c.upvals[a].val).(LuaTable); ok {
-		t.Put(k, v) //XXX:考虑是否需要调用元方法
-	} else {
-		panic(fmt.Sprintf("op setTabup r[%d] not table", a))
-	}
+	vm.setIndex(*vm.stack.c.upvals[a].val, k, v)
 }
 
 // setUpval 将寄存器a设置到 upvalue b
@@ -201,19 +186,19 @@ func opSetTable(i Instruction, vm *State) {
 	a, b, c := i.ABC()
 	k := argK(vm, b)
 	v := argK(vm, c)
-	if ok := vm.setTable(vm.stack.slots[a], k, v); !ok {
-		panic(fmt.Sprintf("op setTable r[%d] not table", a))
-	}
+	vm.setIndex(vm.stack.slots[a], k, v)
 }
 func opNewTable(i Instruction, vm *State) {
 	a, b, c := i.ABC()
-	vm.stack.slots[a] = newLuaTable(Fb2int(b), Fb2int(c))
+	nArr, nRec := Fb2int(b), Fb2int(c)
+	vm.allocMem(tableOverhead + nArr*valueSize + nRec*tableEntrySize)
+	vm.stack.slots[a] = newLuaTable(nArr, nRec)
 }
 func opSelf(i Instruction, vm *State) {
 	a, b, c := i.ABC()
 	self := vm.stack.slots[b]
 	vm.stack.slots[a+1] = self
-	vm.stack.slots[a], _ = vm.getTable(self, argK(vm, c))
+	vm.stack.slots[a] = vm.index(self, argK(vm, c))
 }
 
 func opAdd(i Instruction, vm *State) {
@@ -383,36 +368,17 @@ func opBnot(i Instruction, vm *State) {
 
 func opNot(i Instruction, vm *State) {
 	a, b, _ := i.ABC()
-	vm.stack.slots[a] = toBool(vm.stack.slots[b])
+	vm.stack.slots[a] = !toBool(vm.stack.slots[b])
 }
 
 func opLen(i Instruction, vm *State) {
 	a, b, _ := i.ABC()
-	val := vm.stack.slots[b]
-	if s, ok := val.(string); ok {
-		vm.stack.slots[a] = len(s)
-	} else if v, ok := vm.callMetaMethod("__len", val, nil); ok {
-		vm.stack.slots[a] = v
-	} else if t, ok := val.(LuaTable); ok {
-		vm.stack.slots[a] = t.Len()
-	} else {
-		panic(fmt.Sprintf("attempt to get length of a %T value", val))
-	}
+	vm.stack.slots[a] = vm.length(vm.stack.slots[b])
 }
 
 func opConcat(i Instruction, vm *State) {
 	a, b, c := i.ABC()
-	s := "" // TODO:字符串拼接是否可优化
-	for ; b <= c; b++ {
-		if v, ok := toString(vm.stack.slots[b]); ok {
-			s += v
-		} else if v, ok := vm.callMetaMethod("__concat", s, vm.stack.slots[b]); ok {
-			s += v.(string) //panic if v is not string
-		} else {
-			panic(fmt.Sprintf("op concat %T", vm.stack.slots[b]))
-		}
-	}
-	vm.stack.slots[a] = s
+	vm.stack.slots[a] = vm.concat(vm.stack.slots[b : c+1])
 }
 
 // jmp 程序计数器增加sbx
@@ -420,11 +386,7 @@ func opJmp(i Instruction, vm *State) {
 	a, sBx := i.AsBx()
 	vm.stack.pc += sBx
 	if a != 0 { //close 大于等于 a-1 的 upvalue
-		for i := range vm.stack.openuvs {
-			if i >= a-1 {
-				delete(vm.stack.openuvs, i)
-			}
-		}
+		vm.stack.closeUpvalues(a - 1)
 	}
 }
 
@@ -478,22 +440,7 @@ func opCall(i Instruction, vm *State) {
 	} else {
 		args = vm.stack.slots[a+1 : vm.stack.top]
 	}
-	var results []luaValue
-	callOk := false
-	if f, ok := _f.(*closure); ok {
-		results = _callClosure(vm, f, args...)
-		callOk = true
-	} else {
-		if mf := vm.metaField(_f, "__call"); mf != nil {
-			if f, ok := mf.(*closure); ok {
-				results = _callClosure(vm, f, append([]luaValue{_f}, args...)...)
-				callOk = true
-			}
-		}
-	}
-	if !callOk {
-		panic(fmt.Sprintf("attempt to call a %T value", _f))
-	}
+	results := vm.callValue(_f, args)
 
 	if c == 1 { // no results
 		vm.stack.top = a
@@ -520,6 +467,7 @@ func opTailcall(i Instruction, vm *State) {
 }
 func opReturn(i Instruction, vm *State) {
 	a, b, _ := i.ABC()
+	vm.stack.closeUpvalues(0)
 	if b == 1 { //no return
 	} else if b > 1 {
 		vm.stack.results = vm.stack.slots[a : a+b-1] //return (b-1) values
@@ -607,6 +555,7 @@ func opSetList(i Instruction, vm *State) {
 			b = vm.stack.top - a
 		}
 		idx := c * LFIELDS_PER_FLUSH
+		vm.allocMem(b * valueSize)
 		for j := 1; j <= b; j++ {
 			idx++
 			t.Put(idx, vm.stack.slots[a+j])
@@ -618,6 +567,7 @@ func opSetList(i Instruction, vm *State) {
 func opClosure(i Instruction, vm *State) {
 	a, bx := i.ABx()
 	subProto := vm.stack.c.proto.Protos[bx]
+	vm.allocMem(closureOverhead + len(subProto.Upvalues)*upvalueSize)
 	c := newClosure(subProto)
 	vm.stack.slots[a] = c
 	// 更新upvalues
@@ -626,7 +576,7 @@ func opClosure(i Instruction, vm *State) {
 			if openuv, ok := vm.stack.openuvs[int(uv.Idx)]; ok { //前面已经有opClosure把该寄存器放入openuv
 				c.upvals[i] = openuv
 			} else { //首次将寄存器i放入openuv
-				c.upvals[i] = updateValue{&vm.stack.slots[uv.Idx]}
+				c.upvals[i] = &updateValue{&vm.stack.slots[uv.Idx]}
 				vm.stack.openuvs[int(uv.Idx)] = c.upvals[i]
 			}
 		} else { // 父函数upval引用
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"io"
+	"io/fs"
+	"math/rand"
+	"time"
+)
+
+// Option NewState的配置选项
+type Option func(*State)
+
+// WithRandSource 设置math.random使用的随机数源, 可以注入固定的随机数源以得到可重复的结果
+// 默认每个State使用独立的以当前时间为种子的随机数源
+func WithRandSource(src rand.Source) Option {
+	return func(vm *State) {
+		vm.rand = rand.New(src)
+	}
+}
+
+// WithClock 设置os.time/os.date/os.clock使用的时钟, 可以注入固定的时间以得到可重复的结果
+// 默认使用time.Now
+func WithClock(now func() time.Time) Option {
+	return func(vm *State) {
+		vm.clock = now
+	}
+}
+
+// WithEnv 设置os.getenv查询环境变量的函数, 第二个返回值表示变量是否存在
+// 默认使用os.LookupEnv
+func WithEnv(lookup func(key string) (string, bool)) Option {
+	return func(vm *State) {
+		vm.getenv = lookup
+	}
+}
+
+// WithFileSystem 设置io库和os库访问的文件系统, 默认为OSFileSystem
+// 可以使用 NewReadOnlyFS 包装fs.FS, 或者使用 NewMemFS 使脚本只能访问内存中的虚拟目录
+func WithFileSystem(fsys FileSystem) Option {
+	return func(vm *State) {
+		vm.fs = fsys
+	}
+}
+
+// WithOSFileAccess 设置是否允许os.remove/os.rename/os.tmpname访问文件系统, 默认允许
+// 禁止时调用这些函数会抛出错误
+func WithOSFileAccess(allowed bool) Option {
+	return func(vm *State) {
+		vm.allowFileOps = allowed
+	}
+}
+
+// WithOSExit 设置是否允许os.exit结束宿主进程, 默认允许
+// 禁止时调用os.exit会抛出错误
+func WithOSExit(allowed bool) Option {
+	return func(vm *State) {
+		vm.allowExit = allowed
+	}
+}
+
+// WithCompiler 设置加载lua源码使用的编译器, require和load通过它加载源码, 默认只能加载二进制chunk
+func WithCompiler(c Compiler) Option {
+	return func(vm *State) {
+		vm.compiler = c
+	}
+}
+
+// WithModuleFS 设置require查找和读取模块文件的文件系统, 如使用embed.FS提供内置模块
+// 模块路径经过path.Clean规范化并去掉开头的"/"后在fsys中查找, 如 "./a/b.lua" 对应 "a/b.lua"
+// 默认使用 WithFileSystem 设置的文件系统
+func WithModuleFS(fsys fs.FS) Option {
+	return func(vm *State) {
+		vm.moduleFS = fsys
+	}
+}
+
+// WithStdin 设置io.stdin和不带文件名的loadfile/dofile读取的标准输入, 默认为os.Stdin
+func WithStdin(r io.Reader) Option {
+	return func(vm *State) {
+		vm.stdin = r
+	}
+}
+
+// WithStdout 设置print和io.stdout写入的标准输出, 默认为os.Stdout
+func WithStdout(w io.Writer) Option {
+	return func(vm *State) {
+		vm.stdout = w
+	}
+}
+
+// WithStderr 设置io.stderr写入的标准错误输出, 默认为os.Stderr
+func WithStderr(w io.Writer) Option {
+	return func(vm *State) {
+		vm.stderr = w
+	}
+}
+
+// WithLibs 设置NewState打开的标准库, 如 WithLibs(LibBase, LibString, LibTable), 不带参数时不打开任何库
+// 默认打开全部标准库, 之后可以通过 OpenLibs 打开其他库
+func WithLibs(libs ...Lib) Option {
+	return func(vm *State) {
+		vm.libs = 0
+		for _, lib := range libs {
+			vm.libs |= lib
+		}
+	}
+}
+
+// WithSandbox 以沙箱模式创建State, 全局变量表只包含policy允许的全局变量和库函数, 库table和字符串元表只读
+// 可以使用 DefaultSandboxPolicy, 通过 NewSandboxEnv 为每个脚本创建独立的全局环境
+func WithSandbox(policy SandboxPolicy) Option {
+	return func(vm *State) {
+		vm.policy = &policy
+	}
+}
+
+// WithInstructionLimit 设置每次 RunContext/CallContext 最多执行的指令数, 超过时返回 ErrInstructionLimit
+// string.rep, table.sort和模式匹配等go库函数按照循环次数计入指令数, 默认(n为0)不限制
+func WithInstructionLimit(n int) Option {
+	return func(vm *State) {
+		vm.instLimit = n
+	}
+}
+
+// WithMemoryLimit 设置State的近似内存上限(字节), 统计table, 字符串, 闭包和函数栈帧占用的内存
+// 超过上限时抛出 "not enough memory" 错误(可以被pcall捕获), 默认(bytes为0)不限制
+func WithMemoryLimit(bytes int) Option {
+	return func(vm *State) {
+		vm.memLimit = bytes
+	}
+}
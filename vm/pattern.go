@@ -0,0 +1,400 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lua模式匹配(同lstrlib), lua模式不是正则表达式, 不能使用regexp实现
+// 字符串位置使用字节索引, -1表示匹配失败
+
+const (
+	maxCCalls      = 200 // 匹配函数的最大递归深度
+	luaMaxCaptures = 32  // 最大捕获数量
+	capUnfinished  = -1  // 捕获未结束
+	capPosition    = -2  // 位置捕获 ()
+	patEsc         = '%'
+	patSpecials    = "^$*+?.([%-"
+)
+
+type matchState struct {
+	vm         *State
+	src        string
+	pat        string
+	level      int // 捕获数量
+	matchdepth int // 剩余可以递归的深度
+	capture    [luaMaxCaptures]struct {
+		init int
+		len  int
+	}
+}
+
+func newMatchState(vm *State, src, pat string) *matchState {
+	return &matchState{vm: vm, src: src, pat: pat, matchdepth: maxCCalls}
+}
+
+// reset 每次尝试新的匹配前重置状态
+func (ms *matchState) reset() {
+	ms.level = 0
+	ms.matchdepth = maxCCalls
+}
+
+// noSpecials 模式中不包含特殊字符时可以直接使用字符串查找
+func noSpecials(pat string) bool {
+	return !strings.ContainsAny(pat, patSpecials)
+}
+
+func (ms *matchState) checkCapture(l byte) int {
+	i := int(l) - '1'
+	if i < 0 || i >= ms.level || ms.capture[i].len == capUnfinished {
+		panic(fmt.Sprintf("invalid capture index %%%d", i+1))
+	}
+	return i
+}
+
+func (ms *matchState) captureToClose() int {
+	level := ms.level - 1
+	for ; level >= 0; level-- {
+		if ms.capture[level].len == capUnfinished {
+			return level
+		}
+	}
+	panic("invalid pattern capture")
+}
+
+// classEnd 单个字符类(如 a %d [a-z])之后的位置
+func (ms *matchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	switch c {
+	case patEsc:
+		if p >= len(ms.pat) {
+			panic("malformed pattern (ends with '%')")
+		}
+		return p + 1
+	case '[':
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		for { // 查找 ']', 第一个字符不能作为结束
+			if p >= len(ms.pat) {
+				panic("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == patEsc && p < len(ms.pat) {
+				p++ // 跳过转义字符(如 '%]')
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+		}
+	default:
+		return p
+	}
+}
+
+// matchClass 字符c是否属于字符类%cl, 只识别ASCII字符(同C locale)
+func matchClass(c, cl byte) bool {
+	var res bool
+	switch cl | 0x20 { // tolower
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = c < 0x20 || c == 0x7f
+	case 'd':
+		res = c >= '0' && c <= '9'
+	case 'g':
+		res = c > 0x20 && c < 0x7f
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = c > 0x20 && c < 0x7f && !isAlpha(c) && !(c >= '0' && c <= '9')
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isAlpha(c) || (c >= '0' && c <= '9')
+	case 'x':
+		res = isHexDigit(c)
+	case 'z': // 已废弃, 同\0
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if cl >= 'A' && cl <= 'Z' { // 大写字符类取反
+		return !res
+	}
+	return res
+}
+
+func isAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// matchBracketClass 字符c是否属于集合, p为'['的位置, ec为']'的位置
+func (ms *matchState) matchBracketClass(c byte, p, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		if ms.pat[p] == patEsc {
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		} else if ms.pat[p+1] == '-' && p+2 < ec {
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		} else if ms.pat[p] == c {
+			return sig
+		}
+	}
+	return !sig
+}
+
+// singleMatch s处的字符是否匹配[p, ep)的字符类
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case patEsc:
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	default:
+		return ms.pat[p] == c
+	}
+}
+
+// matchBalance %bxy
+func (ms *matchState) matchBalance(s, p int) int {
+	if p+1 >= len(ms.pat) {
+		panic("malformed pattern (missing arguments to '%b')")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for s++; s < len(ms.src); s++ {
+		if ms.src[s] == e {
+			if cont--; cont == 0 {
+				return s + 1
+			}
+		} else if ms.src[s] == b {
+			cont++
+		}
+	}
+	return -1
+}
+
+// maxExpand 贪婪匹配 * +
+func (ms *matchState) maxExpand(s, p, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- { // 尽可能多地匹配, 失败时回退
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+// minExpand 非贪婪匹配 -
+func (ms *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		} else if ms.singleMatch(s, p, ep) {
+			s++
+		} else {
+			return -1
+		}
+	}
+}
+
+func (ms *matchState) startCapture(s, p, what int) int {
+	if ms.level >= luaMaxCaptures {
+		panic("too many captures")
+	}
+	ms.capture[ms.level].init = s
+	ms.capture[ms.level].len = what
+	ms.level++
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.level-- // 匹配失败, 撤销捕获
+	}
+	return res
+}
+
+func (ms *matchState) endCapture(s, p int) int {
+	l := ms.captureToClose()
+	ms.capture[l].len = s - ms.capture[l].init
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.capture[l].len = capUnfinished
+	}
+	return res
+}
+
+// matchCapture %1-%9 匹配之前捕获的字符串
+func (ms *matchState) matchCapture(s int, l byte) int {
+	i := ms.checkCapture(l)
+	init, n := ms.capture[i].init, ms.capture[i].len
+	if n >= 0 && len(ms.src)-s >= n && ms.src[init:init+n] == ms.src[s:s+n] {
+		return s + n
+	}
+	return -1
+}
+
+// match 从src的s处开始匹配模式中p之后的部分, 返回匹配结束的位置
+func (ms *matchState) match(s, p int) int {
+	if ms.matchdepth--; ms.matchdepth == 0 {
+		panic("pattern too complex")
+	}
+	ms.vm.charge(1) // 回溯可能耗时很长, 需要可以中断
+	for p < len(ms.pat) {
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				s = ms.startCapture(s, p+2, capPosition)
+			} else {
+				s = ms.startCapture(s, p+1, capUnfinished)
+			}
+			ms.matchdepth++
+			return s
+		case ')':
+			s = ms.endCapture(s, p+1)
+			ms.matchdepth++
+			return s
+		case '$':
+			if p+1 == len(ms.pat) { // 模式结尾的'$'
+				if s != len(ms.src) {
+					s = -1
+				}
+				ms.matchdepth++
+				return s
+			}
+		case patEsc:
+			if p+1 < len(ms.pat) {
+				switch c := ms.pat[p+1]; {
+				case c == 'b':
+					if s = ms.matchBalance(s, p+2); s != -1 {
+						p += 4
+						continue
+					}
+					ms.matchdepth++
+					return s
+				case c == 'f': // 边界模式
+					p += 2
+					if p >= len(ms.pat) || ms.pat[p] != '[' {
+						panic("missing '[' after '%f' in pattern")
+					}
+					ep := ms.classEnd(p)
+					var prev, cur byte
+					if s > 0 {
+						prev = ms.src[s-1]
+					}
+					if s < len(ms.src) {
+						cur = ms.src[s]
+					}
+					if !ms.matchBracketClass(prev, p, ep-1) && ms.matchBracketClass(cur, p, ep-1) {
+						p = ep
+						continue
+					}
+					ms.matchdepth++
+					return -1
+				case c >= '0' && c <= '9': // 反向引用
+					if s = ms.matchCapture(s, c); s != -1 {
+						p += 2
+						continue
+					}
+					ms.matchdepth++
+					return s
+				}
+			}
+		}
+		// 默认情况: 单个字符类, 之后可能有重复修饰符
+		ep := ms.classEnd(p)
+		var epc byte
+		if ep < len(ms.pat) {
+			epc = ms.pat[ep]
+		}
+		if !ms.singleMatch(s, p, ep) {
+			if epc == '*' || epc == '?' || epc == '-' { // 允许匹配0次
+				p = ep + 1
+				continue
+			}
+			s = -1
+		} else {
+			switch epc {
+			case '?':
+				if res := ms.match(s+1, ep+1); res != -1 {
+					s = res
+				} else {
+					p = ep + 1
+					continue
+				}
+			case '+':
+				s = ms.maxExpand(s+1, p, ep)
+			case '*':
+				s = ms.maxExpand(s, p, ep)
+			case '-':
+				s = ms.minExpand(s, p, ep)
+			default:
+				s++
+				p = ep
+				continue
+			}
+		}
+		break
+	}
+	ms.matchdepth++
+	return s
+}
+
+// getCapture 第i个捕获的值, 没有捕获时i为0表示整个匹配[s, e)
+func (ms *matchState) getCapture(i, s, e int) luaValue {
+	if i >= ms.level {
+		if i != 0 {
+			panic(fmt.Sprintf("invalid capture index %%%d", i+1))
+		}
+		return ms.src[s:e]
+	}
+	init, l := ms.capture[i].init, ms.capture[i].len
+	if l == capUnfinished {
+		panic("unfinished capture")
+	}
+	if l == capPosition {
+		return init + 1
+	}
+	return ms.src[init : init+l]
+}
+
+// captures 所有捕获的值, s为-1时表示不需要整个匹配(string.find)
+func (ms *matchState) captures(s, e int) []luaValue {
+	n := ms.level
+	if n == 0 && s != -1 {
+		n = 1
+	}
+	results := make([]luaValue, n)
+	for i := range results {
+		results[i] = ms.getCapture(i, s, e)
+		if c, ok := results[i].(string); ok {
+			ms.vm.allocMem(stringSize(len(c)))
+		}
+	}
+	return results
+}
@@ -0,0 +1,427 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"reflect"
+)
+
+var (
+	_goFuncType = reflect.TypeOf(api.GoFunc(nil))
+	_errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	_luaTypes   = map[reflect.Type]bool{ // 可以直接作为lua值使用的类型
+		reflect.TypeOf(""):                 true,
+		reflect.TypeOf(0):                  true,
+		reflect.TypeOf(0.0):                true,
+		reflect.TypeOf(false):              true,
+		reflect.TypeOf(&closure{}):         true,
+		reflect.TypeOf(&luaTable{}):        true,
+		reflect.TypeOf(&UserData{}):        true,
+		reflect.TypeOf(LightUserData(nil)): true,
+	}
+)
+
+// ToLuaValue 通过反射将任意golang值转换为lua值
+//
+//	bool/整数/浮点数/字符串 转换为对应的lua基础类型
+//	func 转换为lua可调用的go函数, 参数和返回值自动转换, 最后一个返回值为非nil的error时抛出lua错误
+//	struct/指针/slice/array/map/chan 包装为userdata, 元表按类型缓存, 可以访问字段、方法、元素
+func (vm *State) ToLuaValue(v interface{}) luaValue {
+	switch x := v.(type) {
+	case nil, bool, string, int, float64, LuaTable, *closure, *UserData, LightUserData, *State:
+		return x
+	case api.GoFunc:
+		return newGoClosure(x)
+	case func(api.State, ...interface{}) []interface{}:
+		return newGoClosure(x)
+	}
+	return vm.reflectToLua(reflect.ValueOf(v))
+}
+
+func (vm *State) reflectToLua(rv reflect.Value) luaValue {
+	if !rv.IsValid() {
+		return nil
+	}
+	if _luaTypes[rv.Type()] {
+		return rv.Interface()
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Interface:
+		if rv.IsNil() {
+			return nil
+		}
+		return vm.reflectToLua(rv.Elem())
+	case reflect.Func:
+		if rv.IsNil() {
+			return nil
+		}
+		if rv.Type().ConvertibleTo(_goFuncType) {
+			return newGoClosure(rv.Convert(_goFuncType).Interface().(api.GoFunc))
+		}
+		return vm.reflectFunc(rv)
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan:
+		if rv.IsNil() {
+			return nil
+		}
+	}
+	return NewUserData(rv.Interface(), vm.reflectMeta(rv.Type()))
+}
+
+// reflectFunc 将golang函数包装为lua函数
+func (vm *State) reflectFunc(fv reflect.Value) *closure {
+	ft := fv.Type()
+	return newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		return vm.reflectCall(fv, ft, args)
+	})
+}
+
+// reflectCall 转换参数调用golang函数, 并转换返回值
+func (vm *State) reflectCall(fv reflect.Value, ft reflect.Type, args []luaValue) []luaValue {
+	nIn := ft.NumIn()
+	if ft.IsVariadic() {
+		nIn--
+	}
+	in := make([]reflect.Value, 0, len(args))
+	for i := 0; i < nIn; i++ {
+		var arg luaValue
+		if i < len(args) {
+			arg = args[i]
+		}
+		in = append(in, vm.argToGo(arg, ft.In(i), i+1))
+	}
+	if ft.IsVariadic() {
+		et := ft.In(nIn).Elem()
+		for i := nIn; i < len(args); i++ {
+			in = append(in, vm.argToGo(args[i], et, i+1))
+		}
+	}
+	out := fv.Call(in)
+	if n := len(out); n > 0 && ft.Out(n-1) == _errorType {
+		if err := out[n-1]; !err.IsNil() {
+			panic(err.Interface().(error).Error())
+		}
+		out = out[:n-1]
+	}
+	results := make([]luaValue, len(out))
+	for i, o := range out {
+		results[i] = vm.reflectToLua(o)
+	}
+	return results
+}
+
+// argToGo 转换第n个参数, 转换失败抛出参数错误
+func (vm *State) argToGo(arg luaValue, t reflect.Type, n int) reflect.Value {
+	if rv, err := vm.luaToReflect(arg, t); err != nil {
+		panic(fmt.Sprintf("bad argument #%d (%s)", n, err.Error()))
+	} else {
+		return rv
+	}
+}
+
+// luaToReflect 将lua值转换为t类型的golang值
+func (vm *State) luaToReflect(v luaValue, t reflect.Type) (reflect.Value, error) {
+	if v == nil {
+		return reflect.Zero(t), nil
+	}
+	if ud, ok := v.(*UserData); ok && t != reflect.TypeOf(ud) {
+		if v = ud.Value; v == nil {
+			return reflect.Zero(t), nil
+		}
+	}
+	rv := reflect.ValueOf(v)
+	if rv.Type().AssignableTo(t) {
+		if t.Kind() == reflect.Interface { // 保持接口类型
+			iv := reflect.New(t).Elem()
+			iv.Set(rv)
+			return iv, nil
+		}
+		return rv, nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if i, ok := toInteger(v); ok {
+			return reflect.ValueOf(i).Convert(t), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		if f, ok := toNumber(v); ok {
+			return reflect.ValueOf(f).Convert(t), nil
+		}
+	case reflect.String:
+		if s, ok := toString(v); ok {
+			return reflect.ValueOf(s).Convert(t), nil
+		}
+	case reflect.Bool:
+		return reflect.ValueOf(toBool(v)).Convert(t), nil
+	case reflect.Slice:
+		if s, ok := v.(string); ok && t.Elem().Kind() == reflect.Uint8 {
+			return reflect.ValueOf([]byte(s)).Convert(t), nil
+		}
+		if tb, ok := v.(LuaTable); ok {
+			return vm.tableToSlice(tb, t)
+		}
+	case reflect.Map:
+		if tb, ok := v.(LuaTable); ok {
+			return vm.tableToMap(tb, t)
+		}
+	case reflect.Struct:
+		if tb, ok := v.(LuaTable); ok {
+			return vm.tableToStruct(tb, t)
+		}
+	case reflect.Ptr:
+		if tb, ok := v.(LuaTable); ok && t.Elem().Kind() == reflect.Struct {
+			if sv, err := vm.tableToStruct(tb, t.Elem()); err != nil {
+				return sv, err
+			} else {
+				pv := reflect.New(t.Elem())
+				pv.Elem().Set(sv)
+				return pv, nil
+			}
+		}
+	case reflect.Func:
+		if c, ok := v.(*closure); ok {
+			return vm.closureToFunc(c, t), nil
+		}
+	}
+	if rv.Kind() == t.Kind() && rv.Type().ConvertibleTo(t) {
+		return rv.Convert(t), nil
+	}
+	return reflect.Value{}, fmt.Errorf("%s expected, got %s", t, _userTypeName(v))
+}
+
+func (vm *State) tableToSlice(tb LuaTable, t reflect.Type) (reflect.Value, error) {
+	n := tb.Len()
+	sv := reflect.MakeSlice(t, n, n)
+	for i := 0; i < n; i++ {
+		ev, err := vm.luaToReflect(tb.Get(i+1), t.Elem())
+		if err != nil {
+			return sv, err
+		}
+		sv.Index(i).Set(ev)
+	}
+	return sv, nil
+}
+
+func (vm *State) tableToMap(tb LuaTable, t reflect.Type) (reflect.Value, error) {
+	mv := reflect.MakeMap(t)
+	for k := tb.Next(nil); k != nil; k = tb.Next(k) {
+		kv, err := vm.luaToReflect(k, t.Key())
+		if err != nil {
+			return mv, err
+		}
+		ev, err := vm.luaToReflect(tb.Get(k), t.Elem())
+		if err != nil {
+			return mv, err
+		}
+		mv.SetMapIndex(kv, ev)
+	}
+	return mv, nil
+}
+
+func (vm *State) tableToStruct(tb LuaTable, t reflect.Type) (reflect.Value, error) {
+	sv := reflect.New(t).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" { // 未导出字段
+			continue
+		}
+		if v := tb.Get(f.Name); v != nil {
+			fv, err := vm.luaToReflect(v, f.Type)
+			if err != nil {
+				return sv, err
+			}
+			sv.Field(i).Set(fv)
+		}
+	}
+	return sv, nil
+}
+
+// closureToFunc 将lua函数包装为t类型的golang函数
+func (vm *State) closureToFunc(c *closure, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(in []reflect.Value) []reflect.Value {
+		args := make([]luaValue, len(in))
+		for i, arg := range in {
+			args[i] = vm.reflectToLua(arg)
+		}
+		results := _callClosure(vm, c, args...)
+		out := make([]reflect.Value, t.NumOut())
+		for i := range out {
+			var r luaValue
+			if i < len(results) {
+				r = results[i]
+			}
+			if rv, err := vm.luaToReflect(r, t.Out(i)); err != nil {
+				panic(fmt.Sprintf("bad result #%d (%s)", i+1, err.Error()))
+			} else {
+				out[i] = rv
+			}
+		}
+		return out
+	})
+}
+
+// reflectMeta 获取(并缓存)golang类型t包装为userdata时使用的元表
+func (vm *State) reflectMeta(t reflect.Type) LuaTable {
+	if mt, ok := vm.reflectMetas[t]; ok {
+		return mt
+	}
+	methods := newLuaTable(0, t.NumMethod())
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if m.PkgPath == "" {
+			methods.Put(m.Name, vm.reflectFunc(m.Func)) // 方法第一个参数为接收者, lua中使用 obj:Method() 调用
+		}
+	}
+	mt := newLuaTable(0, 8)
+	mt.Put("__name", t.String())
+	mt.Put("__index", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		return []interface{}{vm.reflectIndex(args[0].(*UserData), methods, args[1])}
+	}))
+	mt.Put("__newindex", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		vm.reflectNewIndex(args[0].(*UserData), args[1], args[2])
+		return nil
+	}))
+	mt.Put("__len", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		rv := reflect.Indirect(reflect.ValueOf(args[0].(*UserData).Value))
+		switch rv.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map, reflect.String, reflect.Chan:
+			return []interface{}{rv.Len()}
+		}
+		panic(fmt.Sprintf("attempt to get length of a %s value", t))
+	}))
+	mt.Put("__pairs", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		return []interface{}{vm.reflectPairs(args[0].(*UserData)), args[0], nil}
+	}))
+	mt.Put("__eq", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		a, ok1 := args[0].(*UserData)
+		b, ok2 := args[1].(*UserData)
+		return []interface{}{ok1 && ok2 && reflect.TypeOf(a.Value).Comparable() && a.Value == b.Value}
+	}))
+	mt.Put("__tostring", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		return []interface{}{fmt.Sprint(args[0].(*UserData).Value)}
+	}))
+	vm.reflectMetas[t] = mt
+	return mt
+}
+
+// reflectIndex 访问struct字段/方法, slice/array元素(下标从1开始), map元素
+func (vm *State) reflectIndex(ud *UserData, methods LuaTable, key luaValue) luaValue {
+	if name, ok := key.(string); ok {
+		if m := methods.Get(name); m != nil {
+			return m
+		}
+	}
+	rv := reflect.ValueOf(ud.Value)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		if name, ok := key.(string); ok {
+			if f, ok := rv.Type().FieldByName(name); ok && f.PkgPath == "" {
+				fv := rv.FieldByIndex(f.Index)
+				if fv.Kind() == reflect.Struct && fv.CanAddr() { // 嵌套struct返回指针, 使字段可以修改
+					fv = fv.Addr()
+				}
+				return vm.reflectToLua(fv)
+			}
+		}
+	case reflect.Slice, reflect.Array, reflect.String:
+		if i, ok := toInteger(key); ok && i >= 1 && i <= rv.Len() {
+			ev := rv.Index(i - 1)
+			if ev.Kind() == reflect.Struct && ev.CanAddr() {
+				ev = ev.Addr()
+			}
+			return vm.reflectToLua(ev)
+		}
+	case reflect.Map:
+		if kv, err := vm.luaToReflect(key, rv.Type().Key()); err == nil {
+			return vm.reflectToLua(rv.MapIndex(kv))
+		}
+	}
+	return nil
+}
+
+// reflectNewIndex 修改struct字段, slice/array元素, map元素(value为nil时删除)
+func (vm *State) reflectNewIndex(ud *UserData, key, val luaValue) {
+	rv := reflect.ValueOf(ud.Value)
+	if rv.Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		if name, ok := key.(string); ok {
+			if f, ok := rv.Type().FieldByName(name); ok && f.PkgPath == "" {
+				fv := rv.FieldByIndex(f.Index)
+				if !fv.CanSet() {
+					panic(fmt.Sprintf("cannot set field '%s' of non-pointer %s", name, rv.Type()))
+				}
+				fv.Set(vm.assignValue(val, fv.Type(), name))
+				return
+			}
+		}
+		panic(fmt.Sprintf("%s has no field '%v'", rv.Type(), key))
+	case reflect.Slice, reflect.Array:
+		if i, ok := toInteger(key); ok && i >= 1 && i <= rv.Len() {
+			if ev := rv.Index(i - 1); ev.CanSet() {
+				ev.Set(vm.assignValue(val, ev.Type(), key))
+				return
+			}
+		}
+		panic(fmt.Sprintf("index %v out of range or not assignable in %s", key, rv.Type()))
+	case reflect.Map:
+		kv := vm.assignValue(key, rv.Type().Key(), key)
+		if val == nil {
+			rv.SetMapIndex(kv, reflect.Value{})
+		} else {
+			rv.SetMapIndex(kv, vm.assignValue(val, rv.Type().Elem(), key))
+		}
+		return
+	}
+	panic(fmt.Sprintf("attempt to index a %s value", rv.Type()))
+}
+
+func (vm *State) assignValue(v luaValue, t reflect.Type, key luaValue) reflect.Value {
+	if rv, err := vm.luaToReflect(v, t); err != nil {
+		panic(fmt.Sprintf("cannot assign to '%v' (%s)", key, err.Error()))
+	} else {
+		return rv
+	}
+}
+
+// reflectPairs 遍历slice/array/map的迭代函数
+func (vm *State) reflectPairs(ud *UserData) *closure {
+	rv := reflect.Indirect(reflect.ValueOf(ud.Value))
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		return newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+			i, _ := toInteger(args[1])
+			if i >= rv.Len() {
+				return []interface{}{nil}
+			}
+			return []interface{}{i + 1, vm.reflectToLua(rv.Index(i))}
+		})
+	case reflect.Map:
+		keys, i := rv.MapKeys(), 0
+		return newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+			for ; i < len(keys); i++ {
+				if v := rv.MapIndex(keys[i]); v.IsValid() { // 遍历过程中可能被删除
+					i++
+					return []interface{}{vm.reflectToLua(keys[i-1]), vm.reflectToLua(v)}
+				}
+			}
+			return []interface{}{nil}
+		})
+	}
+	panic(fmt.Sprintf("attempt to iterate a %s value", rv.Type()))
+}
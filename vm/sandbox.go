@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"luago/vm/api"
+	"strings"
+)
+
+// SandboxPolicy 沙箱的安全策略, 列出脚本可以访问的全局变量和库函数, 可以直接用于审计
+// Allow中的名称为全局变量名(如 "print")或者"库名.函数名"(如 "string.format"), 单独的库名表示该库的全部函数
+// 库函数组成新的只读库table, 不在列表中的全局变量和库函数对脚本不可见
+type SandboxPolicy struct {
+	Allow        []string // 允许访问的全局变量和库函数
+	BinaryChunks bool     // 是否允许load加载二进制chunk, 二进制chunk不经过编译器检查, 可能破坏虚拟机
+}
+
+// DefaultSandboxPolicy 默认的沙箱策略
+// 不包含io, os(时间函数除外), debug, package库和loadfile/dofile等访问宿主的函数,
+// 也不包含影响其他脚本随机数序列的math.randomseed, load只能加载源码
+var DefaultSandboxPolicy = SandboxPolicy{
+	Allow: []string{
+		"_G", "_VERSION", "assert", "collectgarbage", "error", "getmetatable", "ipairs", "load", "next", "pairs",
+		"pcall", "print", "rawequal", "rawget", "rawlen", "rawset", "select", "setmetatable", "tonumber", "tostring",
+		"type", "xpcall",
+		"string.byte", "string.char", "string.find", "string.format", "string.gmatch", "string.gsub", "string.len",
+		"string.lower", "string.match", "string.pack", "string.packsize", "string.rep", "string.reverse", "string.sub",
+		"string.unpack", "string.upper",
+		"table.concat", "table.insert", "table.move", "table.pack", "table.remove", "table.sort", "table.unpack",
+		"math.abs", "math.acos", "math.asin", "math.atan", "math.ceil", "math.cos", "math.deg", "math.exp",
+		"math.floor", "math.fmod", "math.huge", "math.log", "math.max", "math.maxinteger", "math.min",
+		"math.mininteger", "math.modf", "math.pi", "math.rad", "math.random", "math.sin", "math.sqrt", "math.tan",
+		"math.tointeger", "math.type", "math.ult",
+		"utf8.char", "utf8.charpattern", "utf8.codepoint", "utf8.codes", "utf8.len", "utf8.offset",
+		"os.clock", "os.date", "os.difftime", "os.time",
+	},
+}
+
+// Allowed 判断全局变量或者库函数name是否被策略允许
+func (p SandboxPolicy) Allowed(name string) bool {
+	lib, _, _ := strings.Cut(name, ".")
+	for _, allowed := range p.Allow {
+		if allowed == name || allowed == lib {
+			return true
+		}
+	}
+	return false
+}
+
+// openSandbox 按照沙箱策略构造只读的库table和全局环境模板, 并将全局变量表替换为沙箱环境
+// 字符串元表的__index同样替换为沙箱的string库, 元表本身受到保护
+func (vm *State) openSandbox(policy SandboxPolicy) {
+	tmpl := newLuaTable(0, len(policy.Allow))
+	libs := map[string]*luaTable{}
+	sandboxLib := func(name string) *luaTable {
+		lib, ok := libs[name]
+		if !ok {
+			lib = newLuaTable(0, 0)
+			libs[name] = lib
+			tmpl.Put(name, lib)
+		}
+		return lib
+	}
+	for _, name := range policy.Allow {
+		libName, field, isField := strings.Cut(name, ".")
+		v := vm.global.Get(libName)
+		if src, ok := v.(LuaTable); ok && libName != "_G" {
+			if isField {
+				if fv := src.Get(field); fv != nil {
+					sandboxLib(libName).Put(field, fv)
+				}
+			} else {
+				for k := src.Next(nil); k != nil; k = src.Next(k) {
+					sandboxLib(libName).Put(k, src.Get(k))
+				}
+			}
+		} else if v != nil && !isField {
+			tmpl.Put(name, v)
+		}
+	}
+
+	protected := newLuaTable(0, 1) // 只读table共享的元表, 禁止getmetatable/setmetatable
+	protected.Put("__metatable", false)
+	protected.readonly = true
+	loaded := vm.loadedTable()
+	for _, l := range stdLibs {
+		if l.lib != LibBase && loaded.Get(l.name) != nil {
+			loaded.Put(l.name, nil)
+		}
+	}
+	for name, lib := range libs {
+		lib.meta = protected
+		lib.readonly = true
+		loaded.Put(name, lib)
+	}
+	if vm.metas[LUA_TSTRING] != nil {
+		mt := newLuaTable(0, 2)
+		if lib, ok := libs["string"]; ok {
+			mt.Put("__index", lib)
+		}
+		mt.Put("__metatable", false)
+		mt.readonly = true
+		vm.metas[LUA_TSTRING] = mt
+	}
+
+	vm.sandbox = tmpl
+	vm.allowBinary = policy.BinaryChunks
+	vm.global = vm.NewSandboxEnv()
+	vm.registry.Put(api.LUA_RIDX_GLOBALS, vm.global)
+	loaded.Put("_G", vm.global)
+}
+
+// NewSandboxEnv 按照 WithSandbox 的策略创建新的全局环境, 作为Load的env可以使多个脚本的全局变量互相隔离
+// 各个环境共享只读的库table, 环境中的_G为环境本身, load加载的chunk默认以该环境为_ENV
+// State没有使用 WithSandbox 创建时panic
+func (vm *State) NewSandboxEnv() LuaTable {
+	if vm.sandbox == nil {
+		panic("state is not sandboxed")
+	}
+	env := newLuaTable(0, 0)
+	for k := vm.sandbox.Next(nil); k != nil; k = vm.sandbox.Next(k) {
+		env.Put(k, vm.sandbox.Get(k))
+	}
+	if env.Get("_G") != nil {
+		env.Put("_G", env)
+	}
+	if env.Get("load") != nil {
+		env.Put("load", newGoClosure(func(state api.State, args ...interface{}) []interface{} {
+			if len(args) > 0 && len(args) < 4 {
+				args = append(append(make([]interface{}, 0, 4), args...), make([]interface{}, 4-len(args))...)
+				args[3] = env
+			}
+			return baseLoad(state, args...)
+		}))
+	}
+	return env
+}
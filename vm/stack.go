@@ -1,15 +1,23 @@
 package vm
 
+import "luago/vm/api"
+
 // lua 虚拟机栈帧
 type stackFrame struct {
-	vm      *State      // 引用state便于获取全局变量等信息
-	slots   []luaValue  // 数据栈 底层存储(编译期可以直接确定局部变量需要使用的寄存器数量，子函数返回值临时占用需额外检查)
-	top     int         // 下一个可以使用的数据栈位置(栈顶)
-	prev    *stackFrame // 上一个函数栈帧
-	c       *closure    // 闭包
-	varargs []luaValue
-	pc      int                 // 程序计数器
-	openuvs map[int]updateValue // open状态的upvalue, key为寄存器索引
+	vm         *State      // 引用state便于获取全局变量等信息
+	slots      []luaValue  // 数据栈 底层存储(编译期可以直接确定局部变量需要使用的寄存器数量，子函数返回值临时占用需额外检查)
+	top        int         // 下一个可以使用的数据栈位置(栈顶)
+	prev       *stackFrame // 上一个函数栈帧
+	c          *closure    // 闭包
+	varargs    []luaValue
+	pc         int                  // 程序计数器
+	openuvs    map[int]*updateValue // open状态的upvalue, key为寄存器索引
+	oldpc      int                  // 上一条触发钩子检查的指令, 用于判断是否进入新的一行
+	hooked     bool                 // 正在该栈帧上运行钩子函数
+	memSize    int                  // 栈帧计入内存统计的大小, 出栈时释放
+	memPending int                  // go函数正在生成的结果占用的内存, 重新统计时计入
+	nCalls     int                  // 嵌套调用层数
+	nCcalls    int                  // 非CALL指令发起的嵌套调用层数
 
 	results []luaValue //函数执行完的返回值
 }
@@ -24,19 +32,195 @@ func newStackFrame(vm *State, slots []luaValue, prev *stackFrame, c *closure, va
 		c:       c,
 		varargs: vargs,
 		pc:      0,
-		openuvs: make(map[int]updateValue),
+		openuvs: make(map[int]*updateValue),
 		results: nil,
 	}
 }
 
+// newGoStackFrame go函数使用的栈帧, 参数args位于栈底
+func newGoStackFrame(vm *State, args []luaValue, prev *stackFrame, c *closure) *stackFrame {
+	slots := make([]luaValue, len(args), len(args)+api.LUA_MINSTACK)
+	copy(slots, args)
+	return &stackFrame{
+		vm:    vm,
+		slots: slots,
+		top:   len(args),
+		prev:  prev,
+		c:     c,
+	}
+}
+
 // check and prepare 'want'th slots,
 func (stack *stackFrame) check(want int) {
 	length := len(stack.slots)
 	if want >= length {
 		stack.slots = append(stack.slots, make([]luaValue, 1+want-length)...)
+		for idx, uv := range stack.openuvs { // 扩容后open upvalue指向新的寄存器
+			uv.val = &stack.slots[idx]
+		}
+	}
+}
+
+// closeUpvalues 关闭寄存器索引大于等于level的open upvalue, 将值从寄存器复制到upvalue自身
+func (stack *stackFrame) closeUpvalues(level int) {
+	for idx, uv := range stack.openuvs {
+		if idx >= level {
+			val := *uv.val
+			uv.val = &val
+			delete(stack.openuvs, idx)
+		}
+	}
+}
+
+// currentLine lua函数当前执行到的源码行号, 没有行号信息或非lua函数返回-1
+func (stack *stackFrame) currentLine() int {
+	if stack.c == nil || stack.c.proto == nil {
+		return -1
+	}
+	lineInfo := stack.c.proto.LineInfo
+	pc := stack.pc - 1 // pc指向下一条指令
+	if pc < 0 {
+		pc = 0
+	}
+	if pc < len(lineInfo) {
+		return int(lineInfo[pc])
+	}
+	return -1
+}
+
+// isCalling lua函数正在执行CALL/TAILCALL/TFORCALL指令(不包括运行钩子函数)
+func (stack *stackFrame) isCalling() bool {
+	if stack.c == nil || stack.c.proto == nil || stack.hooked || stack.pc < 1 {
+		return false
+	}
+	switch Instruction(stack.c.proto.Code[stack.pc-1]).Opcode() {
+	case OP_CALL, OP_TAILCALL, OP_TFORCALL:
+		return true
+	}
+	return false
+}
+
+// push 压入栈顶
+func (stack *stackFrame) push(val luaValue) {
+	stack.check(stack.top)
+	stack.slots[stack.top] = val
+	stack.top++
+}
+
+// pushN 压入vals中的n个值, 不足补nil, n<0时压入全部
+func (stack *stackFrame) pushN(vals []luaValue, n int) {
+	if n < 0 {
+		n = len(vals)
+	}
+	for i := 0; i < n; i++ {
+		if i < len(vals) {
+			stack.push(vals[i])
+		} else {
+			stack.push(nil)
+		}
+	}
+}
+
+// pop 弹出栈顶
+func (stack *stackFrame) pop() luaValue {
+	if stack.top < 1 {
+		panic("stack underflow!")
+	}
+	stack.top--
+	val := stack.slots[stack.top]
+	stack.slots[stack.top] = nil
+	return val
+}
+
+// popN 弹出栈顶n个值(按压栈顺序返回)
+func (stack *stackFrame) popN(n int) []luaValue {
+	if n > stack.top {
+		panic("stack underflow!")
+	}
+	vals := make([]luaValue, n)
+	copy(vals, stack.slots[stack.top-n:stack.top])
+	for i := stack.top - n; i < stack.top; i++ {
+		stack.slots[i] = nil
+	}
+	stack.top -= n
+	return vals
+}
+
+// absIndex 相对索引转换为绝对索引, 伪索引保持不变
+func (stack *stackFrame) absIndex(idx int) int {
+	if idx >= 0 || idx <= api.LUA_REGISTRYINDEX {
+		return idx
+	}
+	return idx + stack.top + 1
+}
+
+// isValid 索引是否有效
+func (stack *stackFrame) isValid(idx int) bool {
+	if idx == api.LUA_REGISTRYINDEX {
+		return true
+	}
+	if idx < api.LUA_REGISTRYINDEX { // upvalues
+		uvIdx := api.LUA_REGISTRYINDEX - idx - 1
+		return stack.c != nil && uvIdx < len(stack.c.upvals)
+	}
+	absIdx := stack.absIndex(idx)
+	return absIdx > 0 && absIdx <= stack.top
+}
+
+// get 获取索引处的值, 无效索引返回nil
+func (stack *stackFrame) get(idx int) luaValue {
+	if idx == api.LUA_REGISTRYINDEX {
+		return stack.vm.registry
+	}
+	if idx < api.LUA_REGISTRYINDEX { // upvalues
+		uvIdx := api.LUA_REGISTRYINDEX - idx - 1
+		if stack.c != nil && uvIdx < len(stack.c.upvals) {
+			return *stack.c.upvals[uvIdx].val
+		}
+		return nil
+	}
+	absIdx := stack.absIndex(idx)
+	if absIdx > 0 && absIdx <= stack.top {
+		return stack.slots[absIdx-1]
+	}
+	return nil
+}
+
+// set 设置索引处的值
+func (stack *stackFrame) set(idx int, val luaValue) {
+	if idx == api.LUA_REGISTRYINDEX {
+		if t, ok := val.(LuaTable); ok {
+			stack.vm.registry = t
+			return
+		}
+		panic("registry must be a table")
+	}
+	if idx < api.LUA_REGISTRYINDEX { // upvalues
+		uvIdx := api.LUA_REGISTRYINDEX - idx - 1
+		if stack.c != nil && uvIdx < len(stack.c.upvals) {
+			*stack.c.upvals[uvIdx].val = val
+		}
+		return
+	}
+	absIdx := stack.absIndex(idx)
+	if absIdx > 0 && absIdx <= stack.top {
+		stack.slots[absIdx-1] = val
+		return
+	}
+	panic("invalid index!")
+}
+
+// reverse 反转[from, to]区间内的值(slots下标)
+func (stack *stackFrame) reverse(from, to int) {
+	slots := stack.slots
+	for from < to {
+		slots[from], slots[to] = slots[to], slots[from]
+		from++
+		to--
 	}
 }
 
+// updateValue open状态时val指向栈帧的寄存器, 关闭后指向upvalue自身保存的值
 type updateValue struct {
 	val *luaValue
 }
@@ -3,6 +3,11 @@ package vm
 import (
 	"fmt"
 	"luago/vm/api"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
 )
 
 var baseFuncs = map[string]api.GoFunc{
@@ -27,102 +32,494 @@ var baseFuncs = map[string]api.GoFunc{
 	"type":         baseType,
 	"tostring":     baseTostring,
 	"tonumber":     baseTonumber,
+
+	"collectgarbage": baseCollectgarbage,
 }
-var tabFuncs = map[string]api.GoFunc{
-	// "move":   nil,
-	"insert": tabInsert,
-	// "remove": nil,
-	// "sort":   nil,
-	// "concat": nil,
-	// "pack":   nil,
-	// "unpack": nil,
+
+// Lib 标准库的集合, 用于 WithLibs 和 OpenLibs 选择打开的库
+type Lib uint
+
+const (
+	LibBase    Lib = 1 << iota // 基础函数, _G和_VERSION
+	LibPackage                 // package库和require函数
+	LibString
+	LibTable
+	LibMath
+	LibIO
+	LibOS
+	LibUTF8
+	LibDebug
+
+	AllLibs = LibBase | LibPackage | LibString | LibTable | LibMath | LibIO | LibOS | LibUTF8 | LibDebug
+)
+
+// stdLibs 按打开顺序排列的标准库, name为库在全局变量表和package.loaded中的名称
+var stdLibs = []struct {
+	lib  Lib
+	name string
+	open func(*State)
+}{
+	{LibBase, "_G", openBaseLib},
+	{LibPackage, "package", openPackageLib},
+	{LibTable, "table", openTableLib},
+	{LibString, "string", openStringLib},
+	{LibMath, "math", openMathLib},
+	{LibOS, "os", openOsLib},
+	{LibIO, "io", openIoLib},
+	{LibUTF8, "utf8", openUtf8Lib},
+	{LibDebug, "debug", openDebugLib},
 }
 
-// OpenLibs 注册基础库函数到lua虚拟机
-func OpenLibs(vm api.State) {
+// OpenLibs 打开libs中的标准库并记录到package.loaded, 省略libs时打开全部标准库
+func OpenLibs(vm *State, libs ...Lib) {
+	mask := AllLibs
+	if len(libs) > 0 {
+		mask = 0
+		for _, lib := range libs {
+			mask |= lib
+		}
+	}
+	loaded := vm.loadedTable()
+	for _, l := range stdLibs {
+		if mask&l.lib != 0 {
+			l.open(vm)
+			loaded.Put(l.name, vm.global.Get(l.name))
+		}
+	}
+}
+
+// openBaseLib 注册基础库函数
+func openBaseLib(vm *State) {
 	for name, f := range baseFuncs {
 		vm.Register(name, f)
 	}
-	for name, f := range tabFuncs {
-		vm.Register(name, f)
+	vm.global.Put("_G", vm.global)
+	vm.global.Put("_VERSION", "Lua 5.3")
+}
+
+const loadedKey = "_LOADED" // 注册表中已加载模块表的键(同LUA_LOADED_TABLE)
+
+// loadedTable 注册表中的已加载模块表, 不存在时创建
+func (vm *State) loadedTable() LuaTable {
+	if t, ok := vm.registry.Get(loadedKey).(LuaTable); ok {
+		return t
+	}
+	t := newLuaTable(0, 0)
+	vm.registry.Put(loadedKey, t)
+	return t
+}
+
+// newLib 创建函数库table
+func newLib(funcs map[string]api.GoFunc) LuaTable {
+	lib := newLuaTable(0, len(funcs))
+	for name, f := range funcs {
+		lib.Put(name, newGoClosure(f))
 	}
+	return lib
 }
 
-func basePrint(_ api.State, args ...interface{}) []interface{} {
-	fmt.Println(args...)
+// print (···)
+func basePrint(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = vm.tostring(arg)
+	}
+	fmt.Fprintln(vm.stdout, strings.Join(strs, "\t"))
 	return nil
 }
-func baseAssert(_ api.State, args ...interface{}) []interface{} {
-	msg := "input:1: assertion failed!"
-	if len(args) > 1 {
-		msg = fmt.Sprintf("%v", args[1])
+
+// assert (v [, message])
+func baseAssert(state api.State, args ...interface{}) []interface{} {
+	if toBool(checkAny(args, 1, "assert")) {
+		return args
 	}
-	if v := args[0]; v != nil {
-		return []interface{}{v}
+	if len(args) < 2 {
+		return baseError(state, "assertion failed!")
+	}
+	return baseError(state, args[1])
+}
+
+// error (message [, level])
+func baseError(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	msg := argAt(args, 1)
+	level := optInteger(args, 2, "error", 1)
+	if s, ok := msg.(string); ok && level > 0 {
+		msg = vm.where(level) + s
+	}
+	panic(&LuaError{Value: msg, Status: api.LUA_ERRRUN})
+}
+
+// select (index, ···)
+func baseSelect(_ api.State, args ...interface{}) []interface{} {
+	n := len(args) - 1
+	if s, ok := argAt(args, 1).(string); ok && s == "#" {
+		return []interface{}{n}
+	}
+	i := checkInteger(args, 1, "select")
+	if i < 0 {
+		i = n + i
+	} else if i > n {
+		i = n
 	} else {
-		panic(msg)
+		i--
+	}
+	if i < 0 {
+		argError(1, "select", "index out of range")
 	}
+	return args[1+i:]
 }
-func baseError(_ api.State, args ...interface{}) []interface{}  { return nil } //TODO:std basefunc
-func baseSelect(_ api.State, args ...interface{}) []interface{} { return nil } //TODO:std basefunc
+
+// ipairs (t) 迭代t[1], t[2]...直到第一个nil值, 会调用元方法 __index
 func baseIpairs(_ api.State, args ...interface{}) []interface{} {
-	return []interface{}{newGoClosure(_iNext), args[0], 0}
+	return []interface{}{newGoClosure(_iNext), checkAny(args, 1, "ipairs"), 0}
 }
-func basePairs(_ api.State, args ...interface{}) []interface{} {
-	return []interface{}{newGoClosure(baseNext), args[0], nil}
+
+func _iNext(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	i := checkInteger(args, 2, "ipairs") + 1
+	if v := vm.index(argAt(args, 1), i); v != nil {
+		return []interface{}{i, v}
+	}
+	return []interface{}{nil}
+}
+
+// pairs (t) 存在元方法 __pairs 时返回其调用结果的前三个值
+func basePairs(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	t := checkAny(args, 1, "pairs")
+	if mm := vm.metaField(t, "__pairs"); mm != nil {
+		results := vm.callValue(mm, []luaValue{t})
+		for len(results) < 3 {
+			results = append(results, nil)
+		}
+		return results[:3]
+	}
+	checkTable(args, 1, "pairs")
+	return []interface{}{newGoClosure(baseNext), t, nil}
 }
+
+// next (table [, index])
 func baseNext(_ api.State, args ...interface{}) []interface{} {
-	_t, key := args[0], args[1] //argument #1 #2
-	if t, ok := _t.(LuaTable); ok {
-		if nextKey := t.Next(key); nextKey == nil {
-			return []interface{}{nil}
-		} else {
-			return []interface{}{nextKey, t.Get(nextKey)}
+	t := checkTable(args, 1, "next")
+	key := argAt(args, 2)
+	if lt, ok := t.(*luaTable); ok && !lt.isNextKey(key) {
+		panic("invalid key to 'next'")
+	}
+	if nextKey := t.Next(key); nextKey == nil {
+		return []interface{}{nil}
+	} else {
+		return []interface{}{nextKey, t.Get(nextKey)}
+	}
+}
+
+// load (chunk [, chunkname [, mode [, env]]])
+// chunk为字符串或者返回字符串片段的函数(返回nil或者空串表示结束), 加载失败时返回nil和错误信息
+func baseLoad(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	mode := optString(args, 3, "load", "bt")
+	var data []byte
+	var chunkname string
+	if s, ok := toString(argAt(args, 1)); ok {
+		chunkname = optString(args, 2, "load", s)
+		data = []byte(s)
+	} else {
+		chunkname = optString(args, 2, "load", "=(load)")
+		reader := checkFunction(args, 1, "load")
+		var errValue luaValue
+		if data, errValue = vm.readChunk(reader); errValue != nil {
+			return []interface{}{nil, errValue}
 		}
+	}
+	c, err := vm.loadChunk(data, chunkname, mode)
+	return loadResult(c, err, args, 4)
+}
+
+// readChunk 反复调用reader读取chunk的全部内容, reader出错或者返回非字符串时返回错误值
+func (vm *State) readChunk(reader *closure) ([]byte, luaValue) {
+	var data []byte
+	for {
+		results, err := vm.pcall(reader, nil, nil)
+		if err != nil {
+			return nil, err.Value
+		}
+		piece := _first(results)
+		if piece == nil {
+			return data, nil
+		}
+		s, ok := toString(piece)
+		if !ok {
+			return nil, vm.toLuaError("reader function must return a string").Value
+		}
+		if s == "" {
+			return data, nil
+		}
+		data = append(data, s...)
+	}
+}
+
+// loadResult load和loadfile的返回值, 第envIdx个参数存在(可以为nil)时将其设置为主函数的_ENV
+func loadResult(c *closure, err error, args []luaValue, envIdx int) []interface{} {
+	if err != nil {
+		return []interface{}{nil, err.Error()}
+	}
+	if envIdx <= len(args) && len(c.upvals) > 0 {
+		*c.upvals[0].val = args[envIdx-1]
+	}
+	return []interface{}{c}
+}
+
+// loadfile ([filename [, mode [, env]]])
+// 没有filename时读取标准输入
+func baseLoadfile(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	filename := optString(args, 1, "loadfile", "")
+	mode := optString(args, 2, "loadfile", "bt")
+	c, err := vm.loadFile(filename, mode)
+	return loadResult(c, err, args, 3)
+}
+
+// dofile ([filename])
+// 没有filename时读取标准输入, 返回chunk的所有返回值, 加载错误直接抛出
+func baseDofile(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	filename := optString(args, 1, "dofile", "")
+	c, err := vm.loadFile(filename, "bt")
+	if err != nil {
+		panic(&LuaError{Value: err.Error(), Status: api.LUA_ERRRUN})
+	}
+	return vm.callValue(c, nil)
+}
+
+// pcall (f [, arg1, ···])
+func basePcall(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	f := checkAny(args, 1, "pcall")
+	if results, err := vm.pcall(f, args[1:], nil); err != nil {
+		return []interface{}{false, err.Value}
+	} else {
+		return append([]interface{}{true}, results...)
+	}
+}
+
+// xpcall (f, msgh [, arg1, ···])
+func baseXpcall(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	if len(args) < 2 {
+		argError(2, "xpcall", "value expected")
+	}
+	if results, err := vm.pcall(args[0], args[2:], args[1]); err != nil {
+		return []interface{}{false, err.Value}
 	} else {
-		panic(fmt.Errorf("input:2: bad argument #1 to 'next' (table expected, got %T)", _t))
-	}
-}                                                                     //TODO:std basefunc
-func baseLoad(_ api.State, args ...interface{}) []interface{}         { return nil } //TODO:std basefunc
-func baseLoadfile(_ api.State, args ...interface{}) []interface{}     { return nil } //TODO:std basefunc
-func baseDofile(_ api.State, args ...interface{}) []interface{}       { return nil } //TODO:std basefunc
-func basePcall(_ api.State, args ...interface{}) []interface{}        { return nil } //TODO:std basefunc
-func baseXpcall(_ api.State, args ...interface{}) []interface{}       { return nil } //TODO:std basefunc
-func baseGetmetatable(_ api.State, args ...interface{}) []interface{} { return nil } //TODO:std basefunc
+		return append([]interface{}{true}, results...)
+	}
+}
+
+// getmetatable (object)
+func baseGetmetatable(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	mt := vm.getMetatable(checkAny(args, 1, "getmetatable"))
+	if mt == nil {
+		return []interface{}{nil}
+	}
+	if protected := mt.Get("__metatable"); protected != nil {
+		return []interface{}{protected}
+	}
+	return []interface{}{mt}
+}
+
+// setmetatable (table, metatable)
 func baseSetmetatable(_ api.State, args ...interface{}) []interface{} {
-	arg1, arg2 := args[0], args[1]
-	if meta, ok := arg2.(LuaTable); ok {
-		if t, ok := arg1.(LuaTable); ok {
-			t.SetMeta(meta)
-		} else {
-			panic("TODO: 非LuaTable添加元方法")
+	t := checkTable(args, 1, "setmetatable")
+	meta, ok := argAt(args, 2).(LuaTable)
+	if !ok && (argAt(args, 2) != nil || len(args) < 2) {
+		typeError(args, 2, "setmetatable", "nil or table")
+	}
+	if mt := t.Meta(); mt != nil && mt.Get("__metatable") != nil {
+		panic("cannot change a protected metatable")
+	}
+	t.SetMeta(meta)
+	return []interface{}{t}
+}
+
+// rawequal (v1, v2)
+func baseRawequal(_ api.State, args ...interface{}) []interface{} {
+	checkAny(args, 1, "rawequal")
+	checkAny(args, 2, "rawequal")
+	return []interface{}{rawEqual(args[0], args[1])}
+}
+
+// rawlen (v)
+func baseRawlen(_ api.State, args ...interface{}) []interface{} {
+	switch x := argAt(args, 1).(type) {
+	case LuaTable:
+		return []interface{}{x.Len()}
+	case string:
+		return []interface{}{len(x)}
+	}
+	argError(1, "rawlen", "table or string expected")
+	return nil
+}
+
+// rawget (table, index)
+func baseRawget(_ api.State, args ...interface{}) []interface{} {
+	t := checkTable(args, 1, "rawget")
+	return []interface{}{t.Get(checkAny(args, 2, "rawget"))}
+}
+
+// rawset (table, index, value)
+func baseRawset(state api.State, args ...interface{}) []interface{} {
+	t := checkTable(args, 1, "rawset")
+	k := checkAny(args, 2, "rawset")
+	v := checkAny(args, 3, "rawset")
+	if v != nil && t.Get(k) == nil {
+		state.(*State).allocMem(tableEntrySize)
+	}
+	t.Put(k, v)
+	return []interface{}{t}
+}
+
+// type (v)
+func baseType(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{typeName(typeOf(checkAny(args, 1, "type")))}
+}
+
+// tostring (v)
+func baseTostring(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	return []interface{}{vm.tostring(checkAny(args, 1, "tostring"))}
+}
+
+// tonumber (e [, base])
+func baseTonumber(_ api.State, args ...interface{}) []interface{} {
+	if argAt(args, 2) == nil { // standard conversion
+		switch x := checkAny(args, 1, "tonumber").(type) {
+		case int, float64:
+			return []interface{}{x}
+		case string:
+			if n, ok := stringToNumber(x); ok {
+				return []interface{}{n}
+			}
 		}
-	} else {
-		panic(fmt.Sprintf("input:2: bad argument #2 to 'setmetatable' (nil or table expected, got %T)", arg2))
-	}
-	return []interface{}{}
-}
-func baseRawequal(_ api.State, args ...interface{}) []interface{} { return nil } //TODO:std basefunc
-func baseRawlen(_ api.State, args ...interface{}) []interface{}   { return nil } //TODO:std basefunc
-func baseRawget(_ api.State, args ...interface{}) []interface{}   { return nil } //TODO:std basefunc
-func baseRawset(_ api.State, args ...interface{}) []interface{}   { return nil } //TODO:std basefunc
-func baseType(_ api.State, args ...interface{}) []interface{}     { return nil } //TODO:std basefunc
-func baseTostring(_ api.State, args ...interface{}) []interface{} { return nil } //TODO:std basefunc
-func baseTonumber(_ api.State, args ...interface{}) []interface{} { return nil } //TODO:std basefunc
-
-func _iNext(_ api.State, args ...interface{}) []interface{} {
-	_t, key := args[0], args[1] //argument #1 #2
-	if t, ok := _t.(LuaTable); ok {
-		if nextKey := t.INext(key); nextKey == nil {
-			return []interface{}{nil}
-		} else {
-			return []interface{}{nextKey, t.Get(nextKey)}
+		return []interface{}{nil}
+	}
+	base := checkInteger(args, 2, "tonumber")
+	s, ok := argAt(args, 1).(string)
+	if !ok {
+		typeError(args, 1, "tonumber", "string")
+	}
+	if base < 2 || base > 36 {
+		argError(2, "tonumber", "base out of range")
+	}
+	if n, ok := stringToIntBase(s, base); ok {
+		return []interface{}{n}
+	}
+	return []interface{}{nil}
+}
+
+// stringToIntBase 将base进制的字符串转换为整数, 允许前后空白和负号, 溢出时回绕
+func stringToIntBase(s string, base int) (int, bool) {
+	s = strings.Trim(s, " \f\n\r\t\v")
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg, s = true, s[1:]
+	}
+	if s == "" {
+		return 0, false
+	}
+	n := 0
+	for _, c := range strings.ToLower(s) {
+		var digit int
+		switch {
+		case c >= '0' && c <= '9':
+			digit = int(c - '0')
+		case c >= 'a' && c <= 'z':
+			digit = int(c-'a') + 10
+		default:
+			return 0, false
 		}
-	} else {
-		panic(fmt.Errorf("input:2: bad argument #1 to 'next' (table expected, got %v)", _t))
+		if digit >= base {
+			return 0, false
+		}
+		n = n*base + digit
+	}
+	if neg {
+		n = -n
+	}
+	return n, true
+}
+
+// collectgarbage ([opt [, arg]])
+// count返回State统计的近似内存占用(KB), collect和step重新统计可达对象
+func baseCollectgarbage(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	switch opt := optString(args, 1, "collectgarbage", "collect"); opt {
+	case "collect":
+		runtime.GC()
+		vm.collectMem()
+		return []interface{}{0}
+	case "count":
+		return []interface{}{float64(vm.memUsed) / 1024}
+	case "step":
+		vm.collectMem()
+		return []interface{}{true}
+	case "isrunning":
+		return []interface{}{true}
+	case "stop", "restart":
+		return []interface{}{0}
+	case "setpause", "setstepmul":
+		return []interface{}{100}
+	default:
+		argError(1, "collectgarbage", fmt.Sprintf("invalid option '%s'", opt))
+		return nil
+	}
+}
+
+// ToStringMeta 同luaL_tolstring, 按照lua的tostring函数将任意值转换为字符串, 元方法 __tostring 出错时返回错误
+func (vm *State) ToStringMeta(v interface{}) (string, error) {
+	results, err := vm.pcall(newGoClosure(baseTostring), []luaValue{v}, nil)
+	if err != nil {
+		return "", err
 	}
+	return results[0].(string), nil
 }
 
-func tabInsert(_ api.State, args ...interface{}) []interface{} {
-	panic("TODO:")
+// tostring 同lua的tostring函数, 优先调用元方法 __tostring, 其次使用元表中的 __name
+func (vm *State) tostring(v luaValue) string {
+	if mm := vm.metaField(v, "__tostring"); mm != nil {
+		switch r := _first(vm.callValue(mm, []luaValue{v})).(type) {
+		case string:
+			return r
+		case int, float64: // 同lua_tolstring, 数字转换为字符串
+			s, _ := toString(r)
+			return s
+		}
+		panic("'__tostring' must return a string")
+	}
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(x)
+	case string:
+		return x
+	case int, int64, float64:
+		s, _ := toString(x)
+		return s
+	}
+	kind := typeName(typeOf(v))
+	if name, ok := vm.metaField(v, "__name").(string); ok {
+		kind = name
+	}
+	switch x := v.(type) {
+	case LightUserData:
+		return fmt.Sprintf("%s: %p", kind, unsafe.Pointer(x))
+	case LuaTable, *closure, *UserData, *State:
+		return fmt.Sprintf("%s: %p", kind, x)
+	}
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Map || rv.Kind() == reflect.Func {
+		return fmt.Sprintf("%s: %p", kind, v)
+	}
+	return fmt.Sprintf("%s: %v", kind, v)
 }
@@ -0,0 +1,317 @@
+package vm
+
+import (
+	"luago/vm/api"
+	"strings"
+	"unsafe"
+)
+
+var debugFuncs = map[string]api.GoFunc{
+	"gethook":      debugGethook,
+	"getinfo":      debugGetinfo,
+	"getlocal":     debugGetlocal,
+	"getmetatable": debugGetmetatable,
+	"getregistry":  debugGetregistry,
+	"getupvalue":   debugGetupvalue,
+	"getuservalue": debugGetuservalue,
+	"sethook":      debugSethook,
+	"setlocal":     debugSetlocal,
+	"setmetatable": debugSetmetatable,
+	"setupvalue":   debugSetupvalue,
+	"setuservalue": debugSetuservalue,
+	"traceback":    debugTraceback,
+	"upvalueid":    debugUpvalueid,
+	"upvaluejoin":  debugUpvaluejoin,
+}
+
+// openDebugLib 注册debug库
+func openDebugLib(vm *State) {
+	vm.global.Put("debug", newLib(debugFuncs))
+}
+
+// debugThread 同ldblib的getthread, 可选的第一个参数为线程, 返回该线程和其余参数的偏移
+func debugThread(vm *State, args []luaValue) (*State, int) {
+	if L1, ok := argAt(args, 1).(*State); ok {
+		return L1, 1
+	}
+	return vm, 0
+}
+
+// debug.getinfo ([thread,] f [, what])
+// f为函数或者栈帧层级, 层级超出范围时返回nil
+func debugGetinfo(state api.State, args ...interface{}) []interface{} {
+	L1, arg := debugThread(state.(*State), args)
+	options := optString(args, arg+2, "getinfo", "flnStu")
+	var c *closure
+	var frame *stackFrame
+	if f, ok := argAt(args, arg+1).(*closure); ok {
+		c = f
+	} else {
+		if frame = L1.getFrame(checkInteger(args, arg+1, "getinfo")); frame == nil {
+			return []interface{}{nil}
+		}
+		c = frame.c
+	}
+	for _, opt := range options {
+		if !strings.ContainsRune("SlnutfL", opt) {
+			argError(arg+2, "getinfo", "invalid option")
+		}
+	}
+	ar := L1.funcInfo(c, frame)
+	t := newLuaTable(0, 0)
+	if strings.ContainsRune(options, 'S') {
+		t.Put("source", ar.Source)
+		t.Put("short_src", ar.ShortSrc)
+		t.Put("linedefined", ar.LineDefined)
+		t.Put("lastlinedefined", ar.LastLineDefined)
+		t.Put("what", ar.What)
+	}
+	if strings.ContainsRune(options, 'l') {
+		t.Put("currentline", ar.CurrentLine)
+	}
+	if strings.ContainsRune(options, 'u') {
+		t.Put("nups", ar.NUps)
+		t.Put("nparams", ar.NParams)
+		t.Put("isvararg", ar.IsVararg)
+	}
+	if strings.ContainsRune(options, 'n') {
+		if ar.Name != "" {
+			t.Put("name", ar.Name)
+		}
+		t.Put("namewhat", ar.NameWhat)
+	}
+	if strings.ContainsRune(options, 't') {
+		t.Put("istailcall", false)
+	}
+	if strings.ContainsRune(options, 'L') {
+		if lines := activeLines(c); lines != nil {
+			t.Put("activelines", lines)
+		}
+	}
+	if strings.ContainsRune(options, 'f') {
+		t.Put("func", c)
+	}
+	return []interface{}{t}
+}
+
+// debug.getlocal ([thread,] f, local)
+// f为函数时只能获取参数名称
+func debugGetlocal(state api.State, args ...interface{}) []interface{} {
+	L1, arg := debugThread(state.(*State), args)
+	n := checkInteger(args, arg+2, "getlocal")
+	if f, ok := argAt(args, arg+1).(*closure); ok {
+		if f.proto != nil {
+			if name := localName(f.proto, n, 0); name != "" {
+				return []interface{}{name}
+			}
+		}
+		return []interface{}{nil}
+	}
+	frame := L1.getFrame(checkInteger(args, arg+1, "getlocal"))
+	if frame == nil {
+		argError(arg+1, "getlocal", "level out of range")
+	}
+	if name, v := frame.findLocal(n); v != nil {
+		return []interface{}{name, *v}
+	}
+	return []interface{}{nil}
+}
+
+// debug.setlocal ([thread,] level, local, value)
+func debugSetlocal(state api.State, args ...interface{}) []interface{} {
+	L1, arg := debugThread(state.(*State), args)
+	level := checkInteger(args, arg+1, "setlocal")
+	n := checkInteger(args, arg+2, "setlocal")
+	frame := L1.getFrame(level)
+	if frame == nil {
+		argError(arg+1, "setlocal", "level out of range")
+	}
+	val := checkAny(args, arg+3, "setlocal")
+	if name, v := frame.findLocal(n); v != nil {
+		*v = val
+		return []interface{}{name}
+	}
+	return []interface{}{nil}
+}
+
+// debug.getupvalue (f, up)
+func debugGetupvalue(_ api.State, args ...interface{}) []interface{} {
+	n := checkInteger(args, 2, "getupvalue")
+	c := checkFunction(args, 1, "getupvalue")
+	if name, uv, ok := getUpvalue(c, n); ok {
+		return []interface{}{name, *uv.val}
+	}
+	return nil
+}
+
+// debug.setupvalue (f, up, value)
+func debugSetupvalue(_ api.State, args ...interface{}) []interface{} {
+	val := checkAny(args, 3, "setupvalue")
+	n := checkInteger(args, 2, "setupvalue")
+	c := checkFunction(args, 1, "setupvalue")
+	if name, uv, ok := getUpvalue(c, n); ok {
+		*uv.val = val
+		return []interface{}{name}
+	}
+	return nil
+}
+
+// checkUpvalue 第argf个参数必须为函数, 第argn个参数必须为该函数有效的upvalue序号
+func checkUpvalue(args []luaValue, argf, argn int, fname string) (*closure, int) {
+	n := checkInteger(args, argn, fname)
+	c := checkFunction(args, argf, fname)
+	if _, _, ok := getUpvalue(c, n); !ok {
+		argError(argn, fname, "invalid upvalue index")
+	}
+	return c, n
+}
+
+// debug.upvalueid (f, n)
+// 共享同一个upvalue的闭包返回相同的标识
+func debugUpvalueid(_ api.State, args ...interface{}) []interface{} {
+	c, n := checkUpvalue(args, 1, 2, "upvalueid")
+	return []interface{}{LightUserData(unsafe.Pointer(c.upvals[n-1]))}
+}
+
+// debug.upvaluejoin (f1, n1, f2, n2)
+// 使f1的第n1个upvalue引用f2的第n2个upvalue
+func debugUpvaluejoin(_ api.State, args ...interface{}) []interface{} {
+	f1, n1 := checkUpvalue(args, 1, 2, "upvaluejoin")
+	f2, n2 := checkUpvalue(args, 3, 4, "upvaluejoin")
+	if f1.proto == nil {
+		argError(1, "upvaluejoin", "Lua function expected")
+	}
+	if f2.proto == nil {
+		argError(3, "upvaluejoin", "Lua function expected")
+	}
+	f1.upvals[n1-1] = f2.upvals[n2-1]
+	return nil
+}
+
+// debug.getmetatable (value)
+// 不检查 __metatable 字段
+func debugGetmetatable(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	if mt := vm.getMetatable(checkAny(args, 1, "getmetatable")); mt != nil {
+		return []interface{}{mt}
+	}
+	return []interface{}{nil}
+}
+
+// debug.setmetatable (value, table)
+// 可以设置任意类型的元表, 非table和userdata的类型共享同一个元表
+func debugSetmetatable(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	mt, ok := argAt(args, 2).(LuaTable)
+	if !ok && argAt(args, 2) != nil {
+		argError(2, "setmetatable", "nil or table expected")
+	}
+	vm.setMetatable(argAt(args, 1), mt)
+	return []interface{}{argAt(args, 1)}
+}
+
+// debug.getregistry ()
+func debugGetregistry(state api.State, _ ...interface{}) []interface{} {
+	return []interface{}{state.(*State).registry}
+}
+
+// debug.getuservalue (u)
+func debugGetuservalue(_ api.State, args ...interface{}) []interface{} {
+	if ud, ok := argAt(args, 1).(*UserData); ok {
+		return []interface{}{ud.userValue}
+	}
+	return []interface{}{nil}
+}
+
+// debug.setuservalue (udata, value)
+func debugSetuservalue(_ api.State, args ...interface{}) []interface{} {
+	ud, ok := argAt(args, 1).(*UserData)
+	if !ok {
+		typeError(args, 1, "setuservalue", "userdata")
+	}
+	ud.userValue = checkAny(args, 2, "setuservalue")
+	return []interface{}{ud}
+}
+
+// debug.traceback ([thread,] [message [, level]])
+// message不是字符串或者nil时原样返回
+func debugTraceback(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	L1, arg := debugThread(vm, args)
+	msg, ok := toString(argAt(args, arg+1))
+	if !ok && argAt(args, arg+1) != nil {
+		return []interface{}{argAt(args, arg+1)}
+	}
+	level := 0
+	if L1 == vm {
+		level = 1
+	}
+	level = optInteger(args, arg+2, "traceback", level)
+	if ok {
+		msg += "\n"
+	}
+	return []interface{}{msg + L1.traceback(level)}
+}
+
+// debug.sethook ([thread,] hook, mask [, count])
+// mask包含'c', 'r', 'l'分别对应call, return, line事件, count大于0时每执行count条指令触发count事件
+// 不带参数调用时关闭钩子
+func debugSethook(state api.State, args ...interface{}) []interface{} {
+	L1, arg := debugThread(state.(*State), args)
+	if argAt(args, arg+1) == nil {
+		L1.setHook(nil, 0, 0)
+		L1.hookValue = nil
+		return nil
+	}
+	smask := checkString(args, arg+2, "sethook")
+	fn := checkFunction(args, arg+1, "sethook")
+	count := optInteger(args, arg+3, "sethook", 0)
+	mask := 0
+	if strings.ContainsRune(smask, 'c') {
+		mask |= maskCall
+	}
+	if strings.ContainsRune(smask, 'r') {
+		mask |= maskReturn
+	}
+	if strings.ContainsRune(smask, 'l') {
+		mask |= maskLine
+	}
+	if count > 0 {
+		mask |= maskCount
+	}
+	L1.setHook(func(vm *State, event, line int) {
+		var l luaValue
+		if line >= 0 {
+			l = line
+		}
+		vm.callValue(fn, []luaValue{hookNames[event], l})
+	}, mask, count)
+	L1.hookValue = nil
+	if L1.hook != nil {
+		L1.hookValue = fn
+	}
+	return nil
+}
+
+// debug.gethook ([thread])
+// 返回钩子函数, 事件掩码和count, 宿主设置的钩子返回 "external hook"
+func debugGethook(state api.State, args ...interface{}) []interface{} {
+	L1, _ := debugThread(state.(*State), args)
+	var hook luaValue
+	if L1.hook != nil {
+		if hook = L1.hookValue; hook == nil {
+			hook = "external hook"
+		}
+	}
+	var smask strings.Builder
+	if L1.hookMask&maskCall != 0 {
+		smask.WriteByte('c')
+	}
+	if L1.hookMask&maskReturn != 0 {
+		smask.WriteByte('r')
+	}
+	if L1.hookMask&maskLine != 0 {
+		smask.WriteByte('l')
+	}
+	return []interface{}{hook, smask.String(), L1.baseHookCount}
+}
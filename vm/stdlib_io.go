@@ -0,0 +1,650 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"luago/vm/api"
+	"os"
+	"strings"
+)
+
+var ioFuncs = map[string]api.GoFunc{
+	"close":   ioClose,
+	"flush":   ioFlush,
+	"input":   ioInput,
+	"lines":   ioLines,
+	"open":    ioOpen,
+	"output":  ioOutput,
+	"read":    ioRead,
+	"tmpfile": ioTmpfile,
+	"type":    ioType,
+	"write":   ioWrite,
+}
+
+var fileMethods = map[string]api.GoFunc{
+	"close":   fileClose,
+	"flush":   fileFlush,
+	"lines":   fileLines,
+	"read":    fileRead,
+	"seek":    fileSeek,
+	"setvbuf": fileSetvbuf,
+	"write":   fileWrite,
+}
+
+const (
+	ioInputKey     = "_IO_input"  // 注册表中默认输入文件的键
+	ioOutputKey    = "_IO_output" // 注册表中默认输出文件的键
+	fileHandleName = "FILE*"      // 文件句柄元表在注册表中的键, 同时作为 __name
+	ioBufferSize   = 8192         // 默认的写缓冲大小
+	maxArgLine     = 250          // lines的最大格式参数数量
+	maxLenNum      = 200          // read("n")读取数字的最大长度
+)
+
+// openIoLib 注册io库, 文件句柄为包装*luaFile的userdata, 通过vm的FileSystem打开
+func openIoLib(vm *State) {
+	mt := newLuaTable(0, 3)
+	mt.Put("__name", fileHandleName)
+	mt.Put("__index", newLib(fileMethods))
+	mt.Put("__tostring", newGoClosure(fileToString))
+	vm.registry.Put(fileHandleName, mt)
+
+	lib := newLib(ioFuncs)
+	stdin := vm.newFile(newStreamFile("stdin", vm.stdin, nil), nil)
+	stdout := vm.newFile(newStreamFile("stdout", nil, vm.stdout), nil)
+	stderr := vm.newFile(newStreamFile("stderr", nil, vm.stderr), nil)
+	for _, ud := range []*UserData{stdout, stderr} {
+		ud.Value.(*luaFile).setvbuf("no", 0) // 与print等直接写入标准输出的输出保持顺序
+	}
+	lib.Put("stdin", stdin)
+	lib.Put("stdout", stdout)
+	lib.Put("stderr", stderr)
+	vm.registry.Put(ioInputKey, stdin)
+	vm.registry.Put(ioOutputKey, stdout)
+	vm.global.Put("io", lib)
+}
+
+// luaFile io库的文件句柄, 对读写进行缓冲(同C语言的FILE)
+type luaFile struct {
+	f       File
+	closeFn func(*luaFile) error // 关闭文件, nil表示标准文件(不能关闭)
+	closed  bool
+	r       *bufio.Reader // 读缓冲, 写入或者seek之前需要丢弃
+	w       *bufio.Writer // 写缓冲, nil表示不缓冲
+	line    bool          // 行缓冲, 写入换行符时刷新
+}
+
+// newFile 构造文件句柄userdata, 默认完全缓冲
+func (vm *State) newFile(f File, closeFn func(*luaFile) error) *UserData {
+	lf := &luaFile{f: f, closeFn: closeFn}
+	lf.setvbuf("full", ioBufferSize)
+	return NewUserData(lf, vm.registry.Get(fileHandleName).(LuaTable))
+}
+
+// reader 读取之前需要刷新写缓冲
+func (lf *luaFile) reader() (*bufio.Reader, error) {
+	if err := lf.flush(); err != nil {
+		return nil, err
+	}
+	if lf.r == nil {
+		lf.r = bufio.NewReader(lf.f)
+	}
+	return lf.r, nil
+}
+
+// discardRead 丢弃读缓冲, 将文件位置移回逻辑上的读取位置
+func (lf *luaFile) discardRead() {
+	if lf.r == nil {
+		return
+	}
+	if n := lf.r.Buffered(); n > 0 {
+		if _, err := lf.f.Seek(-int64(n), io.SeekCurrent); err != nil {
+			return // 无法seek(如管道)时保留缓冲的数据
+		}
+	}
+	lf.r.Reset(lf.f)
+}
+
+func (lf *luaFile) write(s string) error {
+	lf.discardRead()
+	if lf.w == nil {
+		_, err := io.WriteString(lf.f, s)
+		return err
+	}
+	if _, err := lf.w.WriteString(s); err != nil {
+		return err
+	}
+	if lf.line && strings.IndexByte(s, '\n') >= 0 {
+		return lf.w.Flush()
+	}
+	return nil
+}
+
+func (lf *luaFile) flush() error {
+	if lf.w == nil {
+		return nil
+	}
+	return lf.w.Flush()
+}
+
+func (lf *luaFile) seek(offset int64, whence int) (int64, error) {
+	if err := lf.flush(); err != nil {
+		return 0, err
+	}
+	lf.discardRead()
+	return lf.f.Seek(offset, whence)
+}
+
+// setvbuf 设置写缓冲模式: "no", "full", "line"
+func (lf *luaFile) setvbuf(mode string, size int) error {
+	err := lf.flush()
+	lf.w, lf.line = nil, mode == "line"
+	if mode != "no" {
+		lf.w = bufio.NewWriterSize(lf.f, size)
+	}
+	return err
+}
+
+// close 关闭文件, 标准文件不能关闭
+func (lf *luaFile) close() []interface{} {
+	if lf.closeFn == nil {
+		return []interface{}{nil, "cannot close standard file"}
+	}
+	lf.closed = true
+	return fileResult(lf.closeFn(lf), "")
+}
+
+// closeFile 普通文件的关闭函数
+func closeFile(lf *luaFile) error {
+	err := lf.flush()
+	if cerr := lf.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// toFile 第1个参数必须是未关闭的文件句柄
+func toFile(args []luaValue, fname string) *luaFile {
+	if ud, ok := argAt(args, 1).(*UserData); ok {
+		if lf, ok := ud.Value.(*luaFile); ok {
+			if lf.closed {
+				panic("attempt to use a closed file")
+			}
+			return lf
+		}
+	}
+	typeError(args, 1, fname, fileHandleName)
+	return nil
+}
+
+// ioFile 注册表中的默认输入或者输出文件
+func (vm *State) ioFile(key string) (*UserData, *luaFile) {
+	ud := vm.registry.Get(key).(*UserData)
+	lf := ud.Value.(*luaFile)
+	if lf.closed {
+		panic(fmt.Sprintf("standard %s file is closed", key[len("_IO_"):]))
+	}
+	return ud, lf
+}
+
+// openFlags io.open的模式对应的os.OpenFile标记, 模式必须匹配 [rwa]%+?b*
+func openFlags(mode string) (int, bool) {
+	var flag int
+	switch {
+	case mode == "":
+		return 0, false
+	case strings.HasPrefix(mode, "r+"):
+		flag = os.O_RDWR
+	case strings.HasPrefix(mode, "w+"):
+		flag = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	case strings.HasPrefix(mode, "a+"):
+		flag = os.O_RDWR | os.O_CREATE | os.O_APPEND
+	case mode[0] == 'r':
+		flag = os.O_RDONLY
+	case mode[0] == 'w':
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case mode[0] == 'a':
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	default:
+		return 0, false
+	}
+	rest := strings.TrimPrefix(mode[1:], "+")
+	return flag, strings.Trim(rest, "b") == ""
+}
+
+// openFile 打开文件并构造文件句柄
+func (vm *State) openFile(name, mode string) (*UserData, error) {
+	flag, _ := openFlags(mode)
+	f, err := vm.fs.OpenFile(name, flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return vm.newFile(f, closeFile), nil
+}
+
+// openCheckFile 打开文件, 失败时抛出错误
+func (vm *State) openCheckFile(name, mode string) *UserData {
+	ud, err := vm.openFile(name, mode)
+	if err != nil {
+		msg, _ := osError(err)
+		panic(fmt.Sprintf("cannot open file '%s' (%s)", name, msg))
+	}
+	return ud
+}
+
+// io.open (filename [, mode])
+func ioOpen(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	name := checkString(args, 1, "open")
+	mode := optString(args, 2, "open", "r")
+	if _, ok := openFlags(mode); !ok {
+		argError(2, "open", "invalid mode")
+	}
+	ud, err := vm.openFile(name, mode)
+	if err != nil {
+		return fileResult(err, name)
+	}
+	return []interface{}{ud}
+}
+
+// io.tmpfile ()
+// 临时文件在关闭时被删除
+func ioTmpfile(state api.State, _ ...interface{}) []interface{} {
+	vm := state.(*State)
+	f, err := vm.fs.TempFile()
+	if err != nil {
+		return fileResult(err, "")
+	}
+	return []interface{}{vm.newFile(f, func(lf *luaFile) error {
+		err := closeFile(lf)
+		vm.fs.Remove(f.Name())
+		return err
+	})}
+}
+
+// io.type (obj)
+func ioType(_ api.State, args ...interface{}) []interface{} {
+	if ud, ok := checkAny(args, 1, "type").(*UserData); ok {
+		if lf, ok := ud.Value.(*luaFile); ok {
+			if lf.closed {
+				return []interface{}{"closed file"}
+			}
+			return []interface{}{"file"}
+		}
+	}
+	return []interface{}{nil}
+}
+
+// io.close ([file])
+func ioClose(state api.State, args ...interface{}) []interface{} {
+	if len(args) == 0 {
+		args = []interface{}{state.(*State).registry.Get(ioOutputKey)}
+	}
+	return fileClose(state, args...)
+}
+
+// io.flush ()
+func ioFlush(state api.State, _ ...interface{}) []interface{} {
+	_, lf := state.(*State).ioFile(ioOutputKey)
+	return fileResult(lf.flush(), "")
+}
+
+// ioFileFunc io.input和io.output: 设置或者获取默认文件
+func (vm *State) ioFileFunc(args []luaValue, key, mode, fname string) []interface{} {
+	if argAt(args, 1) != nil {
+		if name, ok := toString(args[0]); ok {
+			vm.registry.Put(key, vm.openCheckFile(name, mode))
+		} else {
+			toFile(args, fname)
+			vm.registry.Put(key, args[0])
+		}
+	}
+	return []interface{}{vm.registry.Get(key)}
+}
+
+// io.input ([file])
+func ioInput(state api.State, args ...interface{}) []interface{} {
+	return state.(*State).ioFileFunc(args, ioInputKey, "r", "input")
+}
+
+// io.output ([file])
+func ioOutput(state api.State, args ...interface{}) []interface{} {
+	return state.(*State).ioFileFunc(args, ioOutputKey, "w", "output")
+}
+
+// io.lines ([filename, ···])
+func ioLines(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	if argAt(args, 1) == nil {
+		ud, _ := vm.ioFile(ioInputKey)
+		if len(args) > 0 {
+			args = args[1:]
+		}
+		return vm.lines(ud, args, false)
+	}
+	ud := vm.openCheckFile(checkString(args, 1, "lines"), "r")
+	return vm.lines(ud, args[1:], true)
+}
+
+// lines 构造按照formats读取文件的迭代函数, toClose为true时在读取结束后关闭文件
+func (vm *State) lines(ud *UserData, formats []luaValue, toClose bool) []interface{} {
+	if len(formats) > maxArgLine {
+		argError(maxArgLine+2, "lines", "too many arguments")
+	}
+	lf := ud.Value.(*luaFile)
+	formats = append([]luaValue(nil), formats...)
+	iter := func(_ api.State, _ ...interface{}) []interface{} {
+		if lf.closed {
+			panic("file is already closed")
+		}
+		results := vm.read(lf, append([]luaValue{ud}, formats...), 2, "lines")
+		if toBool(results[0]) {
+			return results
+		}
+		if len(results) > 1 { // 读取出错
+			panic(results[1])
+		}
+		if toClose {
+			lf.close()
+		}
+		return nil
+	}
+	return []interface{}{newGoClosure(iter)}
+}
+
+// io.read (···)
+func ioRead(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	_, lf := vm.ioFile(ioInputKey)
+	return vm.read(lf, args, 1, "read")
+}
+
+// io.write (···)
+func ioWrite(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	ud, lf := vm.ioFile(ioOutputKey)
+	return vm.write(ud, lf, args, 1, "write")
+}
+
+// file:close ()
+func fileClose(_ api.State, args ...interface{}) []interface{} {
+	return toFile(args, "close").close()
+}
+
+// file:flush ()
+func fileFlush(_ api.State, args ...interface{}) []interface{} {
+	return fileResult(toFile(args, "flush").flush(), "")
+}
+
+// file:lines (···)
+func fileLines(state api.State, args ...interface{}) []interface{} {
+	toFile(args, "lines")
+	return state.(*State).lines(args[0].(*UserData), args[1:], false)
+}
+
+// file:read (···)
+func fileRead(state api.State, args ...interface{}) []interface{} {
+	lf := toFile(args, "read")
+	return state.(*State).read(lf, args, 2, "read")
+}
+
+// file:write (···)
+func fileWrite(state api.State, args ...interface{}) []interface{} {
+	lf := toFile(args, "write")
+	return state.(*State).write(args[0].(*UserData), lf, args, 2, "write")
+}
+
+// file:seek ([whence [, offset]])
+func fileSeek(_ api.State, args ...interface{}) []interface{} {
+	lf := toFile(args, "seek")
+	var whence int
+	switch opt := optString(args, 2, "seek", "cur"); opt {
+	case "set":
+		whence = io.SeekStart
+	case "cur":
+		whence = io.SeekCurrent
+	case "end":
+		whence = io.SeekEnd
+	default:
+		argError(2, "seek", fmt.Sprintf("invalid option '%s'", opt))
+	}
+	pos, err := lf.seek(int64(optInteger(args, 3, "seek", 0)), whence)
+	if err != nil {
+		return fileResult(err, "")
+	}
+	return []interface{}{int(pos)}
+}
+
+// file:setvbuf (mode [, size])
+func fileSetvbuf(_ api.State, args ...interface{}) []interface{} {
+	lf := toFile(args, "setvbuf")
+	mode := checkString(args, 2, "setvbuf")
+	if mode != "no" && mode != "full" && mode != "line" {
+		argError(2, "setvbuf", fmt.Sprintf("invalid option '%s'", mode))
+	}
+	size := optInteger(args, 3, "setvbuf", ioBufferSize)
+	if size <= 0 {
+		size = ioBufferSize
+	}
+	return fileResult(lf.setvbuf(mode, size), "")
+}
+
+// __tostring
+func fileToString(_ api.State, args ...interface{}) []interface{} {
+	if ud, ok := argAt(args, 1).(*UserData); ok {
+		if lf, ok := ud.Value.(*luaFile); ok {
+			if lf.closed {
+				return []interface{}{"file (closed)"}
+			}
+			return []interface{}{fmt.Sprintf("file (%p)", lf)}
+		}
+	}
+	typeError(args, 1, "__tostring", fileHandleName)
+	return nil
+}
+
+// write 写入args中从第first个开始的参数(字符串或者数字), 成功时返回文件句柄
+func (vm *State) write(ud *UserData, lf *luaFile, args []luaValue, first int, fname string) []interface{} {
+	var err error
+	for n := first; n <= len(args); n++ {
+		var s string
+		switch x := args[n-1].(type) {
+		case int:
+			s = fmt.Sprintf("%d", x)
+		case float64:
+			s = formatSpec{precision: 14}.formatFloat(x, 'g') // LUA_NUMBER_FMT "%.14g"
+		default:
+			s = checkString(args, n, fname)
+		}
+		if err == nil {
+			err = lf.write(s)
+		}
+	}
+	if err != nil {
+		return fileResult(err, "")
+	}
+	return []interface{}{ud}
+}
+
+// read 按照args中从第first个开始的格式读取文件, 某个格式读取失败时返回nil并停止读取
+func (vm *State) read(lf *luaFile, args []luaValue, first int, fname string) []interface{} {
+	r, err := lf.reader()
+	if err != nil {
+		return fileResult(err, "")
+	}
+	if len(args) < first { // 默认读取一行
+		v, ok, err := vm.readLine(r, true)
+		if err != nil {
+			return fileResult(err, "")
+		} else if !ok {
+			v = nil
+		}
+		return []interface{}{v}
+	}
+	var results []interface{}
+	for n := first; n <= len(args); n++ {
+		var v luaValue
+		var ok bool
+		if typeOf(args[n-1]) == LUA_TNUMBER {
+			if l := checkInteger(args, n, fname); l == 0 {
+				v, ok, err = testEOF(r)
+			} else {
+				v, ok, err = vm.readChars(r, l)
+			}
+		} else {
+			switch p := strings.TrimPrefix(checkString(args, n, fname), "*"); {
+			case strings.HasPrefix(p, "n"):
+				v, ok, err = readNumber(r)
+			case strings.HasPrefix(p, "l"):
+				v, ok, err = vm.readLine(r, true)
+			case strings.HasPrefix(p, "L"):
+				v, ok, err = vm.readLine(r, false)
+			case strings.HasPrefix(p, "a"):
+				v, ok, err = vm.readAll(r)
+			default:
+				argError(n, fname, "invalid format")
+			}
+		}
+		if err != nil {
+			return fileResult(err, "")
+		}
+		if !ok {
+			return append(results, nil)
+		}
+		results = append(results, v)
+	}
+	return results
+}
+
+// eofErr 读取到文件结尾不是错误
+func eofErr(err error) error {
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// testEOF read(0): 未到达文件结尾时返回空字符串
+func testEOF(r *bufio.Reader) (luaValue, bool, error) {
+	_, err := r.Peek(1)
+	return "", err == nil, eofErr(err)
+}
+
+// readChars 读取最多n个字节, n为负数时视为无限大(同C语言的size_t转换)
+func (vm *State) readChars(r *bufio.Reader, n int) (luaValue, bool, error) {
+	b := newMemWriter(vm)
+	var err error
+	if n < 0 {
+		_, err = io.Copy(b, r)
+	} else {
+		_, err = io.CopyN(b, r, int64(n))
+	}
+	return b.String(), b.Len() > 0, eofErr(err)
+}
+
+// readLine 读取一行, chop为true时去掉换行符
+func (vm *State) readLine(r *bufio.Reader, chop bool) (luaValue, bool, error) {
+	b := newMemWriter(vm)
+	var err error
+	for {
+		var line []byte
+		line, err = r.ReadSlice('\n')
+		b.Write(line)
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	s := b.String()
+	ok := err == nil || len(s) > 0 // 读到换行符或者读到了字符
+	if chop {
+		s = strings.TrimSuffix(s, "\n")
+	}
+	return s, ok, eofErr(err)
+}
+
+// readAll 读取剩余的全部内容, 总是成功
+func (vm *State) readAll(r *bufio.Reader) (luaValue, bool, error) {
+	b := newMemWriter(vm)
+	_, err := io.Copy(b, r)
+	return b.String(), true, err
+}
+
+// numReader 同liolib的RN, 最多读取maxLenNum个字符, 并且只有1个字符的前瞻
+type numReader struct {
+	r   *bufio.Reader
+	c   int // 当前字符, -1表示EOF
+	buf []byte
+	err error
+}
+
+func (rn *numReader) getc() {
+	b, err := rn.r.ReadByte()
+	if err != nil {
+		rn.c, rn.err = -1, eofErr(err)
+		return
+	}
+	rn.c = int(b)
+}
+
+// nextc 保存当前字符并读取下一个字符
+func (rn *numReader) nextc() bool {
+	if len(rn.buf) >= maxLenNum { // 数字过长, 结果无效
+		rn.buf = rn.buf[:0]
+		return false
+	}
+	rn.buf = append(rn.buf, byte(rn.c))
+	rn.getc()
+	return true
+}
+
+// test2 当前字符为set中的字符时接受该字符
+func (rn *numReader) test2(set string) bool {
+	if rn.c == int(set[0]) || rn.c == int(set[1]) {
+		return rn.nextc()
+	}
+	return false
+}
+
+func (rn *numReader) readDigits(hex bool) int {
+	count := 0
+	for rn.c >= 0 && (hex && isHexDigit(byte(rn.c)) || !hex && isDigit(byte(rn.c))) && rn.nextc() {
+		count++
+	}
+	return count
+}
+
+// readNumber read("n"): 按照lua数字的语法读取尽可能长的数字
+func readNumber(r *bufio.Reader) (luaValue, bool, error) {
+	rn := &numReader{r: r}
+	for rn.getc(); rn.c >= 0 && matchClass(byte(rn.c), 's'); rn.getc() { // 跳过空白
+	}
+	count, hex := 0, false
+	rn.test2("-+")
+	if rn.test2("00") {
+		if rn.test2("xX") {
+			hex = true
+		} else {
+			count = 1
+		}
+	}
+	count += rn.readDigits(hex)
+	if rn.test2("..") {
+		count += rn.readDigits(hex)
+	}
+	exp := "eE"
+	if hex {
+		exp = "pP"
+	}
+	if count > 0 && rn.test2(exp) {
+		rn.test2("-+")
+		rn.readDigits(false)
+	}
+	if rn.c >= 0 {
+		r.UnreadByte()
+	}
+	if rn.err != nil {
+		return nil, false, rn.err
+	}
+	v, ok := stringToNumber(string(rn.buf))
+	return v, ok, nil
+}
@@ -0,0 +1,271 @@
+package vm
+
+import (
+	"luago/vm/api"
+	"math"
+)
+
+var mathFuncs = map[string]api.GoFunc{
+	"abs":        mathAbs,
+	"ceil":       mathCeil,
+	"cos":        mathCos,
+	"deg":        mathDeg,
+	"exp":        mathExp,
+	"tointeger":  mathToInt,
+	"floor":      mathFloor,
+	"fmod":       mathFmod,
+	"ult":        mathUlt,
+	"log":        mathLog,
+	"max":        mathMax,
+	"min":        mathMin,
+	"modf":       mathModf,
+	"rad":        mathRad,
+	"random":     mathRandom,
+	"randomseed": mathRandomseed,
+	"sin":        mathSin,
+	"sqrt":       mathSqrt,
+	"tan":        mathTan,
+	"type":       mathType,
+	"asin":       mathAsin,
+	"acos":       mathAcos,
+	"atan":       mathAtan,
+}
+
+// openMathLib 注册math库
+func openMathLib(vm *State) {
+	lib := newLib(mathFuncs)
+	lib.Put("pi", math.Pi)
+	lib.Put("huge", math.Inf(1))
+	lib.Put("maxinteger", math.MaxInt64)
+	lib.Put("mininteger", math.MinInt64)
+	vm.global.Put("math", lib)
+}
+
+// math.abs (x)
+func mathAbs(_ api.State, args ...interface{}) []interface{} {
+	if i, ok := argAt(args, 1).(int); ok {
+		if i < 0 {
+			i = -i // mininteger时回绕
+		}
+		return []interface{}{i}
+	}
+	return []interface{}{math.Abs(checkNumber(args, 1, "abs"))}
+}
+
+// math.ceil (x)
+func mathCeil(_ api.State, args ...interface{}) []interface{} {
+	if i, ok := argAt(args, 1).(int); ok {
+		return []interface{}{i}
+	}
+	return []interface{}{floatToIntIfFits(math.Ceil(checkNumber(args, 1, "ceil")))}
+}
+
+// math.floor (x)
+func mathFloor(_ api.State, args ...interface{}) []interface{} {
+	if i, ok := argAt(args, 1).(int); ok {
+		return []interface{}{i}
+	}
+	return []interface{}{floatToIntIfFits(math.Floor(checkNumber(args, 1, "floor")))}
+}
+
+// floatToIntIfFits 整数值的浮点数在整数范围内时转换为整数
+func floatToIntIfFits(f float64) luaValue {
+	if i, ok := floatToInteger(f); ok {
+		return i
+	}
+	return f
+}
+
+// math.fmod (x, y)
+func mathFmod(_ api.State, args ...interface{}) []interface{} {
+	a, aok := argAt(args, 1).(int)
+	b, bok := argAt(args, 2).(int)
+	if aok && bok {
+		switch b {
+		case 0:
+			argError(2, "fmod", "zero")
+		case -1:
+			return []interface{}{0} // 避免 mininteger % -1 溢出
+		}
+		return []interface{}{a % b} // C语言的取余, 结果与被除数同号
+	}
+	return []interface{}{math.Mod(checkNumber(args, 1, "fmod"), checkNumber(args, 2, "fmod"))}
+}
+
+// math.modf (x)
+// 整数部分在整数范围内时返回整数(同官方实现的pushnumint), 整数参数返回自身
+func mathModf(_ api.State, args ...interface{}) []interface{} {
+	if i, ok := argAt(args, 1).(int); ok {
+		return []interface{}{i, 0.0}
+	}
+	x := checkNumber(args, 1, "modf")
+	ip := math.Trunc(x)
+	if x == ip { // 整数或者inf
+		return []interface{}{floatToIntIfFits(ip), 0.0}
+	}
+	return []interface{}{floatToIntIfFits(ip), x - ip}
+}
+
+// math.sqrt (x)
+func mathSqrt(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Sqrt(checkNumber(args, 1, "sqrt"))}
+}
+
+// math.exp (x)
+func mathExp(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Exp(checkNumber(args, 1, "exp"))}
+}
+
+// math.log (x [, base])
+func mathLog(_ api.State, args ...interface{}) []interface{} {
+	x := checkNumber(args, 1, "log")
+	if argAt(args, 2) == nil {
+		return []interface{}{math.Log(x)}
+	}
+	switch base := checkNumber(args, 2, "log"); base {
+	case 2:
+		return []interface{}{math.Log2(x)}
+	case 10:
+		return []interface{}{math.Log10(x)}
+	default:
+		return []interface{}{math.Log(x) / math.Log(base)}
+	}
+}
+
+// math.sin (x)
+func mathSin(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Sin(checkNumber(args, 1, "sin"))}
+}
+
+// math.cos (x)
+func mathCos(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Cos(checkNumber(args, 1, "cos"))}
+}
+
+// math.tan (x)
+func mathTan(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Tan(checkNumber(args, 1, "tan"))}
+}
+
+// math.asin (x)
+func mathAsin(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Asin(checkNumber(args, 1, "asin"))}
+}
+
+// math.acos (x)
+func mathAcos(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{math.Acos(checkNumber(args, 1, "acos"))}
+}
+
+// math.atan (y [, x])
+func mathAtan(_ api.State, args ...interface{}) []interface{} {
+	y := checkNumber(args, 1, "atan")
+	x := optNumber(args, 2, "atan", 1)
+	return []interface{}{math.Atan2(y, x)}
+}
+
+// math.deg (x)
+func mathDeg(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{checkNumber(args, 1, "deg") * (180 / math.Pi)}
+}
+
+// math.rad (x)
+func mathRad(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{checkNumber(args, 1, "rad") * (math.Pi / 180)}
+}
+
+// math.tointeger (x)
+func mathToInt(_ api.State, args ...interface{}) []interface{} {
+	if i, ok := convertToInteger(argAt(args, 1)); ok {
+		return []interface{}{i}
+	}
+	checkAny(args, 1, "tointeger")
+	return []interface{}{nil}
+}
+
+// math.type (x)
+func mathType(_ api.State, args ...interface{}) []interface{} {
+	switch checkAny(args, 1, "type").(type) {
+	case int:
+		return []interface{}{"integer"}
+	case float64:
+		return []interface{}{"float"}
+	}
+	return []interface{}{nil}
+}
+
+// math.ult (m, n)
+func mathUlt(_ api.State, args ...interface{}) []interface{} {
+	m := checkInteger(args, 1, "ult")
+	n := checkInteger(args, 2, "ult")
+	return []interface{}{uint64(m) < uint64(n)}
+}
+
+// math.max (x, ···)
+func mathMax(state api.State, args ...interface{}) []interface{} {
+	return mathMinMax(state.(*State), args, "max", false)
+}
+
+// math.min (x, ···)
+func mathMin(state api.State, args ...interface{}) []interface{} {
+	return mathMinMax(state.(*State), args, "min", true)
+}
+
+// mathMinMax 返回参数中的最小值或者最大值(保持原始的整数或者浮点数类型)
+func mathMinMax(vm *State, args []luaValue, fname string, min bool) []interface{} {
+	if len(args) < 1 {
+		argError(1, fname, "value expected")
+	}
+	result := args[0]
+	for _, arg := range args[1:] {
+		a, b := arg, result
+		if !min {
+			a, b = b, a
+		}
+		lt, err := vm.compareLt(a, b)
+		if err != nil {
+			panic(err.Error())
+		}
+		if lt {
+			result = arg
+		}
+	}
+	return []interface{}{result}
+}
+
+// math.random ([m [, n]])
+func mathRandom(state api.State, args ...interface{}) []interface{} {
+	rng := state.(*State).rand
+	var low, up int
+	switch len(args) {
+	case 0:
+		return []interface{}{rng.Float64()}
+	case 1:
+		low, up = 1, checkInteger(args, 1, "random")
+	case 2:
+		low, up = checkInteger(args, 1, "random"), checkInteger(args, 2, "random")
+	default:
+		panic("wrong number of arguments")
+	}
+	if low > up {
+		argError(1, "random", "interval is empty")
+	}
+	if low < 0 && up > math.MaxInt64+low {
+		argError(1, "random", "interval too large")
+	}
+	if n := up - low; n == math.MaxInt64 {
+		return []interface{}{low + int(rng.Uint64()>>1)}
+	} else {
+		return []interface{}{low + int(rng.Int63n(int64(n)+1))}
+	}
+}
+
+// math.randomseed (x)
+func mathRandomseed(state api.State, args ...interface{}) []interface{} {
+	seed, ok := argAt(args, 1).(int)
+	if !ok {
+		seed = int(checkNumber(args, 1, "randomseed"))
+	}
+	state.(*State).rand.Seed(int64(seed))
+	return nil
+}
@@ -0,0 +1,307 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+var osFuncs = map[string]api.GoFunc{
+	"clock":    osClock,
+	"date":     osDate,
+	"difftime": osDifftime,
+	"exit":     osExit,
+	"getenv":   osGetenv,
+	"remove":   osRemove,
+	"rename":   osRename,
+	"time":     osTime,
+	"tmpname":  osTmpname,
+}
+
+// openOsLib 注册os库
+func openOsLib(vm *State) {
+	vm.global.Put("os", newLib(osFuncs))
+}
+
+// checkPermission 宿主通过选项禁止的os函数被调用时抛出错误
+func checkPermission(allowed bool, fname string) {
+	if !allowed {
+		panic(fmt.Sprintf("'%s' is not permitted", fname))
+	}
+}
+
+// os.clock ()
+// go没有可移植的进程CPU时间, 返回State创建以来经过的时间(使用State的时钟)
+func osClock(state api.State, _ ...interface{}) []interface{} {
+	vm := state.(*State)
+	return []interface{}{vm.clock().Sub(vm.startTime).Seconds()}
+}
+
+// os.difftime (t2, t1)
+func osDifftime(_ api.State, args ...interface{}) []interface{} {
+	t2 := checkInteger(args, 1, "difftime")
+	t1 := checkInteger(args, 2, "difftime")
+	return []interface{}{float64(t2) - float64(t1)}
+}
+
+// os.getenv (varname)
+func osGetenv(state api.State, args ...interface{}) []interface{} {
+	if v, ok := state.(*State).getenv(checkString(args, 1, "getenv")); ok {
+		return []interface{}{v}
+	}
+	return []interface{}{nil}
+}
+
+// os.remove (filename)
+func osRemove(state api.State, args ...interface{}) []interface{} {
+	name := checkString(args, 1, "remove")
+	checkPermission(state.(*State).allowFileOps, "remove")
+	return fileResult(state.(*State).fs.Remove(name), name)
+}
+
+// os.rename (oldname, newname)
+func osRename(state api.State, args ...interface{}) []interface{} {
+	from := checkString(args, 1, "rename")
+	to := checkString(args, 2, "rename")
+	checkPermission(state.(*State).allowFileOps, "rename")
+	return fileResult(state.(*State).fs.Rename(from, to), "")
+}
+
+// os.tmpname ()
+func osTmpname(state api.State, _ ...interface{}) []interface{} {
+	vm := state.(*State)
+	checkPermission(vm.allowFileOps, "tmpname")
+	f, err := vm.fs.TempFile()
+	if err != nil {
+		panic("unable to generate a unique filename")
+	}
+	f.Close()
+	return []interface{}{f.Name()}
+}
+
+// os.exit ([code [, close]])
+func osExit(state api.State, args ...interface{}) []interface{} {
+	status := 0
+	if b, ok := argAt(args, 1).(bool); ok {
+		if !b {
+			status = 1
+		}
+	} else {
+		status = optInteger(args, 1, "exit", 0)
+	}
+	checkPermission(state.(*State).allowExit, "exit")
+	os.Exit(status)
+	return nil
+}
+
+// os.time ([table])
+func osTime(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	if argAt(args, 1) == nil {
+		return []interface{}{int(vm.clock().Unix())}
+	}
+	t := checkTable(args, 1, "time")
+	// 字段超出范围时由time.Date规范化(如 month = 13), 与mktime相同; isdst被忽略
+	sec := vm.dateField(t, "sec", 0)
+	min := vm.dateField(t, "min", 0)
+	hour := vm.dateField(t, "hour", 12)
+	day := vm.dateField(t, "day", -1)
+	month := vm.dateField(t, "month", -1)
+	year := vm.dateField(t, "year", -1)
+	date := time.Date(year, time.Month(month), day, hour, min, sec, 0, time.Local)
+	checkDate(date)
+	vm.setDateFields(t, date) // 更新为规范化之后的值
+	return []interface{}{int(date.Unix())}
+}
+
+// maxDateField 日期字段的最大绝对值, 避免计算溢出
+const maxDateField = math.MaxInt32 / 2
+
+// dateField 读取日期表中的整数字段, d为负数时字段不能为空
+func (vm *State) dateField(t LuaTable, key string, d int) int {
+	v := vm.index(t, key)
+	res, ok := convertToInteger(v)
+	if !ok {
+		if v != nil {
+			panic(fmt.Sprintf("field '%s' is not an integer", key))
+		} else if d < 0 {
+			panic(fmt.Sprintf("field '%s' missing in date table", key))
+		}
+		return d
+	}
+	if res < -maxDateField || res > maxDateField {
+		panic(fmt.Sprintf("field '%s' is out-of-bound", key))
+	}
+	return res
+}
+
+// setDateFields 设置日期表的所有字段
+func (vm *State) setDateFields(t LuaTable, date time.Time) {
+	vm.setIndex(t, "sec", date.Second())
+	vm.setIndex(t, "min", date.Minute())
+	vm.setIndex(t, "hour", date.Hour())
+	vm.setIndex(t, "day", date.Day())
+	vm.setIndex(t, "month", int(date.Month()))
+	vm.setIndex(t, "year", date.Year())
+	vm.setIndex(t, "wday", int(date.Weekday())+1)
+	vm.setIndex(t, "yday", date.YearDay())
+	vm.setIndex(t, "isdst", date.IsDST())
+}
+
+// checkDate C语言struct tm中年份为int(tm_year = year - 1900), 超出范围时无法表示
+func checkDate(date time.Time) {
+	if y := date.Year() - 1900; y < math.MinInt32 || y > math.MaxInt32 {
+		panic("time result cannot be represented in this installation")
+	}
+}
+
+// os.date ([format [, time]])
+func osDate(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	format := optString(args, 1, "date", "%c")
+	var sec int64
+	if argAt(args, 2) == nil {
+		sec = vm.clock().Unix()
+	} else {
+		sec = int64(checkInteger(args, 2, "date"))
+	}
+	date := time.Unix(sec, 0).In(time.Local)
+	if strings.HasPrefix(format, "!") { // UTC
+		date = date.UTC()
+		format = format[1:]
+	}
+	checkDate(date)
+	if format == "*t" {
+		t := newLuaTable(0, 9)
+		vm.setDateFields(t, date)
+		return []interface{}{t}
+	}
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		conv := checkDateOption(format[i+1:])
+		i += len(conv)
+		strftime(&b, conv[len(conv)-1], date) // C locale中E和O修饰符没有作用
+	}
+	return []interface{}{b.String()}
+}
+
+// strftimeOptions 有效的转换说明符(C99), 按照长度分组, '|'之后为下一组
+const strftimeOptions = "aAbBcCdDeFgGhHIjmMnprRStTuUVwWxXyYzZ%" +
+	"||" + "EcECExEXEyEY" + "OdOeOHOIOmOMOSOuOUOVOwOWOy"
+
+// checkDateOption 检查'%'之后的转换说明符, 返回说明符(不包括'%')
+func checkDateOption(conv string) string {
+	opts, oplen := strftimeOptions, 1
+	for len(opts) > 0 && oplen <= len(conv) {
+		if opts[0] == '|' { // 下一组, 跳过"||"
+			oplen++
+			opts = opts[oplen:]
+		} else if opts[:oplen] == conv[:oplen] {
+			return conv[:oplen]
+		} else {
+			opts = opts[oplen:]
+		}
+	}
+	argError(1, "date", fmt.Sprintf("invalid conversion specifier '%%%s'", conv))
+	return ""
+}
+
+// strftime 按照C locale输出单个转换说明符
+func strftime(b *strings.Builder, conv byte, t time.Time) {
+	seq := func(convs string) {
+		for i := 0; i < len(convs); i++ {
+			if convs[i] == '%' {
+				i++
+				strftime(b, convs[i], t)
+			} else {
+				b.WriteByte(convs[i])
+			}
+		}
+	}
+	yday, wday := t.YearDay()-1, int(t.Weekday())
+	switch conv {
+	case 'a':
+		b.WriteString(t.Weekday().String()[:3])
+	case 'A':
+		b.WriteString(t.Weekday().String())
+	case 'b', 'h':
+		b.WriteString(t.Month().String()[:3])
+	case 'B':
+		b.WriteString(t.Month().String())
+	case 'c':
+		seq("%a %b %e %H:%M:%S %Y")
+	case 'C':
+		fmt.Fprintf(b, "%02d", t.Year()/100)
+	case 'd':
+		fmt.Fprintf(b, "%02d", t.Day())
+	case 'D', 'x':
+		seq("%m/%d/%y")
+	case 'e':
+		fmt.Fprintf(b, "%2d", t.Day())
+	case 'F':
+		seq("%Y-%m-%d")
+	case 'g':
+		year, _ := t.ISOWeek()
+		fmt.Fprintf(b, "%02d", year%100)
+	case 'G':
+		year, _ := t.ISOWeek()
+		fmt.Fprintf(b, "%d", year)
+	case 'H':
+		fmt.Fprintf(b, "%02d", t.Hour())
+	case 'I':
+		fmt.Fprintf(b, "%02d", (t.Hour()+11)%12+1)
+	case 'j':
+		fmt.Fprintf(b, "%03d", yday+1)
+	case 'm':
+		fmt.Fprintf(b, "%02d", int(t.Month()))
+	case 'M':
+		fmt.Fprintf(b, "%02d", t.Minute())
+	case 'n':
+		b.WriteByte('\n')
+	case 'p':
+		if t.Hour() < 12 {
+			b.WriteString("AM")
+		} else {
+			b.WriteString("PM")
+		}
+	case 'r':
+		seq("%I:%M:%S %p")
+	case 'R':
+		seq("%H:%M")
+	case 'S':
+		fmt.Fprintf(b, "%02d", t.Second())
+	case 't':
+		b.WriteByte('\t')
+	case 'T', 'X':
+		seq("%H:%M:%S")
+	case 'u':
+		fmt.Fprintf(b, "%d", (wday+6)%7+1)
+	case 'U': // 以星期日为一周的第一天
+		fmt.Fprintf(b, "%02d", (yday+7-wday)/7)
+	case 'V':
+		_, week := t.ISOWeek()
+		fmt.Fprintf(b, "%02d", week)
+	case 'w':
+		fmt.Fprintf(b, "%d", wday)
+	case 'W': // 以星期一为一周的第一天
+		fmt.Fprintf(b, "%02d", (yday+7-(wday+6)%7)/7)
+	case 'y':
+		fmt.Fprintf(b, "%02d", t.Year()%100)
+	case 'Y':
+		fmt.Fprintf(b, "%d", t.Year())
+	case 'z':
+		b.WriteString(t.Format("-0700"))
+	case 'Z':
+		name, _ := t.Zone()
+		b.WriteString(name)
+	case '%':
+		b.WriteByte('%')
+	}
+}
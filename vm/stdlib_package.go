@@ -0,0 +1,207 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"luago/vm/api"
+	"os"
+	"strings"
+)
+
+var packageFuncs = map[string]api.GoFunc{
+	"loadlib":    packageLoadlib,
+	"searchpath": packageSearchpath,
+}
+
+const (
+	luaPathDefault  = "/usr/local/share/lua/5.3/?.lua;/usr/local/share/lua/5.3/?/init.lua;/usr/local/lib/lua/5.3/?.lua;/usr/local/lib/lua/5.3/?/init.lua;./?.lua;./?/init.lua"
+	luaCPathDefault = "/usr/local/lib/lua/5.3/?.so;/usr/local/lib/lua/5.3/loadall.so;./?.so"
+	preloadKey      = "_PRELOAD" // 注册表中package.preload的键(同LUA_PRELOAD_TABLE)
+)
+
+// openPackageLib 注册package库和require函数
+// package.searchers依次为: package.preload, package.path中的lua文件(源码或者二进制chunk), RegisterModule注册的go模块
+func openPackageLib(vm *State) {
+	pkg := newLib(packageFuncs)
+	searchers := newLuaTable(3, 0)
+	for _, searcher := range []func(*State, LuaTable, string) []interface{}{searcherPreload, searcherLua, searcherGo} {
+		searcher := searcher
+		searchers.Put(searchers.Len()+1, newGoClosure(func(state api.State, args ...interface{}) []interface{} {
+			return searcher(state.(*State), pkg, checkString(args, 1, "searcher"))
+		}))
+	}
+	pkg.Put("searchers", searchers)
+	pkg.Put("path", vm.envPath("LUA_PATH", luaPathDefault))
+	pkg.Put("cpath", vm.envPath("LUA_CPATH", luaCPathDefault))
+	pkg.Put("config", "/\n;\n?\n!\n-\n")
+	pkg.Put("loaded", vm.loadedTable())
+	pkg.Put("preload", vm.preloadTable())
+	vm.global.Put("package", pkg)
+	vm.global.Put("require", newGoClosure(func(state api.State, args ...interface{}) []interface{} {
+		return packageRequire(state.(*State), pkg, args)
+	}))
+}
+
+// envPath 同loadlib的setpath, 优先使用环境变量 envname_5_3, 其次 envname, 其中的";;"替换为默认路径
+func (vm *State) envPath(envname, dft string) string {
+	p, ok := vm.getenv(envname + "_5_3")
+	if !ok {
+		p, ok = vm.getenv(envname)
+	}
+	if !ok {
+		return dft
+	}
+	p = strings.ReplaceAll(p, ";;", ";\x01;")
+	return strings.ReplaceAll(p, "\x01", dft)
+}
+
+// preloadTable 注册表中的package.preload表, 不存在时创建
+func (vm *State) preloadTable() LuaTable {
+	if t, ok := vm.registry.Get(preloadKey).(LuaTable); ok {
+		return t
+	}
+	t := newLuaTable(0, 0)
+	vm.registry.Put(preloadKey, t)
+	return t
+}
+
+// require (modname)
+// 已加载的模块直接返回package.loaded[modname], 否则依次调用package.searchers查找加载器
+// 加载器的返回值(没有返回值时为true)保存到package.loaded[modname]
+func packageRequire(vm *State, pkg LuaTable, args []luaValue) []interface{} {
+	name := checkString(args, 1, "require")
+	loaded := vm.loadedTable()
+	if mod := loaded.Get(name); toBool(mod) {
+		return []interface{}{mod}
+	}
+	if vm.loading[name] {
+		panic(fmt.Sprintf("loop detected loading module '%s'", name))
+	}
+	loader, extra := vm.findLoader(pkg, name)
+	vm.loading[name] = true
+	defer delete(vm.loading, name)
+	if mod := _first(vm.callValue(loader, []luaValue{name, extra})); mod != nil {
+		loaded.Put(name, mod)
+	}
+	if loaded.Get(name) == nil { // 模块没有返回值
+		loaded.Put(name, true)
+	}
+	return []interface{}{loaded.Get(name)}
+}
+
+// findLoader 依次调用package.searchers中的函数查找模块加载器, 找不到时抛出错误
+func (vm *State) findLoader(pkg LuaTable, name string) (luaValue, luaValue) {
+	searchers, ok := pkg.Get("searchers").(LuaTable)
+	if !ok {
+		panic("'package.searchers' must be a table")
+	}
+	var msg strings.Builder
+	for i := 1; ; i++ {
+		searcher := searchers.Get(i)
+		if searcher == nil {
+			panic(fmt.Sprintf("module '%s' not found:%s", name, msg.String()))
+		}
+		results := vm.callValue(searcher, []luaValue{name})
+		if _, ok := _first(results).(*closure); ok {
+			return results[0], argAt(results, 2)
+		}
+		if s, ok := toString(_first(results)); ok {
+			msg.WriteString(s)
+		}
+	}
+}
+
+// searcherPreload 在package.preload中查找加载器
+func searcherPreload(vm *State, _ LuaTable, name string) []interface{} {
+	if loader := vm.preloadTable().Get(name); loader != nil {
+		return []interface{}{loader}
+	}
+	return []interface{}{fmt.Sprintf("\n\tno field package.preload['%s']", name)}
+}
+
+// searcherLua 在package.path中查找lua模块文件, 返回加载得到的主函数和文件名
+func searcherLua(vm *State, pkg LuaTable, name string) []interface{} {
+	p, ok := toString(pkg.Get("path"))
+	if !ok {
+		panic("'package.path' must be a string")
+	}
+	filename, errMsg := vm.searchPath(name, p, ".", "/")
+	if filename == "" {
+		return []interface{}{errMsg}
+	}
+	c, err := vm.loadModule(filename)
+	if err != nil {
+		panic(fmt.Sprintf("error loading module '%s' from file '%s':\n\t%s", name, filename, err.Error()))
+	}
+	return []interface{}{c, filename}
+}
+
+// searcherGo 查找 RegisterModule 注册的go模块
+func searcherGo(vm *State, _ LuaTable, name string) []interface{} {
+	if open, ok := vm.goModules[name]; ok {
+		return []interface{}{newGoClosure(open)}
+	}
+	return []interface{}{fmt.Sprintf("\n\tno Go module '%s'", name)}
+}
+
+// searchPath 同loadlib的searchpath, 将name中的sep替换为dirsep后依次代入path中以';'分隔的模板
+// 返回第一个可以读取的文件名, 找不到时返回空文件名和所有尝试过的文件名组成的错误信息
+func (vm *State) searchPath(name, path, sep, dirsep string) (string, string) {
+	if sep != "" {
+		name = strings.ReplaceAll(name, sep, dirsep)
+	}
+	var msg strings.Builder
+	for _, template := range strings.Split(path, ";") {
+		if template == "" {
+			continue
+		}
+		filename := strings.ReplaceAll(template, "?", name)
+		if f, err := vm.openModule(filename); err == nil {
+			f.Close()
+			return filename, ""
+		}
+		fmt.Fprintf(&msg, "\n\tno file '%s'", filename)
+	}
+	return "", msg.String()
+}
+
+// openModule 打开模块文件, 配置了 WithModuleFS 时从moduleFS读取, 否则从fs读取
+func (vm *State) openModule(filename string) (io.ReadCloser, error) {
+	if vm.moduleFS != nil {
+		return vm.moduleFS.Open(fsPath(filename))
+	}
+	return vm.fs.OpenFile(filename, os.O_RDONLY, 0)
+}
+
+// loadModule 加载模块文件, 返回模块的主函数
+func (vm *State) loadModule(filename string) (*closure, error) {
+	f, err := vm.openModule(filename)
+	if err != nil {
+		msg, _ := osError(err)
+		return nil, fmt.Errorf("cannot open %s: %s", filename, msg)
+	}
+	defer f.Close()
+	return vm.loadReader(f, "@"+filename, "bt")
+}
+
+// package.loadlib (libname, funcname)
+// 不支持加载C动态库, 总是返回失败
+func packageLoadlib(_ api.State, args ...interface{}) []interface{} {
+	checkString(args, 1, "loadlib")
+	checkString(args, 2, "loadlib")
+	return []interface{}{nil, "dynamic libraries not enabled; check your Lua installation", "absent"}
+}
+
+// package.searchpath (name, path [, sep [, rep]])
+func packageSearchpath(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	name := checkString(args, 1, "searchpath")
+	path := checkString(args, 2, "searchpath")
+	sep := optString(args, 3, "searchpath", ".")
+	dirsep := optString(args, 4, "searchpath", "/")
+	if filename, errMsg := vm.searchPath(name, path, sep, dirsep); filename != "" {
+		return []interface{}{filename}
+	} else {
+		return []interface{}{nil, errMsg}
+	}
+}
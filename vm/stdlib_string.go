@@ -0,0 +1,340 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"math"
+	"strings"
+)
+
+var strFuncs = map[string]api.GoFunc{
+	"byte":     strByte,
+	"char":     strChar,
+	"find":     strFind,
+	"format":   strFormat,
+	"gmatch":   strGmatch,
+	"gsub":     strGsub,
+	"len":      strLen,
+	"lower":    strLower,
+	"match":    strMatch,
+	"pack":     strPack,
+	"packsize": strPacksize,
+	"rep":      strRep,
+	"reverse":  strReverse,
+	"sub":      strSub,
+	"unpack":   strUnpack,
+	"upper":    strUpper,
+}
+
+const maxStringSize = math.MaxInt32 // 字符串操作(rep等)允许生成的最大长度
+
+// openStringLib 注册string库, 并设置string类型元表 __index = string 使 ("abc"):upper() 可用
+func openStringLib(vm *State) {
+	lib := newLib(strFuncs)
+	vm.global.Put("string", lib)
+	mt := newLuaTable(0, 1)
+	mt.Put("__index", lib)
+	vm.SetTypeMetatable(LUA_TSTRING, mt)
+}
+
+// string.byte (s [, i [, j]])
+func strByte(_ api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "byte")
+	i := optInteger(args, 2, "byte", 1)
+	i, j := strRange(len(s), i, optInteger(args, 3, "byte", i))
+	if i > j {
+		return nil
+	}
+	results := make([]interface{}, j-i+1)
+	for k := range results {
+		results[k] = int(s[i-1+k])
+	}
+	return results
+}
+
+// string.char (···)
+func strChar(state api.State, args ...interface{}) []interface{} {
+	state.(*State).allocMem(stringSize(len(args)))
+	buf := make([]byte, len(args))
+	for i := range args {
+		c := checkInteger(args, i+1, "char")
+		if c < 0 || c > math.MaxUint8 {
+			argError(i+1, "char", "value out of range")
+		}
+		buf[i] = byte(c)
+	}
+	return []interface{}{string(buf)}
+}
+
+// string.len (s)
+func strLen(_ api.State, args ...interface{}) []interface{} {
+	return []interface{}{len(checkString(args, 1, "len"))}
+}
+
+// string.lower (s)
+func strLower(state api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "lower")
+	state.(*State).allocMem(stringSize(len(s)))
+	return []interface{}{mapBytes(s, asciiLower)}
+}
+
+// string.rep (s, n [, sep])
+// 结果按照每块repBlock次重复生成, 每块计入相应的指令数
+func strRep(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	s := checkString(args, 1, "rep")
+	n := checkInteger(args, 2, "rep")
+	sep := optString(args, 3, "rep", "")
+	if n <= 0 {
+		return []interface{}{""}
+	}
+	unit := s + sep
+	if len(unit) > 0 && n > maxStringSize/len(unit) {
+		panic("resulting string too large")
+	}
+	vm.allocPending(stringSize(len(unit)*n - len(sep)))
+	if n <= repBlock {
+		vm.charge(n)
+		return []interface{}{strings.Repeat(unit, n)[:len(unit)*n-len(sep)]}
+	}
+	block := strings.Repeat(unit, repBlock)
+	var b strings.Builder // 不预先分配全部空间, 避免超过指令数上限之前占用大量内存
+	for left := n; left > 0; left -= repBlock {
+		k := repBlock
+		if left < k {
+			k = left
+		}
+		vm.charge(k)
+		b.WriteString(block[:len(unit)*k])
+	}
+	return []interface{}{b.String()[:b.Len()-len(sep)]}
+}
+
+// repBlock string.rep每次生成的重复次数
+const repBlock = 4096
+
+// string.reverse (s)
+func strReverse(state api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "reverse")
+	state.(*State).allocMem(stringSize(len(s)))
+	buf := make([]byte, len(s))
+	for i := range buf {
+		buf[i] = s[len(s)-1-i]
+	}
+	return []interface{}{string(buf)}
+}
+
+// string.sub (s [, i [, j]])
+func strSub(state api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "sub")
+	i, j := strRange(len(s), optInteger(args, 2, "sub", 1), optInteger(args, 3, "sub", -1))
+	if i > j {
+		return []interface{}{""}
+	}
+	state.(*State).allocMem(stringSize(j - i + 1))
+	return []interface{}{s[i-1 : j]}
+}
+
+// string.upper (s)
+func strUpper(state api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "upper")
+	state.(*State).allocMem(stringSize(len(s)))
+	return []interface{}{mapBytes(s, asciiUpper)}
+}
+
+// mapBytes 逐字节转换字符串(lua字符串是字节数组, 不能按utf8处理)
+func mapBytes(s string, mapping func(byte) byte) string {
+	buf := []byte(s)
+	for i, b := range buf {
+		buf[i] = mapping(b)
+	}
+	return string(buf)
+}
+
+// lua(C locale)只转换ASCII字母, 其他字节保持不变
+func asciiLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
+func asciiUpper(b byte) byte {
+	if b >= 'a' && b <= 'z' {
+		return b - 'a' + 'A'
+	}
+	return b
+}
+
+// string.find (s, pattern [, init [, plain]])
+func strFind(state api.State, args ...interface{}) []interface{} {
+	return strFindAux(state.(*State), args, "find", true)
+}
+
+// string.match (s, pattern [, init])
+func strMatch(state api.State, args ...interface{}) []interface{} {
+	return strFindAux(state.(*State), args, "match", false)
+}
+
+// strFindAux find返回匹配的位置和捕获, match只返回捕获(没有捕获时返回整个匹配)
+func strFindAux(vm *State, args []luaValue, fname string, find bool) []interface{} {
+	s := checkString(args, 1, fname)
+	pat := checkString(args, 2, fname)
+	init := posRelat(optInteger(args, 3, fname, 1), len(s))
+	if init < 1 {
+		init = 1
+	}
+	if init > len(s)+1 { // 起始位置超出字符串
+		return []interface{}{nil}
+	}
+	if find && (toBool(argAt(args, 4)) || noSpecials(pat)) {
+		if idx := strings.Index(s[init-1:], pat); idx >= 0 {
+			return []interface{}{init + idx, init + idx + len(pat) - 1}
+		}
+		return []interface{}{nil}
+	}
+	anchor := strings.HasPrefix(pat, "^")
+	if anchor {
+		pat = pat[1:]
+	}
+	ms := newMatchState(vm, s, pat)
+	for s1 := init - 1; s1 <= len(s); s1++ {
+		ms.reset()
+		if e := ms.match(s1, 0); e != -1 {
+			if find {
+				return append([]interface{}{s1 + 1, e}, ms.captures(-1, 0)...)
+			}
+			return ms.captures(s1, e)
+		}
+		if anchor {
+			break
+		}
+	}
+	return []interface{}{nil}
+}
+
+// string.gmatch (s, pattern)
+func strGmatch(state api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "gmatch")
+	pat := checkString(args, 2, "gmatch")
+	ms := newMatchState(state.(*State), s, pat)
+	src, lastMatch := 0, -1
+	iter := func(_ api.State, _ ...interface{}) []interface{} {
+		for ; src <= len(s); src++ {
+			ms.reset()
+			if e := ms.match(src, 0); e != -1 && e != lastMatch {
+				start := src
+				src, lastMatch = e, e
+				return ms.captures(start, e)
+			}
+		}
+		return []interface{}{nil}
+	}
+	return []interface{}{newGoClosure(iter)}
+}
+
+// string.gsub (s, pattern, repl [, n])
+func strGsub(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	src := checkString(args, 1, "gsub")
+	pat := checkString(args, 2, "gsub")
+	repl := argAt(args, 3)
+	switch typeOf(repl) {
+	case LUA_TNUMBER, LUA_TSTRING, LUA_TTABLE, LUA_TFUNCTION:
+	default:
+		argError(3, "gsub", "string/function/table expected")
+	}
+	maxN := optInteger(args, 4, "gsub", len(src)+1)
+	anchor := strings.HasPrefix(pat, "^")
+	if anchor {
+		pat = pat[1:]
+	}
+	ms := newMatchState(vm, src, pat)
+	vm.allocPending(stringSize(len(src))) // 未被替换的部分, 替换值在写入时计入
+	var b strings.Builder
+	s, lastMatch, n := 0, -1, 0
+	for n < maxN {
+		ms.reset()
+		if e := ms.match(s, 0); e != -1 && e != lastMatch {
+			n++
+			r := vm.gsubValue(ms, repl, s, e)
+			vm.allocPending(len(r))
+			b.WriteString(r)
+			s, lastMatch = e, e
+		} else if s < len(src) {
+			b.WriteByte(src[s])
+			s++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(src[s:])
+	return []interface{}{b.String(), n}
+}
+
+// gsubValue 匹配[s, e)的替换结果
+func (vm *State) gsubValue(ms *matchState, repl luaValue, s, e int) string {
+	var v luaValue
+	switch x := repl.(type) {
+	case LuaTable:
+		v = vm.index(x, ms.getCapture(0, s, e))
+	case *closure:
+		v = _first(vm.callValue(x, ms.captures(s, e)))
+	default: // string或者number
+		r, _ := toString(x)
+		return gsubString(ms, r, s, e)
+	}
+	if !toBool(v) { // nil或者false时保留原始内容
+		return ms.src[s:e]
+	}
+	if r, ok := toString(v); ok {
+		return r
+	}
+	panic(fmt.Sprintf("invalid replacement value (a %s)", typeName(typeOf(v))))
+}
+
+// gsubString 替换字符串中 %0-%9 为对应的捕获, %% 为 %
+func gsubString(ms *matchState, repl string, s, e int) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		if repl[i] != patEsc {
+			b.WriteByte(repl[i])
+			continue
+		}
+		if i++; i < len(repl) && repl[i] == patEsc {
+			b.WriteByte(patEsc)
+		} else if i >= len(repl) || repl[i] < '0' || repl[i] > '9' {
+			panic("invalid use of '%' in replacement string")
+		} else if repl[i] == '0' {
+			b.WriteString(ms.src[s:e])
+		} else {
+			c, _ := toString(ms.getCapture(int(repl[i]-'1'), s, e))
+			b.WriteString(c)
+		}
+	}
+	return b.String()
+}
+
+// posRelat 将负数位置转换为正数位置(-1为最后一个字符), 越界的负数位置转换为0
+func posRelat(pos, l int) int {
+	if pos >= 0 {
+		return pos
+	} else if -pos > l {
+		return 0
+	}
+	return l + pos + 1
+}
+
+// strRange 将[i, j]转换为字符串中的有效区间(1 <= i, j <= l), i > j表示空区间
+func strRange(l, i, j int) (int, int) {
+	i, j = posRelat(i, l), posRelat(j, l)
+	if i < 1 {
+		i = 1
+	}
+	if j > l {
+		j = l
+	}
+	return i, j
+}
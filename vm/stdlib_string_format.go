@@ -0,0 +1,232 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	fmtFlags     = "-+ #0" // string.format支持的标记
+	fmtMaxDigits = 2       // 宽度和精度的最大位数
+)
+
+// string.format (formatstring, ···)
+// 转换说明符格式同C语言printf: %[flags][width][.precision]conversion
+func strFormat(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	format := checkString(args, 1, "format")
+	vm.allocPending(stringSize(len(format))) // 原样输出的部分, 转换的结果在写入之前计入
+	var b strings.Builder
+	arg := 1
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		if i++; i < len(format) && format[i] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		spec := scanFormatSpec(format[i:])
+		i += len(spec.text)
+		if i >= len(format) {
+			panic("invalid option '%' to 'format'")
+		}
+		if arg++; arg > len(args) {
+			argError(arg, "format", "no value")
+		}
+		s := vm.formatArg(args, arg, spec, format[i])
+		vm.allocPending(len(s))
+		b.WriteString(s)
+	}
+	return []interface{}{b.String()}
+}
+
+// formatSpec 转换说明符中'%'与转换字符之间的部分
+type formatSpec struct {
+	text      string // 原始文本, 如 "-08.3"
+	flags     string
+	width     int
+	precision int // 未指定时为-1
+}
+
+func (spec formatSpec) has(flag byte) bool {
+	return strings.IndexByte(spec.flags, flag) >= 0
+}
+
+// scanFormatSpec 解析flags, width和precision(同lstrlib的scanformat)
+func scanFormatSpec(s string) formatSpec {
+	spec := formatSpec{precision: -1}
+	i := 0
+	for i < len(s) && strings.IndexByte(fmtFlags, s[i]) >= 0 {
+		i++
+	}
+	if i > len(fmtFlags) {
+		panic("invalid format (repeated flags)")
+	}
+	spec.flags = s[:i]
+	digits := func() int {
+		n, start := 0, i
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			if i-start >= fmtMaxDigits {
+				panic("invalid format (width or precision too long)")
+			}
+			n = n*10 + int(s[i]-'0')
+			i++
+		}
+		return n
+	}
+	spec.width = digits()
+	if i < len(s) && s[i] == '.' {
+		i++
+		spec.precision = digits()
+	}
+	spec.text = s[:i]
+	return spec
+}
+
+// formatArg 按照转换字符conv格式化第n个参数
+func (vm *State) formatArg(args []luaValue, n int, spec formatSpec, conv byte) string {
+	switch conv {
+	case 'c':
+		return spec.pad(string([]byte{byte(checkInteger(args, n, "format"))}))
+	case 'd', 'i':
+		return fmt.Sprintf(spec.goFormat(spec.flags, 'd'), checkInteger(args, n, "format"))
+	case 'u', 'o', 'x', 'X':
+		if conv == 'u' {
+			conv = 'd'
+		}
+		// 按照无符号整数格式化, 忽略符号标记
+		flags := strings.NewReplacer("+", "", " ", "").Replace(spec.flags)
+		return fmt.Sprintf(spec.goFormat(flags, conv), uint64(checkInteger(args, n, "format")))
+	case 'a', 'A', 'e', 'E', 'f', 'g', 'G':
+		return spec.formatFloat(checkNumber(args, n, "format"), conv)
+	case 'q': // 保证读回时值不变, 浮点数使用十六进制格式
+		return vm.quoteValue(args, n)
+	case 's':
+		s := vm.tostring(args[n-1])
+		if spec.precision >= 0 && spec.precision < len(s) {
+			s = s[:spec.precision]
+		}
+		return spec.pad(s)
+	default:
+		panic("invalid option '%" + string(conv) + "' to 'format'")
+	}
+}
+
+// goFormat 生成对应的go格式化字符串
+func (spec formatSpec) goFormat(flags string, verb byte) string {
+	f := "%" + flags
+	if spec.width > 0 {
+		f += strconv.Itoa(spec.width)
+	}
+	if spec.precision >= 0 {
+		f += "." + strconv.Itoa(spec.precision)
+	}
+	return f + string(verb)
+}
+
+// pad 按字节数(而不是go的rune数)填充空格到指定宽度
+func (spec formatSpec) pad(s string) string {
+	if n := spec.width - len(s); n > 0 {
+		if spec.has('-') {
+			return s + strings.Repeat(" ", n)
+		}
+		return strings.Repeat(" ", n) + s
+	}
+	return s
+}
+
+var hexExponent = regexp.MustCompile(`([pP][+-])0+(\d)`)
+
+// formatFloat 格式化浮点数, inf/nan和%a的输出与C语言保持一致
+func (spec formatSpec) formatFloat(f float64, conv byte) string {
+	upper := conv == 'A' || conv == 'E' || conv == 'G'
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		s := "inf"
+		if math.IsNaN(f) {
+			s = "nan"
+		}
+		if math.Signbit(f) {
+			s = "-" + s
+		} else if spec.has('+') {
+			s = "+" + s
+		} else if spec.has(' ') {
+			s = " " + s
+		}
+		if upper {
+			s = strings.ToUpper(s)
+		}
+		return spec.pad(s)
+	}
+	switch conv {
+	case 'a', 'A':
+		// go的十六进制指数至少两位(0x1p+00), C为0x1p+0; 去掉宽度格式化后再填充
+		verb := byte('x')
+		if upper {
+			verb = 'X'
+		}
+		noWidth := spec
+		noWidth.width = 0
+		s := hexExponent.ReplaceAllString(fmt.Sprintf(noWidth.goFormat(strings.ReplaceAll(spec.flags, "0", ""), verb), f), "$1$2")
+		if n := spec.width - len(s); n > 0 && spec.has('0') && !spec.has('-') {
+			i := strings.IndexAny(s, "xX") + 1 // 在"0x"之后填充0
+			return s[:i] + strings.Repeat("0", n) + s[i:]
+		}
+		return spec.pad(s)
+	case 'g', 'G':
+		// go的%g默认使用最短表示, C默认精度为6
+		if spec.precision < 0 {
+			spec.precision = 6
+		}
+	}
+	return fmt.Sprintf(spec.goFormat(spec.flags, conv), f)
+}
+
+// quoteValue %q: 生成可以被lua读回的字面量
+func (vm *State) quoteValue(args []luaValue, n int) string {
+	switch x := args[n-1].(type) {
+	case string:
+		return quoteString(x)
+	case int:
+		if x == math.MinInt64 {
+			return fmt.Sprintf("0x%x", uint64(x))
+		}
+		return strconv.Itoa(x)
+	case float64:
+		return formatSpec{precision: -1}.formatFloat(x, 'a')
+	case nil, bool:
+		return vm.tostring(x)
+	}
+	argError(n, "format", "value has no literal form")
+	return ""
+}
+
+// quoteString 同lstrlib的addquoted
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString("\\\n")
+		case c < 0x20 || c == 0x7f:
+			if i+1 < len(s) && s[i+1] >= '0' && s[i+1] <= '9' {
+				fmt.Fprintf(&b, "\\%03d", c)
+			} else {
+				fmt.Fprintf(&b, "\\%d", c)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,363 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"math"
+	"strings"
+	"unsafe"
+)
+
+// string.pack/unpack/packsize (同lstrlib), 二进制格式中各类型的大小与64位C实现保持一致
+
+const (
+	packPadByte = 0x00 // 填充字节
+	maxIntSize  = 16   // 整数二进制表示的最大字节数
+	sizeInt     = 8    // lua整数的字节数
+	maxAlign    = 8    // 默认最大对齐
+)
+
+// nativeLittle 本机是否为小端字节序
+var nativeLittle = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+type packOption int
+
+const (
+	kInt       packOption = iota // 有符号整数
+	kUint                        // 无符号整数
+	kFloat                       // 浮点数
+	kChar                        // 固定长度字符串
+	kString                      // 带长度前缀的字符串
+	kZstr                        // 以'\0'结尾的字符串
+	kPadding                     // 填充
+	kPaddAlign                   // 对齐填充
+	kNop                         // 无操作(配置或者空格)
+)
+
+// packHeader 解析格式字符串的状态
+type packHeader struct {
+	fname    string
+	fmt      string
+	pos      int // 格式字符串中的当前位置
+	little   bool
+	maxAlign int
+}
+
+func newPackHeader(fname, fmt string) *packHeader {
+	return &packHeader{fname: fname, fmt: fmt, little: nativeLittle, maxAlign: 1}
+}
+
+func (h *packHeader) more() bool {
+	return h.pos < len(h.fmt)
+}
+
+// getNum 读取格式中的数字, 没有数字时返回默认值df
+func (h *packHeader) getNum(df int) int {
+	if !h.more() || !isDigit(h.fmt[h.pos]) {
+		return df
+	}
+	a := 0
+	for {
+		a = a*10 + int(h.fmt[h.pos]-'0')
+		h.pos++
+		if !h.more() || !isDigit(h.fmt[h.pos]) || a > (maxStringSize-9)/10 {
+			return a
+		}
+	}
+}
+
+// getNumLimit 读取整数大小, 超出[1, maxIntSize]时抛出错误
+func (h *packHeader) getNumLimit(df int) int {
+	sz := h.getNum(df)
+	if sz > maxIntSize || sz <= 0 {
+		panic(fmt.Sprintf("integral size (%d) out of limits [1,%d]", sz, maxIntSize))
+	}
+	return sz
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// getOption 读取下一个选项及其大小
+func (h *packHeader) getOption() (packOption, int) {
+	opt := h.fmt[h.pos]
+	h.pos++
+	switch opt {
+	case 'b':
+		return kInt, 1
+	case 'B':
+		return kUint, 1
+	case 'h':
+		return kInt, 2
+	case 'H':
+		return kUint, 2
+	case 'l', 'j':
+		return kInt, 8
+	case 'L', 'J', 'T':
+		return kUint, 8
+	case 'f':
+		return kFloat, 4
+	case 'd', 'n':
+		return kFloat, 8
+	case 'i':
+		return kInt, h.getNumLimit(4)
+	case 'I':
+		return kUint, h.getNumLimit(4)
+	case 's':
+		return kString, h.getNumLimit(8)
+	case 'c':
+		size := h.getNum(-1)
+		if size == -1 {
+			panic("missing size for format option 'c'")
+		}
+		return kChar, size
+	case 'z':
+		return kZstr, 0
+	case 'x':
+		return kPadding, 1
+	case 'X':
+		return kPaddAlign, 0
+	case ' ':
+	case '<':
+		h.little = true
+	case '>':
+		h.little = false
+	case '=':
+		h.little = nativeLittle
+	case '!':
+		h.maxAlign = h.getNumLimit(maxAlign)
+	default:
+		panic(fmt.Sprintf("invalid format option '%c'", opt))
+	}
+	return kNop, 0
+}
+
+// getDetails 读取下一个选项, 同时计算totalSize之后需要对齐的字节数
+func (h *packHeader) getDetails(totalSize int) (opt packOption, size, nToAlign int) {
+	opt, size = h.getOption()
+	align := size          // 通常按照大小对齐
+	if opt == kPaddAlign { // 'X'按照下一个选项对齐
+		if !h.more() {
+			argError(1, h.fname, "invalid next option for option 'X'")
+		}
+		var next packOption
+		if next, align = h.getOption(); next == kChar || align == 0 {
+			argError(1, h.fname, "invalid next option for option 'X'")
+		}
+	}
+	if align <= 1 || opt == kChar {
+		return opt, size, 0
+	}
+	if align > h.maxAlign {
+		align = h.maxAlign
+	}
+	if align&(align-1) != 0 {
+		argError(1, h.fname, "format asks for alignment not power of 2")
+	}
+	return opt, size, (align - totalSize&(align-1)) & (align - 1)
+}
+
+// packInt 按照字节序写入size字节的整数, 超过8字节时负数需要符号扩展
+func packInt(b *strings.Builder, n uint64, little bool, size int, neg bool) {
+	buf := make([]byte, size)
+	for i := 0; i < size; i++ {
+		var c byte
+		if i < sizeInt {
+			c = byte(n >> (8 * i))
+		} else if neg {
+			c = 0xff
+		}
+		if little {
+			buf[i] = c
+		} else {
+			buf[size-1-i] = c
+		}
+	}
+	b.Write(buf)
+}
+
+// unpackInt 读取size字节的整数, 小于8字节的有符号整数需要符号扩展, 超过8字节时检查溢出
+func unpackInt(data string, little bool, size int, signed bool) int {
+	at := func(i int) byte {
+		if little {
+			return data[i]
+		}
+		return data[size-1-i]
+	}
+	var res uint64
+	limit := size
+	if limit > sizeInt {
+		limit = sizeInt
+	}
+	for i := limit - 1; i >= 0; i-- {
+		res = res<<8 | uint64(at(i))
+	}
+	if size < sizeInt {
+		if signed {
+			mask := uint64(1) << (size*8 - 1)
+			res = (res ^ mask) - mask
+		}
+	} else if size > sizeInt {
+		var mask byte
+		if signed && int64(res) < 0 {
+			mask = 0xff
+		}
+		for i := limit; i < size; i++ {
+			if at(i) != mask {
+				panic(fmt.Sprintf("%d-byte integer does not fit into Lua Integer", size))
+			}
+		}
+	}
+	return int(res)
+}
+
+// packFloat 按照字节序写入浮点数
+func packFloat(b *strings.Builder, n float64, little bool, size int) {
+	var bits uint64
+	if size == 4 {
+		bits = uint64(math.Float32bits(float32(n)))
+	} else {
+		bits = math.Float64bits(n)
+	}
+	packInt(b, bits, little, size, false)
+}
+
+func unpackFloat(data string, little bool, size int) float64 {
+	bits := uint64(unpackInt(data, little, size, false))
+	if size == 4 {
+		return float64(math.Float32frombits(uint32(bits)))
+	}
+	return math.Float64frombits(bits)
+}
+
+// string.pack (fmt, v1, v2, ···)
+// 每个选项写入之前计入内存统计, 避免超过上限时生成很大的结果(如 "c1000000000")
+func strPack(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	h := newPackHeader("pack", checkString(args, 1, "pack"))
+	vm.allocPending(stringOverhead)
+	var b strings.Builder
+	arg := 1
+	for h.more() {
+		opt, size, nToAlign := h.getDetails(b.Len())
+		vm.allocPending(nToAlign + size)
+		for ; nToAlign > 0; nToAlign-- {
+			b.WriteByte(packPadByte)
+		}
+		arg++
+		switch opt {
+		case kInt:
+			n := checkInteger(args, arg, "pack")
+			if size < sizeInt {
+				lim := 1 << (size*8 - 1)
+				if n < -lim || n >= lim {
+					argError(arg, "pack", "integer overflow")
+				}
+			}
+			packInt(&b, uint64(n), h.little, size, n < 0)
+		case kUint:
+			n := checkInteger(args, arg, "pack")
+			if size < sizeInt && uint64(n) >= uint64(1)<<(size*8) {
+				argError(arg, "pack", "unsigned overflow")
+			}
+			packInt(&b, uint64(n), h.little, size, false)
+		case kFloat:
+			packFloat(&b, checkNumber(args, arg, "pack"), h.little, size)
+		case kChar:
+			s := checkString(args, arg, "pack")
+			if len(s) > size {
+				argError(arg, "pack", "string longer than given size")
+			}
+			b.WriteString(s)
+			for i := len(s); i < size; i++ {
+				b.WriteByte(packPadByte)
+			}
+		case kString:
+			s := checkString(args, arg, "pack")
+			if size < sizeInt && uint64(len(s)) >= uint64(1)<<(size*8) {
+				argError(arg, "pack", "string length does not fit in given size")
+			}
+			vm.allocPending(len(s))
+			packInt(&b, uint64(len(s)), h.little, size, false)
+			b.WriteString(s)
+		case kZstr:
+			s := checkString(args, arg, "pack")
+			if strings.IndexByte(s, 0) >= 0 {
+				argError(arg, "pack", "string contains zeros")
+			}
+			vm.allocPending(len(s) + 1)
+			b.WriteString(s)
+			b.WriteByte(0)
+		case kPadding:
+			b.WriteByte(packPadByte)
+			arg--
+		default: // kPaddAlign, kNop
+			arg--
+		}
+	}
+	return []interface{}{b.String()}
+}
+
+// string.packsize (fmt)
+func strPacksize(_ api.State, args ...interface{}) []interface{} {
+	h := newPackHeader("packsize", checkString(args, 1, "packsize"))
+	totalSize := 0
+	for h.more() {
+		opt, size, nToAlign := h.getDetails(totalSize)
+		size += nToAlign
+		if totalSize > maxStringSize-size {
+			argError(1, "packsize", "format result too large")
+		}
+		totalSize += size
+		if opt == kString || opt == kZstr {
+			argError(1, "packsize", "variable-length format")
+		}
+	}
+	return []interface{}{totalSize}
+}
+
+// string.unpack (fmt, s [, pos])
+func strUnpack(_ api.State, args ...interface{}) []interface{} {
+	h := newPackHeader("unpack", checkString(args, 1, "unpack"))
+	data := checkString(args, 2, "unpack")
+	pos := posRelat(optInteger(args, 3, "unpack", 1), len(data)) - 1
+	if pos < 0 || pos > len(data) {
+		argError(3, "unpack", "initial position out of string")
+	}
+	var results []interface{}
+	for h.more() {
+		opt, size, nToAlign := h.getDetails(pos)
+		if nToAlign+size > len(data)-pos {
+			argError(2, "unpack", "data string too short")
+		}
+		pos += nToAlign
+		switch opt {
+		case kInt, kUint:
+			results = append(results, unpackInt(data[pos:], h.little, size, opt == kInt))
+		case kFloat:
+			results = append(results, unpackFloat(data[pos:], h.little, size))
+		case kChar:
+			results = append(results, data[pos:pos+size])
+		case kString:
+			l := uint64(unpackInt(data[pos:], h.little, size, false))
+			if l > uint64(len(data)-pos-size) {
+				argError(2, "unpack", "data string too short")
+			}
+			results = append(results, data[pos+size:pos+size+int(l)])
+			pos += int(l)
+		case kZstr:
+			l := strings.IndexByte(data[pos:], 0)
+			if l < 0 {
+				l = len(data) - pos
+			}
+			results = append(results, data[pos:pos+l])
+			pos += l + 1
+		}
+		pos += size
+	}
+	return append(results, pos+1)
+}
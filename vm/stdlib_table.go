@@ -0,0 +1,321 @@
+package vm
+
+import (
+	"fmt"
+	"luago/vm/api"
+	"math"
+	"strings"
+	"time"
+)
+
+var tabFuncs = map[string]api.GoFunc{
+	"concat": tabConcat,
+	"insert": tabInsert,
+	"move":   tabMove,
+	"pack":   tabPack,
+	"remove": tabRemove,
+	"sort":   tabSort,
+	"unpack": tabUnpack,
+}
+
+// openTableLib 注册table库
+func openTableLib(vm *State) {
+	vm.global.Put("table", newLib(tabFuncs))
+}
+
+// 表操作需要的元方法, table以外的值必须有对应的元方法才能作为参数
+const (
+	tabR = 1 << iota // __index
+	tabW             // __newindex
+	tabL             // __len
+)
+
+// checkTab 第n个参数必须是table, 或者元表中有what要求的元方法
+func (vm *State) checkTab(args []luaValue, n int, fname string, what int) luaValue {
+	t := argAt(args, n)
+	if _, ok := t.(LuaTable); ok {
+		return t
+	}
+	if mt := vm.getMetatable(t); mt != nil &&
+		(what&tabR == 0 || mt.Get("__index") != nil) &&
+		(what&tabW == 0 || mt.Get("__newindex") != nil) &&
+		(what&tabL == 0 || mt.Get("__len") != nil) {
+		return t
+	}
+	typeError(args, n, fname, "table")
+	return nil
+}
+
+// lenInt 长度运算(可能调用元方法 __len), 结果必须是整数
+func (vm *State) lenInt(v luaValue) int {
+	if n, ok := toInteger(vm.length(v)); ok {
+		return n
+	}
+	panic("object length is not an integer")
+}
+
+// table.concat (list [, sep [, i [, j]]])
+func tabConcat(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	t := vm.checkTab(args, 1, "concat", tabR|tabL)
+	sep := optString(args, 2, "concat", "")
+	i := optInteger(args, 3, "concat", 1)
+	var j int
+	if argAt(args, 4) == nil {
+		j = vm.lenInt(t)
+	} else {
+		j = checkInteger(args, 4, "concat")
+	}
+	var strs []string
+	n := 0
+	for ; i <= j; i++ {
+		v := vm.index(t, i)
+		s, ok := toString(v)
+		if !ok {
+			panic(fmt.Sprintf("invalid value (%s) at index %d in table for 'concat'", _userTypeName(v), i))
+		}
+		strs = append(strs, s)
+		n += len(s)
+		if i != j {
+			n += len(sep)
+		}
+		if i == math.MaxInt64 { // 避免i++溢出
+			break
+		}
+	}
+	vm.allocMem(stringSize(n))
+	return []interface{}{strings.Join(strs, sep)}
+}
+
+// table.insert (list, [pos,] value)
+func tabInsert(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	t := vm.checkTab(args, 1, "insert", tabR|tabW|tabL)
+	e := vm.lenInt(t) + 1 // 第一个空位置
+	var pos int
+	switch len(args) {
+	case 2:
+		pos = e
+	case 3:
+		pos = checkInteger(args, 2, "insert")
+		if uint64(pos)-1 >= uint64(e) { // 检查 1 <= pos <= e
+			argError(2, "insert", "position out of bounds")
+		}
+		for i := e; i > pos; i-- { // 后移元素
+			vm.setIndex(t, i, vm.index(t, i-1))
+		}
+	default:
+		panic("wrong number of arguments to 'insert'")
+	}
+	vm.setIndex(t, pos, args[len(args)-1])
+	return nil
+}
+
+// table.remove (list [, pos])
+func tabRemove(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	t := vm.checkTab(args, 1, "remove", tabR|tabW|tabL)
+	size := vm.lenInt(t)
+	pos := optInteger(args, 2, "remove", size)
+	if pos != size && uint64(pos)-1 > uint64(size) { // 检查 1 <= pos <= size+1
+		argError(1, "remove", "position out of bounds")
+	}
+	v := vm.index(t, pos)
+	for ; pos < size; pos++ { // 前移元素
+		vm.setIndex(t, pos, vm.index(t, pos+1))
+	}
+	vm.setIndex(t, pos, nil)
+	return []interface{}{v}
+}
+
+// table.move (a1, f, e, t [,a2])
+func tabMove(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	a1 := vm.checkTab(args, 1, "move", tabR)
+	f := checkInteger(args, 2, "move")
+	e := checkInteger(args, 3, "move")
+	t := checkInteger(args, 4, "move")
+	a2 := a1
+	if argAt(args, 5) != nil {
+		a2 = vm.checkTab(args, 5, "move", tabW)
+	}
+	if e >= f {
+		if f <= 0 && e >= math.MaxInt64+f {
+			argError(3, "move", "too many elements to move")
+		}
+		n := e - f // 需要移动的元素数量-1
+		if t > math.MaxInt64-n {
+			argError(4, "move", "destination wrap around")
+		}
+		if t > e || t <= f || (len(args) >= 5 && !vm.compareEq(a1, a2)) {
+			for i := 0; i <= n; i++ {
+				vm.setIndex(a2, t+i, vm.index(a1, f+i))
+			}
+		} else { // 目标区间与源区间重叠, 从后向前复制
+			for i := n; i >= 0; i-- {
+				vm.setIndex(a2, t+i, vm.index(a1, f+i))
+			}
+		}
+	}
+	return []interface{}{a2}
+}
+
+// table.pack (···)
+func tabPack(_ api.State, args ...interface{}) []interface{} {
+	t := newLuaTable(len(args), 1)
+	for i, arg := range args {
+		t.Put(i+1, arg)
+	}
+	t.Put("n", len(args))
+	return []interface{}{t}
+}
+
+// table.unpack (list [, i [, j]])
+func tabUnpack(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	t := argAt(args, 1)
+	i := optInteger(args, 2, "unpack", 1)
+	var j int
+	if argAt(args, 3) == nil {
+		j = vm.lenInt(t)
+	} else {
+		j = checkInteger(args, 3, "unpack")
+	}
+	if i > j {
+		return nil
+	}
+	if n := uint64(j) - uint64(i); n >= api.LUAI_MAXSTACK { // 结果数量超过栈的限制
+		panic("too many results to unpack")
+	}
+	results := make([]interface{}, 0, j-i+1)
+	for ; i < j; i++ {
+		results = append(results, vm.index(t, i))
+	}
+	return append(results, vm.index(t, j))
+}
+
+// table.sort (list [, comp])
+func tabSort(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	s := &sorter{vm: vm, t: vm.checkTab(args, 1, "sort", tabR|tabW|tabL)}
+	if n := vm.lenInt(s.t); n > 1 {
+		if n >= math.MaxInt32 {
+			argError(1, "sort", "array too big")
+		}
+		if s.comp = argAt(args, 2); s.comp != nil {
+			if _, ok := s.comp.(*closure); !ok {
+				typeError(args, 2, "sort", "function")
+			}
+		}
+		s.sort(1, n, 0)
+	}
+	return nil
+}
+
+// sortRanLimit 区间大于该值时随机选择主元
+const sortRanLimit = 100
+
+// sorter 同ltablib的快速排序, 通过lua比较函数或者 < 运算比较元素
+type sorter struct {
+	vm   *State
+	t    luaValue
+	comp luaValue
+}
+
+func (s *sorter) get(i int) luaValue {
+	return s.vm.index(s.t, i)
+}
+
+func (s *sorter) set(i int, v luaValue) {
+	s.vm.setIndex(s.t, i, v)
+}
+
+func (s *sorter) less(a, b luaValue) bool {
+	s.vm.charge(1)
+	if s.comp == nil {
+		lt, err := s.vm.compareLt(a, b)
+		if err != nil {
+			panic(err.Error())
+		}
+		return lt
+	}
+	return toBool(_first(s.vm.callValue(s.comp, []luaValue{a, b})))
+}
+
+// partition 以主元p(位于up-1)划分区间[lo, up], 返回主元的最终位置
+// 比较函数不满足严格弱序时可能越界, 此时抛出错误
+func (s *sorter) partition(lo, up int, p luaValue) int {
+	i, j := lo, up-1
+	for {
+		var ai, aj luaValue
+		for i++; ; i++ { // a[i] < P 时继续
+			if ai = s.get(i); !s.less(ai, p) {
+				break
+			}
+			if i == up-1 { // a[up-1] == P, 不可能 a[up-1] < P
+				panic("invalid order function for sorting")
+			}
+		}
+		for j--; ; j-- { // P < a[j] 时继续
+			if aj = s.get(j); !s.less(p, aj) {
+				break
+			}
+			if j < i { // a[i] >= P, 不可能 j < i 并且 P < a[j]
+				panic("invalid order function for sorting")
+			}
+		}
+		if j < i { // 划分结束, 将主元交换到位置i
+			s.set(up-1, ai)
+			s.set(i, p)
+			return i
+		}
+		s.set(i, aj)
+		s.set(j, ai)
+	}
+}
+
+// sort 排序区间[lo, up], rnd不为0时用于随机选择主元
+func (s *sorter) sort(lo, up int, rnd uint) {
+	for lo < up { // 循环代替尾递归
+		// 排序 a[lo], a[p], a[up]
+		if alo, aup := s.get(lo), s.get(up); s.less(aup, alo) {
+			s.set(lo, aup)
+			s.set(up, alo)
+		}
+		if up-lo == 1 {
+			break
+		}
+		p := (lo + up) / 2
+		if up-lo >= sortRanLimit && rnd != 0 {
+			r4 := uint(up-lo) / 4
+			p = int(rnd%(r4*2)) + lo + int(r4)
+		}
+		if ap, alo := s.get(p), s.get(lo); s.less(ap, alo) {
+			s.set(p, alo)
+			s.set(lo, ap)
+		} else if aup := s.get(up); s.less(aup, ap) {
+			s.set(p, aup)
+			s.set(up, ap)
+		}
+		if up-lo == 2 {
+			break
+		}
+		pivot := s.get(p)
+		s.set(p, s.get(up-1))
+		s.set(up-1, pivot)
+		p = s.partition(lo, up, pivot)
+		var n int
+		if p-lo < up-p { // 递归排序较短的区间
+			s.sort(lo, p-1, rnd)
+			n = p - lo
+			lo = p + 1
+		} else {
+			s.sort(p+1, up, rnd)
+			n = up - p
+			up = p - 1
+		}
+		if (up-lo)/128 > n { // 划分过于不平衡, 重新随机化
+			rnd = uint(time.Now().UnixNano())
+		}
+	}
+}
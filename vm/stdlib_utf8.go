@@ -0,0 +1,226 @@
+package vm
+
+import (
+	"luago/vm/api"
+	"strings"
+)
+
+var utf8Funcs = map[string]api.GoFunc{
+	"char":      utf8Char,
+	"codepoint": utf8Codepoint,
+	"codes":     utf8Codes,
+	"len":       utf8Len,
+	"offset":    utf8Offset,
+}
+
+const (
+	maxUnicode  = 0x10FFFF
+	utf8Pattern = "[\x00-\x7F\xC2-\xF4][\x80-\xBF]*" // 匹配单个utf8字符的模式
+)
+
+// openUtf8Lib 注册utf8库
+// 与go的unicode/utf8不同, 代理对(U+D800-U+DFFF)被视为有效字符(同lutf8lib)
+func openUtf8Lib(vm *State) {
+	lib := newLib(utf8Funcs)
+	lib.Put("charpattern", utf8Pattern)
+	vm.global.Put("utf8", lib)
+}
+
+// isCont s[i]是否为utf8的后续字节, 越界时视为'\0'
+func isCont(s string, i int) bool {
+	return i < len(s) && s[i]&0xC0 == 0x80
+}
+
+// utf8Decode 解码s[i]开始的utf8字符, 返回码点和下一个字符的位置, 无效时返回-1
+func utf8Decode(s string, i int) (rune, int) {
+	limits := [...]rune{0xFF, 0x7F, 0x7FF, 0xFFFF}
+	c := rune(s[i])
+	if c < 0x80 {
+		return c, i + 1
+	}
+	var res rune
+	count := 0
+	for ; c&0x40 != 0; c <<= 1 { // 首字节中每个1对应一个后续字节
+		count++
+		if !isCont(s, i+count) {
+			return 0, -1
+		}
+		res = res<<6 | rune(s[i+count]&0x3F)
+	}
+	res |= (c & 0x7F) << (count * 5)
+	if count > 3 || res > maxUnicode || res <= limits[count] {
+		return 0, -1
+	}
+	return res, i + count + 1
+}
+
+// utf8Encode 同lobject的luaO_utf8esc, 可以编码代理对
+func utf8Encode(b *strings.Builder, x int) {
+	if x < 0x80 {
+		b.WriteByte(byte(x))
+		return
+	}
+	var buf [8]byte
+	n := len(buf)
+	mfb := 0x3f // 首字节可以容纳的最大值
+	for {
+		n--
+		buf[n] = byte(0x80 | x&0x3f)
+		x >>= 6
+		mfb >>= 1
+		if x <= mfb {
+			break
+		}
+	}
+	n--
+	buf[n] = byte(^mfb<<1 | x)
+	b.Write(buf[n:])
+}
+
+// utf8Size utf8Encode编码x需要的字节数
+func utf8Size(x int) int {
+	if x < 0x80 {
+		return 1
+	}
+	n, mfb := 1, 0x3f
+	for {
+		n++
+		x >>= 6
+		mfb >>= 1
+		if x <= mfb {
+			return n
+		}
+	}
+}
+
+// utf8.char (···)
+func utf8Char(state api.State, args ...interface{}) []interface{} {
+	vm := state.(*State)
+	vm.allocPending(stringOverhead)
+	var b strings.Builder
+	for n := 1; n <= len(args); n++ {
+		code := checkInteger(args, n, "char")
+		if code < 0 || code > maxUnicode {
+			argError(n, "char", "value out of range")
+		}
+		vm.allocPending(utf8Size(code))
+		utf8Encode(&b, code)
+	}
+	return []interface{}{b.String()}
+}
+
+// utf8.codepoint (s [, i [, j]])
+func utf8Codepoint(_ api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "codepoint")
+	posi := posRelat(optInteger(args, 2, "codepoint", 1), len(s))
+	pose := posRelat(optInteger(args, 3, "codepoint", posi), len(s))
+	if posi < 1 {
+		argError(2, "codepoint", "out of range")
+	}
+	if pose > len(s) {
+		argError(3, "codepoint", "out of range")
+	}
+	if posi > pose {
+		return nil
+	}
+	if pose-posi >= api.LUAI_MAXSTACK {
+		panic("string slice too long")
+	}
+	var codes []interface{}
+	for i := posi - 1; i < pose; {
+		var code rune
+		if code, i = utf8Decode(s, i); i < 0 {
+			panic("invalid UTF-8 code")
+		}
+		codes = append(codes, int(code))
+	}
+	return codes
+}
+
+// utf8.len (s [, i [, j]])
+// 遇到无效的字节序列时返回 nil 和该位置
+func utf8Len(_ api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "len")
+	posi := posRelat(optInteger(args, 2, "len", 1), len(s))
+	posj := posRelat(optInteger(args, 3, "len", -1), len(s))
+	if posi--; posi < 0 || posi > len(s) {
+		argError(2, "len", "initial position out of string")
+	}
+	if posj--; posj >= len(s) {
+		argError(3, "len", "final position out of string")
+	}
+	n := 0
+	for posi <= posj {
+		_, next := utf8Decode(s, posi)
+		if next < 0 {
+			return []interface{}{nil, posi + 1}
+		}
+		posi = next
+		n++
+	}
+	return []interface{}{n}
+}
+
+// utf8.offset (s, n [, i])
+func utf8Offset(_ api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "offset")
+	n := checkInteger(args, 2, "offset")
+	posi := 1
+	if n < 0 {
+		posi = len(s) + 1
+	}
+	posi = posRelat(optInteger(args, 3, "offset", posi), len(s))
+	if posi--; posi < 0 || posi > len(s) {
+		argError(3, "offset", "position out of range")
+	}
+	if n == 0 { // 当前字符的起始位置
+		for posi > 0 && isCont(s, posi) {
+			posi--
+		}
+		return []interface{}{posi + 1}
+	}
+	if isCont(s, posi) {
+		panic("initial position is a continuation byte")
+	}
+	if n < 0 {
+		for ; n < 0 && posi > 0; n++ { // 向前移动
+			for posi--; posi > 0 && isCont(s, posi); posi-- {
+			}
+		}
+	} else {
+		for n--; n > 0 && posi < len(s); n-- { // 向后移动, 不移动第一个字符
+			for posi++; isCont(s, posi); posi++ {
+			}
+		}
+	}
+	if n == 0 {
+		return []interface{}{posi + 1}
+	}
+	return []interface{}{nil}
+}
+
+// utf8.codes (s)
+func utf8Codes(_ api.State, args ...interface{}) []interface{} {
+	checkString(args, 1, "codes")
+	return []interface{}{newGoClosure(utf8IterAux), args[0], 0}
+}
+
+// utf8IterAux utf8.codes的迭代函数, 控制变量为上一个字符的位置
+func utf8IterAux(_ api.State, args ...interface{}) []interface{} {
+	s := checkString(args, 1, "codes")
+	n, _ := toInteger(argAt(args, 2))
+	if n--; n < 0 { // 第一次迭代
+		n = 0
+	} else if n < len(s) { // 跳过当前字符
+		for n++; isCont(s, n); n++ {
+		}
+	}
+	if n >= len(s) {
+		return nil
+	}
+	code, next := utf8Decode(s, n)
+	if next < 0 || isCont(s, next) {
+		panic("invalid UTF-8 code")
+	}
+	return []interface{}{n + 1, int(code)}
+}
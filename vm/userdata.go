@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// UserData 完整userdata, 包装任意golang值交给lua使用, 每个userdata拥有独立的元表和user value
+type UserData struct {
+	Value     interface{} // 包装的golang值
+	meta      LuaTable    // 元表
+	userValue luaValue    // 关联的lua值
+}
+
+// LightUserData 轻量userdata, 仅表示一个不透明指针, 按指针值比较, 所有light userdata共享类型元表
+type LightUserData unsafe.Pointer
+
+// NewUserData 使用golang值v和元表mt(可以为nil)构造userdata
+func NewUserData(v interface{}, mt LuaTable) *UserData {
+	return &UserData{Value: v, meta: mt}
+}
+
+// Meta 获取元表, 未设置元表返回nil
+func (ud *UserData) Meta() LuaTable {
+	return ud.meta
+}
+
+// SetMeta 设置元表
+func (ud *UserData) SetMeta(mt LuaTable) {
+	ud.meta = mt
+}
+
+// UserValue 获取关联的lua值
+func (ud *UserData) UserValue() interface{} {
+	return ud.userValue
+}
+
+// SetUserValue 设置关联的lua值
+func (ud *UserData) SetUserValue(v interface{}) {
+	ud.userValue = v
+}
+
+// CheckUserData 检查第n个参数(从1开始)是否为包装了T类型值的userdata, 否则抛出参数错误
+func CheckUserData[T any](args []interface{}, n int) T {
+	var arg luaValue
+	if n <= len(args) {
+		arg = args[n-1]
+	}
+	if ud, ok := arg.(*UserData); ok {
+		if v, ok := ud.Value.(T); ok {
+			return v
+		}
+	}
+	expected := reflect.TypeOf((*T)(nil)).Elem()
+	panic(fmt.Sprintf("bad argument #%d (%s expected, got %s)", n, expected, _userTypeName(arg)))
+}
+
+// ToUserData 获取userdata包装的T类型值
+func ToUserData[T any](v interface{}) (T, bool) {
+	if ud, ok := v.(*UserData); ok {
+		t, ok := ud.Value.(T)
+		return t, ok
+	}
+	var zero T
+	return zero, false
+}
+
+// _userTypeName 类型名称, userdata优先使用元表中的 __name
+func _userTypeName(v luaValue) string {
+	if ud, ok := v.(*UserData); ok && ud.meta != nil {
+		if name, ok := ud.meta.Get("__name").(string); ok {
+			return name
+		}
+	}
+	return typeName(typeOf(v))
+}
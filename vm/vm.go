@@ -1,54 +1,149 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"io/fs"
 	"luago/chunk"
 	"luago/vm/api"
+	"math/rand"
+	"os"
+	"reflect"
+	"time"
 )
 
 // state lua虚拟机运行期各种状态
 type State struct {
 	stack   *stackFrame //虚拟机栈
+	main    *closure    //最近一次Load加载的主函数, 由Run运行
 	opcodes [LEN_OPCODE]opcode
 
-	global LuaTable              //全局变量
-	meta   map[luaValue]luaValue //元表
+	registry LuaTable                  //注册表
+	global   LuaTable                  //全局变量
+	metas    [LUA_NUMTAGS]LuaTable     //基础类型元表(table除外)
+	goMetas  map[reflect.Type]LuaTable //宿主类型元表
+
+	reflectMetas map[reflect.Type]LuaTable //反射包装为userdata的golang类型元表缓存
+
+	rand *rand.Rand //math.random使用的随机数生成器
+
+	clock        func() time.Time            //os.time/os.date/os.clock使用的时钟
+	startTime    time.Time                   //State创建的时间, os.clock返回此后经过的时间
+	getenv       func(string) (string, bool) //os.getenv使用的环境变量查询函数
+	allowFileOps bool                        //是否允许os.remove/os.rename/os.tmpname访问文件系统
+	allowExit    bool                        //是否允许os.exit结束进程
+	fs           FileSystem                  //io库和os库访问的文件系统
+	stdin        io.Reader                   //io.stdin和loadfile/dofile读取的标准输入
+	stdout       io.Writer                   //print和io.stdout写入的标准输出
+	stderr       io.Writer                   //io.stderr写入的标准错误输出
+	libs         Lib                         //NewState打开的标准库
+	policy       *SandboxPolicy              //沙箱策略, 为nil时不使用沙箱
+	sandbox      *luaTable                   //沙箱全局环境的模板, 包含策略允许的全局变量和只读库table
+	allowBinary  bool                        //是否允许加载二进制chunk
+	compiler     Compiler                    //加载lua源码使用的编译器, 为nil时只能加载二进制chunk
+	moduleFS     fs.FS                       //require加载模块文件使用的文件系统, 为nil时使用fs
+	goModules    map[string]api.GoFunc       //宿主注册的go模块
+	loading      map[string]bool             //正在加载的模块, 用于检测循环require
+
+	ctx       context.Context //RunContext/CallContext的ctx, 为nil时不检查中断
+	instLimit int             //每次RunContext/CallContext允许执行的指令数, 0表示不限制
+	steps     int             //本次RunContext/CallContext已经执行的指令数
+	nextCheck int             //下一次检查中断时的指令数
+
+	memUsed      int //统计的近似内存占用(字节)
+	memLimit     int //内存上限(字节), 0表示不限制
+	memAllocated int //上一次重新统计之后新分配的内存(字节)
+
+	hook          hookFunc //钩子函数, 为nil时不触发钩子
+	hookValue     luaValue //debug.sethook设置的lua钩子函数
+	hookMask      int      //触发钩子的事件掩码
+	baseHookCount int      //count事件的指令间隔
+	hookCount     int      //距离下一次count事件的剩余指令数
+	inHook        bool     //是否正在运行钩子函数
 }
 
 var _ api.State = api.State(&State{})
 
-// NewState new state
-func NewState() *State {
+// NewState new state, opts为可选的配置
+func NewState(opts ...Option) *State {
 	// 构造lua vm
 	vm := &State{
-		opcodes: opcodes,
-		global:  newLuaTable(0, 0),
-		meta:    make(map[luaValue]luaValue),
+		opcodes:  opcodes,
+		registry: newLuaTable(0, 0),
+		global:   newLuaTable(0, 0),
+		goMetas:  make(map[reflect.Type]LuaTable),
+
+		goModules: make(map[string]api.GoFunc),
+		loading:   make(map[string]bool),
+
+		reflectMetas: make(map[reflect.Type]LuaTable),
+
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+
+		clock:        time.Now,
+		getenv:       os.LookupEnv,
+		allowFileOps: true,
+		allowExit:    true,
+		fs:           OSFileSystem,
+		stdin:        os.Stdin,
+		stdout:       os.Stdout,
+		stderr:       os.Stderr,
+		libs:         AllLibs,
+		allowBinary:  true,
+	}
+	for _, opt := range opts {
+		opt(vm)
 	}
-	OpenLibs(vm) //注册基础库函数
+	vm.startTime = vm.clock()
+	vm.registry.Put(api.LUA_RIDX_MAINTHREAD, vm)
+	vm.registry.Put(api.LUA_RIDX_GLOBALS, vm.global)
+	vm.stack = newGoStackFrame(vm, nil, nil, nil) // 基础栈帧, 供宿主直接使用栈操作接口
+	OpenLibs(vm, vm.libs)                         //注册标准库
+	if vm.policy != nil {
+		vm.openSandbox(*vm.policy)
+	}
+	vm.collectMem() // 计入标准库占用的内存
 	return vm
 }
 
-// load state load binary chunk
-func (vm *State) Load(proto *chunk.Prototype) {
-	// 构造主函数
-	slots := make([]luaValue, proto.MaxStackSize, proto.MaxStackSize+20)
-	mainStack := newStackFrame(vm, slots, nil, newClosure(proto), nil)
-	// 初始化全局变量
-	if len(proto.Upvalues) > 0 {
-		var g luaValue = vm.global
-		mainStack.c.upvals[0] = updateValue{&g}
-	}
-	for i, uvInfo := range proto.Upvalues {
-		_ = i
-		_ = uvInfo
+// Load 加载函数原型, 返回主函数(lua函数值), 不改变虚拟机栈
+// 主函数可以通过Run, CallFunction或者栈操作接口多次调用, 也可以放入table或者传给lua
+// env为主函数的_ENV, 省略时为全局变量表
+func (vm *State) Load(proto *chunk.Prototype, env ...interface{}) interface{} {
+	c := vm.NewFunction(proto, env...).(*closure)
+	vm.main = c
+	return c
+}
+
+// NewFunction 同Load构造函数原型的主函数, 但是不改变Run运行的主函数, 如调试器编译执行的表达式
+func (vm *State) NewFunction(proto *chunk.Prototype, env ...interface{}) interface{} {
+	c := vm.newMainClosure(proto)
+	if len(env) > 0 && len(c.upvals) > 0 {
+		*c.upvals[0].val = env[0]
 	}
-	vm.stack = mainStack
+	return c
+}
+
+// Globals 全局变量表
+func (vm *State) Globals() LuaTable {
+	return vm.global
 }
 
 // Resister 实现golang函数注册到lua虚拟机
+// 使用沙箱时同时注册到沙箱环境模板, 之后 NewSandboxEnv 创建的环境都可以访问
 func (vm *State) Register(name string, f api.GoFunc) {
-	vm.global.Put(name, newGoClosure(f))
+	c := newGoClosure(f)
+	vm.global.Put(name, c)
+	if vm.sandbox != nil {
+		vm.sandbox.Put(name, c)
+	}
+}
+
+// RegisterModule 注册go实现的模块(代替C的luaopen_*函数), 脚本中require(name)时调用open(name)
+// open的第一个返回值作为模块的值, 没有返回值时模块的值为true
+func (vm *State) RegisterModule(name string, open api.GoFunc) {
+	vm.goModules[name] = open
 }
 
 // Fetch 获取下一条指令
@@ -59,10 +154,31 @@ func (vm *State) Fetch() Instruction {
 	return Instruction(i)
 }
 
-// pushStack 压入函数栈
+const (
+	LUAI_MAXCALLS  = 20000 // 嵌套调用的最大层数, 超过时抛出 "stack overflow"
+	LUAI_MAXCCALLS = 200   // 非CALL指令发起(元方法, go函数调用等)的嵌套调用的最大层数, 超过时抛出 "C stack overflow"
+)
+
+// pushStack 压入函数栈, 嵌套调用超过上限时抛出错误
+// 同lua, 出错的栈帧已经压入, 消息处理函数还可以使用额外的1/8层数, 再超过时抛出 LUA_ERRERR
 func (vm *State) pushStack(stack *stackFrame) {
-	stack.prev = vm.stack
+	prev := vm.stack
+	stack.prev = prev
+	if prev != nil {
+		stack.nCalls, stack.nCcalls = prev.nCalls+1, prev.nCcalls
+		if !prev.isCalling() {
+			stack.nCcalls++
+		}
+	}
 	vm.stack = stack
+	switch {
+	case stack.nCalls == LUAI_MAXCALLS:
+		panic(&LuaError{Value: vm.where(1) + "stack overflow", Status: api.LUA_ERRRUN})
+	case stack.nCcalls == LUAI_MAXCCALLS:
+		panic(&LuaError{Value: vm.where(1) + "C stack overflow", Status: api.LUA_ERRRUN})
+	case stack.nCalls >= LUAI_MAXCALLS+LUAI_MAXCALLS>>3, stack.nCcalls >= LUAI_MAXCCALLS+LUAI_MAXCCALLS>>3:
+		panic(&LuaError{Value: "error in error handling", Status: api.LUA_ERRERR})
+	}
 }
 
 // popStack 弹出函数栈
@@ -73,57 +189,145 @@ func (vm *State) popStack() *stackFrame {
 	return stack
 }
 
+// SetTypeMetatable 设置基础类型(table除外)共享的元表, mt为nil时移除
+func (vm *State) SetTypeMetatable(tp int, mt LuaTable) {
+	if tp == LUA_TTABLE || tp < 0 || tp >= LUA_NUMTAGS {
+		panic(fmt.Sprintf("can not set metatable for type '%s'", typeName(tp)))
+	}
+	vm.metas[tp] = mt
+}
+
+// SetGoTypeMetatable 设置宿主类型t的值在lua中使用的元表, mt为nil时移除
+func (vm *State) SetGoTypeMetatable(t reflect.Type, mt LuaTable) {
+	if mt == nil {
+		delete(vm.goMetas, t)
+	} else {
+		vm.goMetas[t] = mt
+	}
+}
+
+// getMetatable 获取任意lua变量的元表, 没有元表返回nil
+func (vm *State) getMetatable(val luaValue) LuaTable {
+	switch x := val.(type) {
+	case LuaTable:
+		return x.Meta()
+	case *UserData:
+		return x.Meta()
+	case nil, bool, int, int64, float64, string, *closure, LightUserData, *State:
+	default:
+		if mt, ok := vm.goMetas[reflect.TypeOf(x)]; ok {
+			return mt
+		}
+	}
+	return vm.metas[typeOf(val)]
+}
+
+// setMetatable 设置lua变量的元表, table为独立元表 其他类型共享元表
+func (vm *State) setMetatable(val luaValue, mt LuaTable) {
+	switch x := val.(type) {
+	case LuaTable:
+		x.SetMeta(mt)
+	case *UserData:
+		x.SetMeta(mt)
+	case nil, bool, int, int64, float64, string, *closure, LightUserData, *State:
+		vm.SetTypeMetatable(typeOf(val), mt)
+	default:
+		vm.SetGoTypeMetatable(reflect.TypeOf(val), mt)
+	}
+}
+
 // metaField 从元表获取元数据
 func (vm *State) metaField(val, field luaValue) luaValue {
-	if t, ok := val.(LuaTable); ok {
-		return t.Meta().Get(field)
+	if mt := vm.getMetatable(val); mt != nil {
+		return mt.Get(field)
 	}
-	return vm.meta[field]
+	return nil
 }
 func (vm *State) callMetaMethod(mmName string, a, b luaValue) (luaValue, bool) {
-	if m := vm.metaField(a, mmName); m != nil {
-		if mm, ok := m.(*closure); ok {
-			// vm.Push(mm)
-			return _callClosure(vm, mm, a, b)[0], true
-		}
+	m := vm.metaField(a, mmName)
+	if m == nil {
+		m = vm.metaField(b, mmName)
+	}
+	if mm, ok := m.(*closure); ok {
+		// vm.Push(mm)
+		return _first(_callClosure(vm, mm, a, b)), true
 	}
 	return nil, false
 }
+
+// MAXTAGLOOP __index/__newindex链的最大长度, 超过时认为存在循环
+const MAXTAGLOOP = 2000
+
 func (vm *State) getTable(t, field luaValue) (luaValue, bool) {
-	if tb, ok := t.(LuaTable); ok {
-		if v := tb.Get(field); v != nil {
-			return v, true
+	for loop := 0; loop < MAXTAGLOOP; loop++ {
+		if tb, ok := t.(LuaTable); ok {
+			if v := tb.Get(field); v != nil {
+				return v, true
+			}
 		}
-	}
-	mf := vm.metaField(t, "__index")
-	if mf != nil {
-		switch x := mf.(type) {
-		case luaTable:
-			return x.Get(field), true //此处不会递归调用元方法
-		case *closure:
-			// vm.Push(x)
-			return _callClosure(vm, x, t, field)[0], true
+		mf := vm.metaField(t, "__index")
+		if mf == nil {
+			_, ok := t.(LuaTable)
+			return nil, ok
 		}
+		if c, ok := mf.(*closure); ok {
+			// vm.Push(c)
+			return _first(_callClosure(vm, c, t, field)), true
+		}
+		t = mf // __index为table等其他值时重复索引过程
 	}
-	return nil, false
+	panic("'__index' chain too long; possible loop")
 }
 func (vm *State) setTable(t, field, value luaValue) bool {
-	mf := vm.metaField(t, "__newindex")
-	if tb, ok := t.(LuaTable); ok && mf == nil {
-		tb.Put(field, value)
-		return true
-	}
-	if mf != nil {
+	for loop := 0; loop < MAXTAGLOOP; loop++ {
+		tb, isTable := t.(LuaTable)
+		var mf luaValue
+		isNew := !isTable || tb.Get(field) == nil
+		if isNew { // 已存在的key直接赋值
+			mf = vm.metaField(t, "__newindex")
+		}
+		if isTable && mf == nil {
+			if isNew && value != nil {
+				vm.allocMem(tableEntrySize)
+			}
+			tb.Put(field, value)
+			return true
+		}
 		switch x := mf.(type) {
-		case luaTable:
-			return vm.setTable(x, field, value)
+		case LuaTable:
+			t = x // __newindex为table时对其重复赋值过程
 		case *closure:
 			// vm.Push(x)
 			_callClosure(vm, x, t, field, value)
 			return true
+		default:
+			return false
 		}
 	}
-	return false
+	panic("'__newindex' chain too long; possible loop")
+}
+
+// index 索引操作t[k], 可能调用元方法 __index, 无法索引时抛出错误
+func (vm *State) index(t, k luaValue) luaValue {
+	if v, ok := vm.getTable(t, k); ok {
+		return v
+	}
+	panic(fmt.Sprintf("attempt to index a %s value", typeName(typeOf(t))))
+}
+
+// setIndex 赋值操作t[k]=v, 可能调用元方法 __newindex, 无法索引时抛出错误
+func (vm *State) setIndex(t, k, v luaValue) {
+	if !vm.setTable(t, k, v) {
+		panic(fmt.Sprintf("attempt to index a %s value", typeName(typeOf(t))))
+	}
+}
+
+// _first 获取函数调用的第一个返回值
+func _first(results []luaValue) luaValue {
+	if len(results) > 0 {
+		return results[0]
+	}
+	return nil
 }
 
 func (vm *State) _stackLevel() int {
@@ -143,7 +347,16 @@ func (vm *State) _printStackLevel() {
 	}
 }
 
+// Run 运行最近一次Load加载的主函数, 可以重复运行
 func (vm *State) Run() {
+	if vm.main == nil {
+		panic("no lua chunk loaded")
+	}
+	vm.callValue(vm.main, nil)
+}
+
+// execute 执行当前栈帧的lua函数直到函数返回
+func (vm *State) execute() {
 	for {
 		// defer func() {
 		// 	if p := recover(); p != nil {
@@ -155,6 +368,12 @@ func (vm *State) Run() {
 		// vm._printStackLevel()
 		// fmt.Printf("run process count: %d\n", vm.stack.pc)
 		inst := vm.Fetch()
+		if vm.ctx != nil {
+			vm.charge(1)
+		}
+		if vm.hookMask&(maskLine|maskCount) != 0 {
+			vm.traceExec()
+		}
 		code := inst.Opcode()
 		vm.opcodes[code].action(inst, vm)
 		if code == OP_RETURN {
@@ -167,24 +386,41 @@ func (vm *State) Run() {
 func (vm *State) CallByParam(name string, args ...interface{}) ([]interface{}, error) {
 	if _f := vm.global.Get(name); _f == nil {
 		return []interface{}{}, fmt.Errorf("not a function: %s", name)
+	} else if _, ok := vm.callable(_f); !ok {
+		return nil, fmt.Errorf("attempt to call a %s value", typeName(typeOf(_f)))
 	} else {
-		var results []luaValue
-		callOk := false
-		if f, ok := _f.(*closure); ok {
-			results = _callClosure(vm, f, args...)
-			callOk = true
-		} else {
-			if mf := vm.metaField(_f, "__call"); mf != nil {
-				if f, ok := mf.(*closure); ok {
-					results = _callClosure(vm, f, append([]luaValue{_f}, args...)...)
-					callOk = true
-				}
-			}
-		}
-		if !callOk {
-			return results, fmt.Errorf("attempt to call a %T value", _f)
-		} else {
-			return results, nil
-		}
+		return vm.callValue(_f, args), nil
+	}
+}
+
+// CallFunction 以保护模式调用函数f(Load返回的主函数, ToValue获取的lua函数等), 返回f的所有返回值
+// 运行时错误以*LuaError返回
+func (vm *State) CallFunction(f interface{}, args ...interface{}) ([]interface{}, error) {
+	results, err := vm.pcall(f, args, nil)
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// callable 获取可调用的闭包(函数本身或者元方法 __call)
+func (vm *State) callable(f luaValue) (*closure, bool) {
+	if c, ok := f.(*closure); ok {
+		return c, true
+	}
+	if c, ok := vm.metaField(f, "__call").(*closure); ok {
+		return c, true
+	}
+	return nil, false
+}
+
+// callValue 调用函数f, 非函数值尝试调用元方法 __call
+func (vm *State) callValue(f luaValue, args []luaValue) []luaValue {
+	if c, ok := f.(*closure); ok {
+		return _callClosure(vm, c, args...)
+	}
+	if c, ok := vm.metaField(f, "__call").(*closure); ok {
+		return _callClosure(vm, c, append([]luaValue{f}, args...)...)
 	}
+	panic(fmt.Sprintf("attempt to call a %s value", typeName(typeOf(f))))
 }
@@ -1,11 +1,21 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"luago/chunk"
+	"luago/vm/api"
+	"luago/vm/example"
+	"math/rand"
 	"os"
 	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 var helloworld = []byte{
@@ -72,7 +82,7 @@ func printCode(f *chunk.Prototype) {
 		fmt.Printf("\t%d\t[%s]\t%s\t%s\n", pc, line, i.OpName(), operands)
 	}
 }
-func loadLuaScript(name, content string) (*State, error) {
+func loadLuaScript(name, content string, opts ...Option) (*State, error) {
 	luaFile := "/tmp/" + name + ".lua"
 	outFile := "/tmp/" + name + ".out"
 	os.WriteFile(luaFile, []byte(content), os.ModePerm)
@@ -83,13 +93,13 @@ func loadLuaScript(name, content string) (*State, error) {
 		return nil, err
 	} else {
 		proto := chunk.Undump(buf)
-		vm := NewState()
+		vm := NewState(opts...)
 		vm.Load(proto)
 		return vm, nil
 	}
 }
-func runLuaScript(name, content string) error {
-	if vm, err := loadLuaScript(name, content); err != nil {
+func runLuaScript(name, content string, opts ...Option) error {
+	if vm, err := loadLuaScript(name, content, opts...); err != nil {
 		return err
 	} else {
 		vm.Run()
@@ -117,6 +127,44 @@ func TestArith(t *testing.T) {
 		}
 	}
 }
+func TestArithError(t *testing.T) {
+	script := `
+local z = 0
+local ok, err = pcall(function() return 1 // z end)
+assert(not ok and err:find("attempt to divide by zero", 1, true), err)
+ok, err = pcall(function() return 1 % z end)
+assert(not ok and err:find("attempt to perform 'n%0'", 1, true), err)
+assert(1 // 0.0 == math.huge and (1 % 0.0) ~= (1 % 0.0))
+ok, err = pcall(gopanic)
+assert(false, "runtime error should not be caught by pcall")
+`
+	vm, err := loadLuaScript("aritherror", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Register("gopanic", func(api.State, ...interface{}) []interface{} {
+		var m map[string]int
+		m["x"] = 1
+		return nil
+	})
+	defer func() {
+		if _, ok := recover().(runtime.Error); !ok {
+			t.Fatal("go runtime error should be re-panicked")
+		}
+	}()
+	vm.Run()
+}
+func TestNot(t *testing.T) {
+	script := `
+local n, f, z, s, t = nil, false, 0, "", {}
+assert((not n) == true and (not f) == true)
+assert((not z) == false and (not s) == false and (not t) == false)
+assert((not not z) == true and (not not n) == false)
+`
+	if err := runLuaScript("not", script); err != nil {
+		t.Fatal(err)
+	}
+}
 func TestFor(t *testing.T) {
 	script := `
 local sum = 0
@@ -223,6 +271,35 @@ print(u,v,w) --> 11	222	33`
 	}
 }
 
+// TestCloseUpvalue 离开作用域时关闭upvalue, 寄存器扩容后open upvalue仍然有效
+func TestCloseUpvalue(t *testing.T) {
+	script := `
+local fs = {}
+for i = 1, 3 do fs[i] = function() return i end end
+assert(fs[1]() == 1 and fs[2]() == 2 and fs[3]() == 3)
+local r200 = {}
+for i = 1, 200 do r200[i] = i end
+local x = 1
+local g = function() return x end
+local t = {table.unpack(r200)}
+x = 42
+assert(g() == 42 and #t == 200)
+local function counter()
+  local n = 0
+  local inc = function() n = n + 1 return n end
+  local get = function() return n end
+  local _ = {table.unpack(r200)}
+  return inc, get
+end
+local inc, get = counter()
+inc() inc()
+assert(get() == 2)
+`
+	if err := runLuaScript("closeupvalue", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestMeta(t *testing.T) {
 	script := `
 local mt = {}
@@ -272,6 +349,29 @@ v4()
 		t.Fatal(err)
 	}
 }
+
+// TestMetaLoop __index/__newindex形成循环时抛出可以捕获的错误
+func TestMetaLoop(t *testing.T) {
+	script := `
+local t = setmetatable({}, {})
+getmetatable(t).__index = t
+local ok, err = pcall(function() return t.x end)
+assert(not ok and err:find("'__index' chain too long; possible loop", 1, true), err)
+getmetatable(t).__newindex = t
+ok, err = pcall(function() t.x = 1 end)
+assert(not ok and err:find("'__newindex' chain too long; possible loop", 1, true), err)
+local chain = {v = 1}
+for i = 1, 100 do chain = setmetatable({}, {__index = chain, __newindex = chain}) end
+assert(chain.v == 1)
+chain.w = 2
+assert(rawget(chain, "w") == nil and chain.w == 2)
+`
+	for _, opts := range [][]Option{nil, {WithSandbox(DefaultSandboxPolicy)}, {WithMemoryLimit(4 << 20)}} {
+		if err := runLuaScript("metaloop", script, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
 func TestLoop(t *testing.T) {
 	script := `
 t = {a=1,b=2,c=3}
@@ -311,3 +411,1458 @@ func TestGoCallLua(t *testing.T) {
 		}
 	}
 }
+func TestTypeMetatable(t *testing.T) {
+	script := `
+local s = "abc"
+assert(s:upper() == "ABC")
+assert(("XyZ"):lower() == "xyz")
+assert(getmetatable("abc").__index == string)
+assert(getmetatable({}) == nil)
+local mt = {__metatable = "locked"}
+local obj = setmetatable({}, mt)
+assert(getmetatable(obj) == "locked")
+local base = {name = "base"}
+local child = setmetatable({}, {__index = setmetatable({}, {__index = base})})
+assert(child.name == "base")
+`
+	if err := runLuaScript("typemeta", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProtectedMetatable(t *testing.T) {
+	vm, err := loadLuaScript("protected", `setmetatable(setmetatable({}, {__metatable = false}), {})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if p := recover(); p != "cannot change a protected metatable" {
+			t.Fatalf("unexpected error: %v", p)
+		}
+	}()
+	vm.Run()
+}
+
+func TestGoTypeMetatable(t *testing.T) {
+	type point struct{ x, y int }
+	vm, err := loadLuaScript("gotypemeta", `function f(p) return p.x + p.y end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Run()
+	mt := newLuaTable(0, 1)
+	mt.Put("__index", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		p := args[0].(point)
+		if args[1] == "x" {
+			return []interface{}{p.x}
+		}
+		return []interface{}{p.y}
+	}))
+	vm.SetGoTypeMetatable(reflect.TypeOf(point{}), mt)
+	if results, err := vm.CallByParam("f", point{1, 2}); err != nil {
+		t.Fatal(err)
+	} else if results[0] != 3 {
+		t.Fatalf("p.x + p.y = %v", results[0])
+	}
+}
+
+func TestUserData(t *testing.T) {
+	type conn struct{ addr string }
+	vm, err := loadLuaScript("userdata", `
+function describe(c, p)
+  assert(type(c) == "userdata" and type(p) == "userdata")
+  return c:addr()
+end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Run()
+	methods := newLuaTable(0, 1)
+	methods.Put("addr", newGoClosure(func(_ api.State, args ...interface{}) []interface{} {
+		return []interface{}{CheckUserData[*conn](args, 1).addr}
+	}))
+	mt := newLuaTable(0, 1)
+	mt.Put("__index", methods)
+	ud := NewUserData(&conn{"127.0.0.1:80"}, mt)
+	x := 0
+	if results, err := vm.CallByParam("describe", ud, LightUserData(&x)); err != nil {
+		t.Fatal(err)
+	} else if results[0] != "127.0.0.1:80" {
+		t.Fatalf("c:addr() = %v", results[0])
+	}
+	if c, ok := ToUserData[*conn](ud); !ok || c.addr != "127.0.0.1:80" {
+		t.Fatal("ToUserData failed")
+	}
+	defer func() {
+		if p := recover(); p != "bad argument #1 (*vm.conn expected, got userdata)" {
+			t.Fatalf("unexpected error: %v", p)
+		}
+	}()
+	CheckUserData[*conn]([]interface{}{NewUserData(1, nil)}, 1)
+}
+
+type testAccount struct {
+	Owner   string
+	Balance float64
+	Tags    []string
+	Meta    map[string]int
+	Address struct{ City string }
+}
+
+func (a *testAccount) Deposit(amount float64) (float64, error) {
+	if amount <= 0 {
+		return a.Balance, fmt.Errorf("invalid amount %v", amount)
+	}
+	a.Balance += amount
+	return a.Balance, nil
+}
+
+func (a testAccount) Summary(sep string, parts ...string) string {
+	s := a.Owner
+	for _, p := range parts {
+		s += sep + p
+	}
+	return s
+}
+
+func TestReflectBinding(t *testing.T) {
+	vm, err := loadLuaScript("reflect", `
+assert(acc.Owner == "alice")
+assert(acc:Deposit(50) == 150)
+acc.Owner = "bob"
+assert(acc:Summary("-", "x", "y") == "bob-x-y")
+assert(#acc.Tags == 2 and acc.Tags[2] == "vip")
+acc.Tags[1] = "gold"
+assert(acc.Meta.age == 30)
+acc.Meta.level = 3
+acc.Address.City = "Paris"
+assert(sum({1, 2, 3}) == 6)
+local q, r = divmod(7, 2)
+assert(q == 3 and r == 1)
+assert(apply(function(x) return x * 2 end, 21) == 42)
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := &testAccount{Owner: "alice", Balance: 100, Tags: []string{"new", "vip"}, Meta: map[string]int{"age": 30}}
+	vm.SetGlobal("acc", acc)
+	vm.SetGlobal("sum", func(nums []int) int {
+		s := 0
+		for _, n := range nums {
+			s += n
+		}
+		return s
+	})
+	vm.SetGlobal("divmod", func(a, b int) (int, int) { return a / b, a % b })
+	vm.SetGlobal("apply", func(f func(int) int, x int) int { return f(x) })
+	vm.Run()
+	if acc.Owner != "bob" || acc.Balance != 150 || acc.Tags[0] != "gold" || acc.Meta["level"] != 3 || acc.Address.City != "Paris" {
+		t.Fatalf("unexpected account %+v", acc)
+	}
+	if vm.ToLuaValue(acc).(*UserData).Meta() != vm.ToLuaValue(&testAccount{}).(*UserData).Meta() {
+		t.Fatal("metatable should be cached per type")
+	}
+}
+
+func TestReflectError(t *testing.T) {
+	vm, err := loadLuaScript("reflecterr", `acc:Deposit(-1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.SetGlobal("acc", &testAccount{})
+	defer func() {
+		if p := recover(); p != "invalid amount -1" {
+			t.Fatalf("unexpected error: %v", p)
+		}
+	}()
+	vm.Run()
+}
+
+func TestStackAPI(t *testing.T) {
+	vm := NewState()
+	vm.PushInteger(1)
+	vm.PushString("2")
+	vm.PushNumber(3.5)
+	vm.PushBoolean(true)
+	vm.PushNil()
+	if vm.GetTop() != 5 || vm.Type(-1) != LUA_TNIL || vm.Type(6) != LUA_TNONE {
+		t.Fatal("unexpected stack state")
+	}
+	if vm.ToInteger(2) != 2 || !vm.IsNumber(2) || vm.IsInteger(3) || vm.ToString(1) != "1" {
+		t.Fatal("unexpected conversions")
+	}
+	vm.Rotate(1, 1) // nil 1 "2" 3.5 true
+	if !vm.IsNil(1) || vm.ToInteger(2) != 1 {
+		t.Fatal("rotate failed")
+	}
+	vm.Remove(1) // 1 "2" 3.5 true
+	vm.Insert(1) // true 1 "2" 3.5
+	if !vm.ToBoolean(1) || vm.ToNumber(-1) != 3.5 {
+		t.Fatal("insert/remove failed")
+	}
+	vm.SetTop(0)
+
+	vm.NewTable()
+	vm.PushString("v")
+	vm.SetField(-2, "k")
+	vm.PushInteger(10)
+	vm.SetI(-2, 1)
+	if vm.GetField(-1, "k") != LUA_TSTRING || vm.ToString(-1) != "v" {
+		t.Fatal("GetField failed")
+	}
+	vm.Pop(1)
+	vm.RawGetI(-1, 1)
+	if vm.ToInteger(-1) != 10 || vm.RawLen(-2) != 1 {
+		t.Fatal("RawGetI failed")
+	}
+	vm.Pop(1)
+	vm.SetGlobal("t")
+	vm.GetGlobal("t")
+	vm.PushString("k")
+	vm.RawGet(-2)
+	if vm.ToString(-1) != "v" {
+		t.Fatal("RawGet failed")
+	}
+	vm.SetTop(0)
+
+	vm.PushValue(api.LUA_REGISTRYINDEX)
+	vm.RawGetI(-1, api.LUA_RIDX_GLOBALS)
+	vm.GetField(-1, "t")
+	if !vm.IsTable(-1) {
+		t.Fatal("registry globals failed")
+	}
+	vm.SetTop(0)
+}
+
+func TestStackAPICall(t *testing.T) {
+	vm, err := loadLuaScript("stackcall", `
+function add(a, b) return a + b end
+function fail(msg) error(msg) end
+function callsum(...) return sum(...) end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Run()
+	vm.Register("sum", example.ExampleGoFuncSum)
+	vm.GetGlobal("add")
+	vm.PushInteger(1)
+	vm.PushInteger(2)
+	vm.Call(2, 1)
+	if vm.ToInteger(-1) != 3 || vm.GetTop() != 1 {
+		t.Fatal("call add failed")
+	}
+	vm.Pop(1)
+
+	vm.GetGlobal("callsum")
+	vm.PushInteger(1)
+	vm.PushNumber(2.5)
+	vm.Call(2, api.LUA_MULTRET)
+	if vm.ToNumber(-1) != 3.5 || vm.GetTop() != 1 {
+		t.Fatal("call sum failed")
+	}
+	vm.Pop(1)
+
+	vm.GetGlobal("callsum")
+	vm.PushString("x")
+	if status := vm.PCall(1, 0, 0); status != api.LUA_ERRRUN || vm.ToString(-1) != "bad argument #1 to 'sum' (number expected, got string)" {
+		t.Fatalf("pcall sum: %d %v", status, vm.ToValue(-1))
+	}
+	vm.Pop(1)
+
+	vm.PushGoFunction(func(s api.State, args ...interface{}) []interface{} {
+		return []interface{}{"handled: " + s.ToString(1)}
+	})
+	vm.GetGlobal("undefined")
+	if status := vm.PCall(0, 0, 1); status != api.LUA_ERRRUN || vm.ToString(-1) != "handled: attempt to call a nil value" {
+		t.Fatalf("pcall handler: %d %v", status, vm.ToValue(-1))
+	}
+	vm.SetTop(0)
+}
+
+func TestGoClosureAndRef(t *testing.T) {
+	vm, err := loadLuaScript("goclosure", `
+local c1, c2 = counter(), counter()
+assert(c1() == 1 and c1() == 2 and c2() == 1)
+function callback(x) return x * 10 end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Register("counter", func(s api.State, _ ...interface{}) []interface{} {
+		s.PushInteger(0)
+		s.PushGoClosure(func(s api.State, _ ...interface{}) []interface{} {
+			n := s.ToInteger(api.UpvalueIndex(1)) + 1
+			s.PushInteger(n)
+			s.Replace(api.UpvalueIndex(1))
+			return []interface{}{n}
+		}, 1)
+		return []interface{}{s.ToValue(-1)}
+	})
+	vm.Run()
+
+	vm.GetGlobal("callback")
+	ref := vm.Ref(api.LUA_REGISTRYINDEX)
+	vm.PushNil()
+	if vm.Ref(api.LUA_REGISTRYINDEX) != api.LUA_REFNIL || vm.GetTop() != 0 {
+		t.Fatal("ref nil failed")
+	}
+	vm.SetGlobal("callback", nil)
+	vm.RawGetI(api.LUA_REGISTRYINDEX, ref)
+	vm.PushInteger(4)
+	vm.Call(1, 1)
+	if vm.ToInteger(-1) != 40 {
+		t.Fatal("call by ref failed")
+	}
+	vm.Pop(1)
+	vm.Unref(api.LUA_REGISTRYINDEX, ref)
+	vm.PushString("reused")
+	if vm.Ref(api.LUA_REGISTRYINDEX) != ref {
+		t.Fatal("ref should be reused after unref")
+	}
+}
+
+func TestBaseLib(t *testing.T) {
+	script := `
+assert(select("#", 1, nil, 3) == 3)
+assert(select(2, "a", "b", "c") == "b")
+assert(select(-1, "a", "b", "c") == "c")
+assert(tostring(1) == "1" and tostring(1.0) == "1.0" and tostring(-0.5) == "-0.5")
+assert(tostring(setmetatable({}, {__tostring = function() return "obj" end})) == "obj")
+point = tostring(setmetatable({}, {__name = "Point"}))
+assert(tonumber("0x10") == 16 and tonumber(" 10 ") == 10 and tonumber("1e2") == 100.0)
+assert(tonumber("ff", 16) == 255 and tonumber("zz", 36) == 1295 and tonumber("8", 8) == nil)
+assert(tonumber("abc") == nil and tonumber(nil) == nil)
+assert(rawequal("a", "a") and rawlen({1, 2}) == 2 and rawlen("abc") == 3)
+local t = setmetatable({}, {__index = function(_, k) if k <= 3 then return k * 10 end end})
+local n = 0
+for i, v in ipairs(t) do
+  assert(v == i * 10)
+  n = n + 1
+end
+assert(n == 3)
+for _ in ipairs({}) do error("empty table") end
+assert(rawget(t, 1) == nil and rawset(t, 1, "x") == t and t[1] == "x")
+local ok, err = pcall(error, {code = 1})
+assert(not ok and err.code == 1)
+ok, err = pcall(function() error("boom") end)
+assert(not ok and err == "/tmp/baselib.lua:23: boom")
+ok, err = pcall(function() error("boom", 0) end)
+assert(err == "boom")
+ok, err = pcall(function() local x = nil; return x.y end)
+assert(err == "/tmp/baselib.lua:27: attempt to index a nil value")
+ok, err = pcall(assert, false)
+assert(err == "assertion failed!")
+ok, err = pcall(select, 0)
+assert(err == "bad argument #1 to 'select' (index out of range)")
+ok, err = xpcall(function() error("x", 0) end, function(m) return "handled " .. m end)
+assert(not ok and err == "handled x")
+assert(select("#", pcall(function() return 1, 2 end)) == 3)
+assert(_G._G == _G and _VERSION == "Lua 5.3")
+assert(type(collectgarbage("count")) == "number")
+assert(tostring(setmetatable({}, {__tostring = function() return 42 end})) == "42")
+ok, err = pcall(tostring, setmetatable({}, {__tostring = function() return {} end}))
+assert(err == "'__tostring' must return a string")
+ok, err = pcall(rawset, {}, 0/0, 1)
+assert(err == "table index is NaN")
+ok, err = pcall(next, {a = 1}, "b")
+assert(err == "invalid key to 'next'")
+t = {a = 1, b = 2, 3}
+for k in pairs(t) do t[k] = nil end
+assert(next(t) == nil and next({}, nil) == nil and next({10}, 1.0) == nil)
+`
+	vm, err := loadLuaScript("baselib", script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Run()
+	if point, _ := vm.global.Get("point").(string); !strings.HasPrefix(point, "Point: 0x") {
+		t.Fatalf("tostring with __name: %q", point)
+	}
+}
+
+func TestStringLib(t *testing.T) {
+	script := `
+assert(("abc"):byte() == 97 and select("#", ("abc"):byte(1, -1)) == 3 and ("abc"):byte(10) == nil)
+assert(string.char(76, 117, 97) == "Lua" and string.char() == "")
+assert(("ab"):rep(3) == "ababab" and ("ab"):rep(3, ",") == "ab,ab,ab" and ("x"):rep(0) == "")
+assert(("abc"):reverse() == "cba" and #string.reverse("") == 0)
+local s = "hello world"
+assert(s:sub(1, 5) == "hello" and s:sub(-5) == "world" and s:sub(-100, 2) == "he" and s:sub(5, 1) == "")
+assert(s:len() == 11 and s:upper() == "HELLO WORLD")
+assert(string.format("%5d|%-5d|%05.1f|%x|%X|%#o", 42, 42, 3.14159, 255, 255, 8) == "   42|42   |003.1|ff|FF|010")
+assert(string.format("%g %g %.3g %e", 0.1 + 0.2, 1e20, 3.14159, 12345.678) == "0.3 1e+20 3.14 1.234568e+04")
+assert(string.format("%a %A %020a", 1.0, 0.1, 2.5) == "0x1p+0 0X1.999999999999AP-4 0x0000000000001.4p+1")
+assert(string.format("%f %5.1f %c %u", 1/0, -1/0, 65, -1) == "inf  -inf A 18446744073709551615")
+assert(string.format("%q", 'a "q"\n\0\0001\127') == '"a \\"q\\"\\\n\\0\\0001\\127"')
+assert(string.format("%q %q %q", 1.5, 7, nil) == "0x1.8p+0 7 nil")
+assert(string.format("%-4s|%.2s|%s|%%", "ab", "abc", setmetatable({}, {__tostring = function() return "T" end})) == "ab  |ab|T|%")
+assert(not pcall(string.format, "%d", 1.5))
+local ok, err = pcall(string.format, "%y", 1)
+assert(err == "invalid option '%y' to 'format'")
+ok, err = pcall(string.format, "%d")
+assert(err == "bad argument #2 to 'format' (no value)")
+ok, err = pcall(string.format, "%100d", 1)
+assert(err == "invalid format (width or precision too long)")
+ok, err = pcall(string.format, "%q", {})
+assert(err == "bad argument #2 to 'format' (value has no literal form)")
+`
+	if err := runLuaScript("stringlib", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStringPattern(t *testing.T) {
+	script := `
+local function pack(...) return {n = select("#", ...), ...} end
+local r = pack(string.find("hello world", "(o)(r)"))
+assert(r.n == 4 and r[1] == 8 and r[2] == 9 and r[3] == "o" and r[4] == "r")
+assert(string.find("a.b", ".", 1, true) == 2 and string.find("hello", "l", -2) == 4)
+assert(string.find("hello", "", 10) == nil and string.find("hello", "^e") == nil)
+assert(select(2, string.find("x = [[a]] y", "%b[]")) == 9)
+assert(string.find("THE (quick) fox", "%f[%a]%a+", 5) == 6)
+local k, v = string.match("key = value", "(%w+)%s*=%s*(%w+)")
+assert(k == "key" and v == "value")
+assert(string.match("  trim  ", "^%s*(.-)%s*$") == "trim")
+local p1, p2 = string.match("abc", "()b()")
+assert(p1 == 2 and p2 == 3)
+assert(string.match("abba", "(a)(b)%2%1") == "a" and string.match("]]", "[]]+") == "]]")
+assert(string.match("hello123", "[^%d]+") == "hello" and string.match("a^b", "[%^b]+") == "^b")
+assert(string.find("a\0b", "%z") == 2 and string.match("a\0b", "[%Z]+") == "a" and string.gsub("a\0b\0", "%z", "") == "ab")
+assert(string.match("end$", "d%$$") == "d$" and string.match("a$b", "a$b") == "a$b")
+local s, n = string.gsub("hello world", "(%w+)", "<%1>")
+assert(s == "<hello> <world>" and n == 2)
+assert(string.gsub("abc", "", "-") == "-a-b-c-" and string.gsub("hello", "l*", "x") == "xhxexox")
+assert(string.gsub("hello world", "%w+", "%0 %0", 1) == "hello hello world")
+assert(string.gsub("$name is $x", "%$(%w+)", {name = "bob"}) == "bob is $x")
+assert(string.gsub("abc", "%w", function(c) if c ~= "b" then return c:upper() end end) == "AbC")
+assert(string.gsub("abc", "%w", "100%%") == "100%100%100%" and string.gsub("abc", "^a", "A") == "Abc")
+assert(string.gsub("hello world", "()o", "%1") == "hell5 w8rld")
+local t = {}
+for k, v in string.gmatch("a=1, b=2, c=3", "(%w+)=(%w+)") do t[#t + 1] = k .. v end
+assert(#t == 3 and t[1] == "a1" and t[3] == "c3")
+t = {}
+for w in ("one two  three"):gmatch("%a+") do t[#t + 1] = w end
+assert(#t == 3 and t[2] == "two")
+local errors = {
+  {"malformed pattern (ends with '%')", string.match, "hello", "%"},
+  {"malformed pattern (missing ']')", string.match, "hello", "[a"},
+  {"unfinished capture", string.match, "hello", "(l"},
+  {"invalid pattern capture", string.match, "hello", "l)"},
+  {"invalid capture index %1", string.match, "hello", "%1"},
+  {"missing '[' after '%f' in pattern", string.match, "hello", "%fa"},
+  {"pattern too complex", string.match, string.rep("a", 300), string.rep("a?", 300) .. string.rep("a", 300)},
+  {"invalid capture index %2", string.gsub, "abc", "%w", "%2"},
+  {"invalid use of '%' in replacement string", string.gsub, "abc", "%w", "%x"},
+  {"invalid replacement value (a table)", string.gsub, "abc", "b", {b = {}}},
+  {"bad argument #3 to 'gsub' (string/function/table expected)", string.gsub, "abc", "b", true},
+}
+for _, e in ipairs(errors) do
+  local ok, err = pcall(e[2], e[3], e[4], e[5])
+  assert(not ok and err == e[1], err)
+end
+`
+	if err := runLuaScript("pattern", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStringPack(t *testing.T) {
+	script := `
+assert(string.pack(">i4", 100) == "\0\0\0\100" and string.pack("<i4", 100) == "\100\0\0\0")
+assert(string.pack("<h>H", -2, 513) == "\254\255\2\1" and string.pack("i16", -3) == "\253" .. string.rep("\255", 15))
+assert(string.pack("s1", "abc") == "\3abc" and string.pack("z", "ab") == "ab\0" and string.pack("c5", "ab") == "ab\0\0\0")
+assert(string.pack("!4 b i4", 1, 2) == "\1\0\0\0\2\0\0\0" and string.pack("!8 b Xd", 1) == "\1" .. string.rep("\0", 7))
+assert(string.packsize("i4i8") == 12 and string.packsize("!8 b d") == 16 and string.packsize("c10 x h") == 13)
+local a, b, pos = string.unpack("<h>H", "\254\255\2\1")
+assert(a == -2 and b == 513 and pos == 5)
+local f, d = string.unpack("f d", string.pack("f d", 1.5, -2.25))
+assert(f == 1.5 and d == -2.25)
+local s1, z, c3, next = string.unpack("s1 z c3", string.pack("s1 z c3", "abc", "hi", "xy"))
+assert(s1 == "abc" and z == "hi" and c3 == "xy\0" and next == 11)
+assert(string.unpack("i4", "abcdefgh", -4) == string.unpack("<i4", "efgh"))
+assert(string.unpack("i9", string.rep("\255", 9)) == -1)
+local errors = {
+  {"bad argument #2 to 'pack' (integer overflow)", string.pack, "i3", 8388608},
+  {"bad argument #2 to 'pack' (unsigned overflow)", string.pack, "I1", -1},
+  {"bad argument #2 to 'pack' (string length does not fit in given size)", string.pack, "s1", string.rep("x", 256)},
+  {"bad argument #2 to 'pack' (string contains zeros)", string.pack, "z", "a\0b"},
+  {"bad argument #2 to 'pack' (string longer than given size)", string.pack, "c1", "ab"},
+  {"missing size for format option 'c'", string.pack, "c", "ab"},
+  {"bad argument #1 to 'pack' (format asks for alignment not power of 2)", string.pack, "!3 b i4", 1, 2},
+  {"bad argument #1 to 'pack' (invalid next option for option 'X')", string.pack, "bXc1", 1},
+  {"integral size (17) out of limits [1,16]", string.pack, "i17", 1},
+  {"invalid format option 'y'", string.pack, "y", 1},
+  {"bad argument #1 to 'packsize' (variable-length format)", string.packsize, "s"},
+  {"9-byte integer does not fit into Lua Integer", string.unpack, "I9", "\0\0\0\0\0\0\0\0\1"},
+  {"bad argument #2 to 'unpack' (data string too short)", string.unpack, "s1", "\5ab"},
+  {"bad argument #3 to 'unpack' (initial position out of string)", string.unpack, "i4", "abcdefgh", 10},
+}
+for _, e in ipairs(errors) do
+  local ok, err = pcall(e[2], e[3], e[4], e[5])
+  assert(not ok and err == e[1], err)
+end
+`
+	if err := runLuaScript("pack", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTableLib(t *testing.T) {
+	script := `
+local t = {1, 2, 3}
+table.insert(t, 4)
+table.insert(t, 1, 0)
+assert(table.concat(t, ",") == "0,1,2,3,4" and table.concat(t, "", 2, 3) == "12" and table.concat({}) == "")
+assert(table.remove(t) == 4 and table.remove(t, 1) == 0 and table.concat(t, ",") == "1,2,3")
+assert(table.remove({}) == nil and table.remove({}, 0) == nil)
+local p = table.pack(1, nil, 3)
+assert(p.n == 3 and p[3] == 3)
+local a, b, c = table.unpack({1, 2, 3}, 2)
+assert(a == 2 and b == 3 and c == nil and select("#", table.unpack({}, 1, 3)) == 3)
+assert(table.concat(table.move({1, 2, 3}, 1, 3, 2), ",") == "1,1,2,3")
+assert(table.concat(table.move({1, 2, 3}, 2, 3, 1), ",") == "2,3,3")
+assert(table.concat(table.move({1, 2}, 1, 2, 3, {}), ",", 3, 4) == "1,2")
+-- 代理表通过元方法访问
+local store = {5, 3, 8, 1}
+local proxy = setmetatable({}, {
+  __index = store, __newindex = store, __len = function() return #store end})
+table.sort(proxy)
+table.insert(proxy, 9)
+assert(table.concat(store, ",") == "1,3,5,8,9" and table.unpack(proxy, 5) == 9)
+local words = {"pear", "Apple", "fig", "banana"}
+table.sort(words, function(x, y) return x:lower() < y:lower() end)
+assert(table.concat(words, " ") == "Apple banana fig pear")
+local nums = {}
+for i = 1, 500 do nums[i] = (i * 7919) % 1000 end
+table.sort(nums, function(x, y) return x > y end)
+for i = 2, #nums do assert(nums[i - 1] >= nums[i]) end
+local bad = {}
+for i = 1, 200 do bad[i] = (i * 7919) % 200 end
+local errors = {
+  {"invalid order function for sorting", table.sort, bad, function() return true end},
+  {"attempt to compare string with number", table.sort, {3, 1, "x"}},
+  {"bad argument #2 to 'insert' (position out of bounds)", table.insert, {1}, 5, 2},
+  {"wrong number of arguments to 'insert'", table.insert, {1}, 1, 2, 3},
+  {"invalid value (table) at index 2 in table for 'concat'", table.concat, {1, {}, 3}},
+  {"bad argument #1 to 'remove' (position out of bounds)", table.remove, {1, 2}, 5},
+  {"bad argument #1 to 'sort' (table expected, got number)", table.sort, 1},
+}
+for _, e in ipairs(errors) do
+  local ok, err = pcall(e[2], table.unpack(e, 3))
+  assert(not ok and err == e[1], err)
+end
+local ok, err = pcall(table.sort, {3, 2, 1}, function() error("cmp", 0) end)
+assert(not ok and err == "cmp")
+`
+	if err := runLuaScript("tablelib", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMathLib(t *testing.T) {
+	script := `
+assert(math.abs(-3) == 3 and math.type(math.abs(-3)) == "integer" and math.abs(-2.5) == 2.5)
+assert(math.abs(math.mininteger) == math.mininteger)
+assert(math.floor(3.7) == 3 and math.type(math.floor(3.7)) == "integer" and math.ceil(3.2) == 4)
+assert(math.floor(-0.5) == -1 and math.type(math.floor(1e100)) == "float")
+assert(math.fmod(7, 3) == 1 and math.fmod(-7, 3) == -1 and math.fmod(math.mininteger, -1) == 0)
+assert(math.fmod(7.5, 2) == 1.5)
+local ip, fp = math.modf(3.25)
+assert(ip == 3 and fp == 0.25 and math.type(ip) == "integer")
+ip, fp = math.modf(-math.huge)
+assert(ip == -math.huge and fp == 0.0)
+ip, fp = math.modf(5)
+assert(math.type(ip) == "integer" and ip == 5 and math.type(fp) == "float" and fp == 0.0)
+assert(math.type(math.modf(2^63)) == "float" and math.type(math.modf(-0.5)) == "integer" and select(2, math.modf(-0.5)) == -0.5)
+assert(math.sqrt(16) == 4.0 and math.exp(0) == 1.0 and math.log(8, 2) == 3.0 and math.log(100, 10) == 2.0)
+assert(math.abs(math.log(27, 3) - 3) < 1e-12 and math.log(1) == 0.0)
+assert(math.sin(0) == 0.0 and math.cos(0) == 1.0 and math.abs(math.atan(1, 1) - math.pi / 4) < 1e-15)
+assert(math.deg(math.pi) == 180.0 and math.rad(180) == math.pi)
+assert(math.tointeger(3.0) == 3 and math.tointeger(3.5) == nil and math.tointeger("x") == nil)
+assert(math.type(1) == "integer" and math.type(1.0) == "float" and math.type("1") == nil)
+assert(math.ult(1, -1) and not math.ult(-1, 1))
+assert(math.max(1, 5.5, 3) == 5.5 and math.min(4, 2, 8) == 2 and math.type(math.max(1, 2)) == "integer")
+assert(math.maxinteger + 1 == math.mininteger and math.huge > math.maxinteger)
+for _ = 1, 100 do
+  local r, i = math.random(), math.random(3, 5)
+  assert(r >= 0 and r < 1 and i >= 3 and i <= 5 and math.random(1) == 1)
+end
+assert(not pcall(math.random, 2, 1) and not pcall(math.random, 1, 2, 3))
+local ok, err = pcall(math.fmod, 1, 0)
+assert(err == "bad argument #2 to 'fmod' (zero)")
+ok, err = pcall(math.random, 0, math.maxinteger + 0)
+assert(ok)
+ok, err = pcall(math.random, -1, math.maxinteger)
+assert(err == "bad argument #1 to 'random' (interval too large)")
+math.randomseed(7)
+local a = {math.random(100), math.random(100), math.random(100)}
+math.randomseed(7)
+assert(a[1] == math.random(100) and a[2] == math.random(100) and a[3] == math.random(100))
+`
+	if err := runLuaScript("mathlib", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	values := func() []interface{} {
+		vm := NewState(WithRandSource(rand.NewSource(42)))
+		vm.GetGlobal("math")
+		vm.GetField(-1, "random")
+		vm.PushInteger(1000)
+		vm.Call(1, 1)
+		vm.GetField(-2, "random")
+		vm.Call(0, 1)
+		return []interface{}{vm.ToValue(-2), vm.ToValue(-1)}
+	}
+	if a, b := values(), values(); a[0] != b[0] || a[1] != b[1] {
+		t.Fatalf("injected source should be reproducible: %v %v", a, b)
+	}
+}
+func TestOSLib(t *testing.T) {
+	now := time.Date(2021, time.March, 14, 15, 9, 26, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	env := map[string]string{"LUA_TEST": "yes"}
+	lookup := func(key string) (string, bool) {
+		v, ok := env[key]
+		return v, ok
+	}
+	script := `
+local t0 = os.time()
+assert(t0 == 1615734568 and os.time() == t0 + 1)
+assert(os.date("!%Y-%m-%d %H:%M:%S") == "2021-03-14 15:09:30")
+assert(os.clock() == 4.0 and math.type(os.clock()) == "float")
+assert(os.date("!%c", 0) == "Thu Jan  1 00:00:00 1970")
+assert(os.date("!%a %A %b %B %j %p %I %y %C %e|%D|%F|%R|%T|%%", 951782400) ==
+  "Tue Tuesday Feb February 060 AM 12 00 20 29|02/29/00|2000-02-29|00:00|00:00:00|%")
+assert(os.date("!%U %W %V %G %g %u %w", 1609459200) == "00 00 53 2020 20 5 5")
+assert(os.date("!%Ex %OS", 1234567890) == "02/13/09 30")
+local d = os.date("!*t", 1234567890)
+assert(d.year == 2009 and d.month == 2 and d.day == 13 and d.hour == 23 and d.min == 31 and d.sec == 30)
+assert(d.wday == 6 and d.yday == 44 and d.isdst == false)
+local lt = os.date("*t", 1234567890)
+assert(os.time(lt) == 1234567890)
+local t = {year = 2020, month = 14, day = -3, hour = 25, min = 61, sec = -5}
+os.time(t)
+assert(t.year == 2021 and t.month == 1 and t.day == 29 and t.hour == 2 and t.min == 0 and t.sec == 55)
+assert(t.wday == 6 and t.yday == 29)
+assert(os.time{year = 2000, month = 1, day = 1, hour = 0} + 86400 == os.time{year = 2000, month = 1, day = 2, hour = 0})
+assert(os.difftime(10, 3) == 7.0)
+assert(os.getenv("LUA_TEST") == "yes" and os.getenv("HOME") == nil)
+local errs = {
+  {"field 'day' missing in date table", os.time, {year = 2000, month = 1}},
+  {"field 'day' is not an integer", os.time, {year = 2000, month = 1, day = 1.5}},
+  {"field 'year' is out-of-bound", os.time, {year = 2^31, month = 1, day = 1}},
+  {"bad argument #1 to 'time' (table expected, got number)", os.time, 1},
+  {"bad argument #1 to 'date' (invalid conversion specifier '%Ez')", os.date, "%Ez"},
+  {"bad argument #1 to 'date' (invalid conversion specifier '%')", os.date, "abc%"},
+  {"bad argument #2 to 'difftime' (number expected, got no value)", os.difftime, 1},
+  {"'remove' is not permitted", os.remove, "x"},
+  {"'rename' is not permitted", os.rename, "x", "y"},
+  {"'tmpname' is not permitted", os.tmpname},
+  {"'exit' is not permitted", os.exit, 0},
+}
+for _, e in ipairs(errs) do
+  local ok, err = pcall(e[2], table.unpack(e, 3))
+  assert(not ok and err == e[1], err)
+end
+`
+	if err := runLuaScript("oslib", script, WithClock(clock), WithEnv(lookup),
+		WithOSFileAccess(false), WithOSExit(false)); err != nil {
+		t.Fatal(err)
+	}
+	script = `
+local name = os.tmpname()
+assert(type(name) == "string")
+assert(os.rename(name, name .. ".x") == true)
+assert(os.remove(name .. ".x") == true)
+local ok, msg, code = os.remove(name .. ".x")
+assert(ok == nil and msg == name .. ".x: No such file or directory" and code == 2)
+ok, msg = os.rename(name, name)
+assert(ok == nil and msg == "No such file or directory")
+`
+	if err := runLuaScript("osfile", script); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestIOLib(t *testing.T) {
+	mem := NewMemFS()
+	mem.WriteFile("/data/in.txt", []byte("first line\n42 0x10 -1.5e1\nrest\n"))
+	script := `
+local f = assert(io.open("/data/in.txt"))
+assert(io.type(f) == "file" and tostring(f):match("^file %(0x%x+%)$"))
+assert(f:read() == "first line")
+local a, b, c = f:read("n", "n", "n")
+assert(a == 42 and math.type(a) == "integer" and b == 16 and c == -15.0)
+assert(f:read("L") == "\n" and f:read("a") == "rest\n" and f:read("a") == "" and f:read() == nil)
+assert(f:seek("set", 6) == 6 and f:read(4) == "line" and f:seek() == 10 and f:seek("end") == 31)
+assert(f:read(0) == nil and f:seek("set") == 0 and f:read(0) == "")
+assert(f:close() == true and io.type(f) == "closed file" and tostring(f) == "file (closed)")
+
+local out = assert(io.open("out.txt", "w"))
+assert(out:write("a", 1, " ", 2.5, " ", 1.0, "\n") == out)
+assert(out:read() == nil)
+out:close()
+out = io.open("out.txt", "a+")
+out:write("b\n")
+out:seek("set")
+assert(out:read("a") == "a1 2.5 1\nb\n")
+out:close()
+
+local lines = {}
+for l in io.lines("/data/in.txt", "L") do lines[#lines + 1] = l end
+assert(#lines == 3 and lines[3] == "rest\n")
+for n1, n2 in io.open("/data/in.txt"):lines(1, 2) do
+  assert(n1 == "f" and n2 == "ir")
+  break
+end
+
+io.output("log.txt")
+io.write("x", "y")
+assert(io.output() ~= io.stdout and io.close())
+io.output(io.stdout)
+io.input("log.txt")
+assert(io.read("a") == "xy")
+io.input():close()
+io.input(io.stdin)
+
+local tmp = io.tmpfile()
+tmp:write("tmp data")
+tmp:seek("set")
+assert(tmp:read("a") == "tmp data")
+tmp:close()
+
+local ok, msg, code = io.open("/missing.txt")
+assert(ok == nil and msg == "/missing.txt: No such file or directory" and code == 2)
+assert(io.type(io.stdout) == "file" and io.type({}) == nil)
+assert(select(2, io.close(io.stdout)) == "cannot close standard file")
+local errs = {
+  {"attempt to use a closed file", f.read, f},
+  {"bad argument #2 to 'open' (invalid mode)", io.open, "x", "rw"},
+  {"bad argument #1 to 'read' (invalid format)", io.read, "x"},
+  {"bad argument #2 to 'seek' (invalid option 'bad')", io.stdin.seek, io.stdin, "bad"},
+  {"bad argument #1 to 'close' (FILE* expected, got number)", io.close, 1},
+  {"cannot open file '/missing.txt' (No such file or directory)", io.lines, "/missing.txt"},
+}
+for _, e in ipairs(errs) do
+  local ok, err = pcall(e[2], table.unpack(e, 3))
+  assert(not ok and err == e[1], err)
+end
+assert(os.rename("out.txt", "renamed.txt") and os.remove("log.txt"))
+`
+	if err := runLuaScript("iolib", script, WithFileSystem(mem)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := mem.ReadFile("/renamed.txt"); err != nil || string(data) != "a1 2.5 1\nb\n" {
+		t.Fatalf("unexpected file content: %q %v", data, err)
+	}
+	if _, err := mem.ReadFile("/log.txt"); err == nil {
+		t.Fatal("log.txt should be removed")
+	}
+
+	ro := NewReadOnlyFS(fstest.MapFS{"conf/app.txt": {Data: []byte("k=v\n")}})
+	script = `
+assert(io.open("/conf/app.txt"):read("a") == "k=v\n")
+assert(io.open("./conf/../conf/app.txt"):seek("end") == 4)
+local f, msg = io.open("/conf/app.txt", "w")
+assert(f == nil and msg == "/conf/app.txt: Permission denied")
+assert(select(2, os.remove("/conf/app.txt")) == "/conf/app.txt: Permission denied")
+assert(select(2, io.tmpfile()) == "Permission denied")
+`
+	if err := runLuaScript("iolibro", script, WithFileSystem(ro)); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestUtf8Lib(t *testing.T) {
+	script := `
+local s = "héllo, 世界! \u{10FFFF}"
+assert(utf8.len(s) == 12 and utf8.len(s, 4) == 10 and utf8.len("") == 0 and utf8.len("abc", 4) == 0)
+local n, pos = utf8.len(s, 3)
+assert(n == nil and pos == 3)
+n, pos = utf8.len("ab\x80cd")
+assert(n == nil and pos == 3)
+assert(utf8.len("\xed\xa0\x80") == 1 and utf8.len("\xc0\x80") == nil and utf8.len("\xf4\x90\x80\x80") == nil)
+assert(utf8.char(72, 233, 19990, 0x10FFFF) == "Hé世\u{10FFFF}" and utf8.char() == "")
+assert(utf8.char(0xD800) == "\xed\xa0\x80" and #utf8.char(0x7FF, 0x800, 0xFFFF, 0x10000) == 12)
+local cps = {utf8.codepoint(s, 1, -1)}
+assert(#cps == 12 and cps[2] == 233 and cps[8] == 19990 and cps[12] == 0x10FFFF)
+assert(utf8.codepoint(s, -4) == 0x10FFFF and select("#", utf8.codepoint(s, 5, 4)) == 0)
+assert(utf8.offset(s, 3) == 4 and utf8.offset(s, -1) == 17 and utf8.offset(s, 0, 3) == 2)
+assert(utf8.offset(s, 100) == nil and utf8.offset(s, -100) == nil and utf8.offset("abc", 4) == 4)
+local positions = {}
+for p, c in utf8.codes(s) do
+  positions[#positions + 1] = p
+  assert(utf8.codepoint(s, p) == c)
+end
+assert(#positions == 12 and positions[3] == 4 and positions[12] == 17)
+assert(utf8.charpattern == "[\0-\x7F\xC2-\xF4][\x80-\xBF]*")
+local count = 0
+for _ in s:gmatch(utf8.charpattern) do count = count + 1 end
+assert(count == 12)
+local errs = {
+  {"bad argument #2 to 'len' (initial position out of string)", utf8.len, "abc", 5},
+  {"bad argument #3 to 'len' (final position out of string)", utf8.len, "abc", 1, 4},
+  {"bad argument #1 to 'char' (value out of range)", utf8.char, -1},
+  {"bad argument #2 to 'char' (value out of range)", utf8.char, 65, 0x110000},
+  {"invalid UTF-8 code", utf8.codepoint, s, 3},
+  {"bad argument #2 to 'codepoint' (out of range)", utf8.codepoint, s, 0},
+  {"initial position is a continuation byte", utf8.offset, s, 1, 3},
+  {"bad argument #3 to 'offset' (position out of range)", utf8.offset, s, 1, 100},
+  {"bad argument #1 to 'codes' (string expected, got no value)", utf8.codes},
+}
+for _, e in ipairs(errs) do
+  local ok, err = pcall(e[2], table.unpack(e, 3))
+  assert(not ok and err == e[1], err)
+end
+local ok, err = pcall(function() for _ in utf8.codes("ab\xffcd") do end end)
+assert(not ok and err:find("invalid UTF-8 code", 1, true))
+`
+	if err := runLuaScript("utf8lib", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDebugLib(t *testing.T) {
+	script := `
+local function f(a, b, ...)
+  local x = 10
+  local info = debug.getinfo(1, "Slnu")
+  assert(info.what == "Lua" and info.short_src == "/tmp/debuglib.lua" and info.currentline == 4)
+  assert(info.linedefined == 2 and info.lastlinedefined == 13 and info.nparams == 2 and info.isvararg)
+  assert(info.name == "f" and info.namewhat == "local")
+  assert(select(2, debug.getlocal(1, 3)) == 10 and debug.getlocal(1, 1) == "a")
+  assert(debug.getlocal(1, -1) == "(*vararg)" and select(2, debug.getlocal(1, -2)) == 4 and debug.getlocal(1, -3) == nil)
+  assert(debug.setlocal(1, 3, 99) == "x" and x == 99)
+  assert(debug.getinfo(2, "S").what == "main")
+  return x
+end
+assert(f(1, 2, 3, 4) == 99)
+local info = debug.getinfo(print)
+assert(info.what == "C" and info.short_src == "[C]" and info.currentline == -1 and info.func == print)
+assert(debug.getlocal(f, 2) == "b" and debug.getlocal(f, 3) == nil)
+assert(debug.getinfo(f, "L").activelines[3] and debug.getinfo(100) == nil)
+
+local up1, up2 = 1, 2
+local function g() return up1 + up2 end
+local function h() return up2 end
+assert(debug.getupvalue(g, 1) == "up1" and select(2, debug.getupvalue(g, 2)) == 2 and debug.getupvalue(g, 3) == nil)
+assert(debug.setupvalue(g, 1, 10) == "up1" and up1 == 10 and g() == 12)
+assert(debug.upvalueid(g, 2) == debug.upvalueid(h, 1) and debug.upvalueid(g, 1) ~= debug.upvalueid(h, 1))
+debug.upvaluejoin(h, 1, g, 1)
+assert(h() == 10 and debug.upvalueid(g, 1) == debug.upvalueid(h, 1))
+
+debug.setmetatable(10, {__index = {twice = function(n) return n * 2 end}})
+assert((5):twice() == 10)
+debug.setmetatable(10, nil)
+local p = setmetatable({}, {__metatable = "locked"})
+assert(getmetatable(p) == "locked" and type(debug.getmetatable(p)) == "table")
+assert(debug.getregistry()._LOADED.string == string)
+
+local function lvl2() error("boom") end
+function glob() lvl2() end
+local _, tb = xpcall(glob, debug.traceback)
+assert(tb:find("boom\nstack traceback:\n\t[C]: in function 'error'\n\t/tmp/debuglib.lua:36: in upvalue 'lvl2'\n\t/tmp/debuglib.lua:37: in function 'glob'\n\t[C]: in function 'xpcall'", 1, true), tb)
+local obj = {}
+function obj:meth() return debug.traceback("msg") end
+assert(obj:meth():find("msg\nstack traceback:\n\t/tmp/debuglib.lua:41: in method 'meth'\n", 1, true))
+local function rec(n) if n == 0 then return debug.traceback() end return (rec(n - 1)) end
+assert(select(2, rec(30):gsub("\n", "")) == 22 and rec(30):find("\n\t...\n", 1, true))
+
+local events = {}
+local function target(n)
+  local s = 0
+  for i = 1, n do
+    s = s + i
+  end
+  return s
+end
+debug.sethook(function(ev, line) events[#events + 1] = ev .. ":" .. tostring(line) end, "crl")
+target(2)
+debug.sethook()
+assert(table.concat(events, " ") == "return:nil line:55 call:nil line:48 line:49 line:50 line:49 line:50 line:49 line:52 return:nil line:56 call:nil")
+assert(debug.gethook() == nil)
+local count = 0
+debug.sethook(function() count = count + 1 end, "", 10)
+assert(type(debug.gethook()) == "function" and select(3, debug.gethook()) == 10)
+target(100)
+debug.sethook()
+assert(count > 20)
+`
+	if err := runLuaScript("debuglib", script); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// luacCompile 测试使用的编译器, 调用官方luac编译源码, chunkname写入函数原型的Source
+func luacCompile(source []byte, chunkname string) (*chunk.Prototype, error) {
+	dir, err := os.MkdirTemp("", "luac")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	luaFile, outFile := dir+"/chunk.lua", dir+"/chunk.out"
+	os.WriteFile(luaFile, source, 0600)
+	const luac = "../lua-5.3.6/src/luac"
+	if out, err := exec.Command(luac, "-o", outFile, luaFile).CombinedOutput(); err != nil {
+		msg := strings.TrimPrefix(strings.TrimSpace(string(out)), luac+": ")
+		return nil, fmt.Errorf("%s", strings.ReplaceAll(msg, luaFile, chunkID(chunkname)))
+	}
+	buf, err := os.ReadFile(outFile)
+	if err != nil {
+		return nil, err
+	}
+	proto := chunk.Undump(buf)
+	var rename func(p *chunk.Prototype)
+	rename = func(p *chunk.Prototype) {
+		p.Source = chunkname
+		for _, sub := range p.Protos {
+			rename(sub)
+		}
+	}
+	rename(proto)
+	return proto, nil
+}
+
+// luacDump 使用官方luac将源码编译为二进制chunk
+func luacDump(t *testing.T, source string) []byte {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/chunk.lua", []byte(source), 0600)
+	if err := exec.Command("../lua-5.3.6/src/luac", "-o", dir+"/chunk.out", dir+"/chunk.lua").Run(); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := os.ReadFile(dir + "/chunk.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func TestPackageLib(t *testing.T) {
+	mods := fstest.MapFS{
+		"mods/src.lua":      {Data: []byte("#!/usr/bin/lua\nlocal name, file = ...\nreturn {name = name, file = file, line = debug.getinfo(1, 'l').currentline}")},
+		"mods/bin.lua":      {Data: luacDump(t, "return 'binary module'")},
+		"mods/pkg/init.lua": {Data: []byte("pkg_loaded = (pkg_loaded or 0) + 1")},
+		"mods/loop.lua":     {Data: []byte("return require('loop')")},
+		"mods/bad.lua":      {Data: []byte("return +")},
+	}
+	script := `
+package.path = "./mods/?.lua;./mods/?/init.lua"
+local src = require("src")
+assert(src.name == "src" and src.file == "./mods/src.lua" and src.line == 3)
+assert(require("src") == src and package.loaded.src == src)
+assert(require("bin") == "binary module")
+assert(require("pkg") == true and require("pkg") == true and pkg_loaded == 1)
+
+local calls = 0
+package.preload.pre = function(name, extra) calls = calls + 1; return {name = name, extra = extra} end
+assert(require("pre").name == "pre" and require("pre").extra == nil and calls == 1)
+assert(require("gomod").answer == 42 and require("gomod").name == "gomod")
+assert(require("string") == string and package.loaded._G == _G)
+
+local ok, err = pcall(require, "loop")
+assert(not ok and err:find("loop detected loading module 'loop'", 1, true), err)
+ok, err = pcall(require, "bad")
+assert(not ok and err:find("error loading module 'bad' from file './mods/bad.lua':\n\t", 1, true), err)
+ok, err = pcall(require, "nope")
+assert(not ok and err == "module 'nope' not found:\n\tno field package.preload['nope']\n\tno file './mods/nope.lua'\n\tno file './mods/nope/init.lua'\n\tno Go module 'nope'", err)
+
+table.insert(package.searchers, 2, function(name)
+  if name:sub(1, 4) == "gen." then return function(n, extra) return n .. "/" .. extra end, "generated" end
+  return "\n\tno generated module '" .. name .. "'"
+end)
+assert(require("gen.x") == "gen.x/generated")
+ok, err = pcall(require, "nope")
+assert(err:find("\n\tno generated module 'nope'\n\tno file", 1, true))
+package.searchers = nil
+ok, err = pcall(require, "nope")
+assert(err:find("'package.searchers' must be a table", 1, true))
+
+assert(package.searchpath("a.b", "./mods/?.lua;./mods/?/init.lua") == nil)
+assert(package.searchpath("pkg", "./mods/?.lua;./mods/?/init.lua") == "./mods/pkg/init.lua")
+assert(package.searchpath("mods.src", "?.lua") == "mods/src.lua")
+assert(select(2, package.searchpath("a.b", "x/?.lua;?.txt", ".", "_")) == "\n\tno file 'x/a_b.lua'\n\tno file 'a_b.txt'")
+local f, msg, where = package.loadlib("lib.so", "luaopen_lib")
+assert(f == nil and msg:find("dynamic libraries not enabled") and where == "absent")
+assert(package.config:sub(1, 1) == "/" and package.cpath ~= nil)
+`
+	vm, err := loadLuaScript("packagelib", script, WithModuleFS(mods), WithCompiler(luacCompile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.RegisterModule("gomod", func(_ api.State, args ...interface{}) []interface{} {
+		lib := newLuaTable(0, 2)
+		lib.Put("answer", 42)
+		lib.Put("name", args[0])
+		return []interface{}{lib}
+	})
+	vm.Run()
+
+	// 没有配置编译器时只能加载二进制模块, package.path可以通过环境变量设置
+	env := map[string]string{"LUA_PATH": "./mods/?.lua;;"}
+	script = `
+assert(package.path:sub(1, 14) == "./mods/?.lua;/" and package.path:find("./?/init.lua", 1, true))
+assert(require("bin") == "binary module")
+local ok, err = pcall(require, "src")
+assert(not ok and err:find("attempt to load a text chunk (no compiler available)", 1, true), err)
+`
+	if err := runLuaScript("packagelib2", script, WithModuleFS(mods), WithEnv(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	mem := NewMemFS()
+	mem.WriteFile("/m.lua", []byte("#!/usr/bin/lua\nlocal a = ... return 'file', z, a, debug.getinfo(1, 'l').currentline"))
+	mem.WriteFile("/err.lua", []byte("error('in file')"))
+	mem.WriteFile("/bad.lua", []byte("return +"))
+	mem.WriteFile("/bin.luac", luacDump(t, "return 'binary file'"))
+	script := `
+assert(load("return 1 + 1")() == 2)
+assert(load("return x", "=c", "t", {x = 5})() == 5)
+assert(select(2, load("return +")) == [[[string "return +"]:1: unexpected symbol near '+']])
+assert(select(2, load("return 1", "=n", "b")) == "attempt to load a text chunk (mode is 'b')")
+assert(select(2, load(bin, "=bin", "t")) == "attempt to load a binary chunk (mode is 't')")
+assert(load(bin, "=bin", "b")() == 42 and load(bin)() == 42)
+assert(select(2, load(bin:sub(1, 10))) == "binary string: truncated precompiled chunk")
+assert(select(2, load(bin:sub(1, 10), "@trunc.luac")) == "trunc.luac: truncated precompiled chunk")
+
+local parts, i = {"return ", "1", "+", 2}, 0
+assert(load(function() i = i + 1 return parts[i] end)() == 3)
+i = 0
+parts = {"return 1", "", "+ 1"}
+assert(load(function() i = i + 1 return parts[i] end)() == 1)
+local f, err = load(function() return true end)
+assert(f == nil and err:find(":%d+: reader function must return a string$"), err)
+f, err = load(function() error("boom") end)
+assert(f == nil and err:find(":%d+: boom$"), err)
+local e = {}
+assert(select(2, load(function() error(e) end)) == e)
+assert(select(2, load(function() return nil end, "=empty")) == nil)
+assert(select(2, pcall(load, nil)) == "bad argument #1 to 'load' (function expected, got nil)")
+assert(select(2, pcall(load, "x", 1, {})) == "bad argument #3 to 'load' (string expected, got table)")
+
+local env = setmetatable({}, {__index = _G})
+load("y = tostring(2)", "=e", "bt", env)()
+assert(env.y == "2" and y == nil)
+assert(select(2, pcall(load("x = 1", "=e", "t", nil))) == "e:1: attempt to index a nil value")
+assert(load("return ...")(1, 2, 3) == 1 and select("#", load("return ...")(1, 2, 3)) == 3)
+
+local a, b, c, d = loadfile("/m.lua")("arg")
+assert(a == "file" and b == nil and c == "arg" and d == 2)
+assert(select(2, loadfile("/m.lua", "t", {z = 9, debug = debug})()) == 9)
+assert(select(2, loadfile("/m.lua", "b")) == "attempt to load a text chunk (mode is 'b')")
+assert(loadfile("/bin.luac", "b")() == "binary file" and dofile("/bin.luac") == "binary file")
+assert(select(2, loadfile("/missing.lua")) == "cannot open /missing.lua: No such file or directory")
+assert(select(2, loadfile("/bad.lua")) == "/bad.lua:1: unexpected symbol near '+'")
+assert(dofile("/m.lua") == "file")
+assert(select(2, pcall(dofile, "/missing.lua")) == "cannot open /missing.lua: No such file or directory")
+assert(select(2, pcall(dofile, "/err.lua")) == "/err.lua:1: in file")
+assert(select(2, pcall(dofile, "/bad.lua")) == "/bad.lua:1: unexpected symbol near '+'")
+
+-- 不带文件名时读取标准输入
+assert(loadfile()() == "stdin" and loadfile(nil, "t", {})() == nil)
+`
+	vm, err := loadLuaScript("load", script, WithFileSystem(mem), WithCompiler(luacCompile),
+		WithStdin(strings.NewReader("return debug and 'stdin'")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.global.Put("bin", string(luacDump(t, "return 42")))
+	vm.Run()
+}
+
+func TestLoadFunction(t *testing.T) {
+	vm := NewState()
+	counter, err := luacCompile([]byte("n = (n or 0) + 1; local a, b = ...; return n, a, b"), "@counter.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env1 := GoMapToLuaTable(map[interface{}]interface{}{})
+	env2 := GoMapToLuaTable(map[interface{}]interface{}{"n": 100})
+	f1, f2 := vm.Load(counter, env1), vm.Load(counter, env2)
+	for i := 1; i <= 3; i++ {
+		if results, err := vm.CallFunction(f1, "x", i); err != nil || results[0] != i || results[1] != "x" || results[2] != i {
+			t.Fatalf("unexpected results: %v %v", results, err)
+		}
+	}
+	if results, err := vm.CallFunction(f2); err != nil || results[0] != 101 || env1.Get("n") != 3 {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+	if vm.global.Get("n") != nil {
+		t.Fatal("global table should not be modified")
+	}
+
+	// 主函数可以作为普通的lua值使用, 省略env时使用全局变量表
+	caller, err := luacCompile([]byte("local f = ...; return f(1), f(2), n"), "=caller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results, err := vm.CallFunction(vm.Load(caller), f1); err != nil || results[0] != 4 || results[1] != 5 || results[2] != nil {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+	vm.Load(counter)
+	vm.Run()
+	vm.Run()
+	if vm.global.Get("n") != 2 {
+		t.Fatalf("n = %v", vm.global.Get("n"))
+	}
+
+	bad, err := luacCompile([]byte("error('bad chunk')"), "@bad.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vm.CallFunction(vm.Load(bad)); err == nil || err.Error() != "bad.lua:1: bad chunk" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := vm.CallFunction(nil); err == nil || err.Error() != "attempt to call a nil value" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if vm.GetTop() != 0 {
+		t.Fatal("stack should be unchanged")
+	}
+}
+
+func TestLibsAndOutput(t *testing.T) {
+	var stdout, stderr strings.Builder
+	script := `
+print("a", 1, nil, true)
+io.write("b", 2, "\n")
+io.stdout:write("c\n")
+io.stderr:write("err\n")
+print(io.output() == io.stdout, io.type(io.stderr))
+`
+	if err := runLuaScript("output", script, WithStdout(&stdout), WithStderr(&stderr)); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "a\t1\tnil\ttrue\nb2\nc\ntrue\tfile\n" || stderr.String() != "err\n" {
+		t.Fatalf("unexpected output: %q %q", stdout.String(), stderr.String())
+	}
+
+	script = `
+assert(string and _G and _VERSION and print)
+assert(table == nil and io == nil and os == nil and package == nil and require == nil and debug == nil)
+assert(math.pi)
+`
+	vm, err := loadLuaScript("libs", script, WithLibs(LibBase, LibString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded := vm.loadedTable(); loaded.Get("string") != vm.global.Get("string") || loaded.Get("table") != nil {
+		t.Fatal("package.loaded should only contain opened libs")
+	}
+	OpenLibs(vm, LibMath)
+	vm.Run()
+
+	vm = NewState(WithLibs())
+	if k := vm.global.Next(nil); k != nil {
+		t.Fatalf("global table should be empty, got %v", k)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	script := `
+assert(io == nil and debug == nil and package == nil and require == nil and loadfile == nil and dofile == nil)
+assert(os.time and os.clock and os.exit == nil and os.remove == nil and os.getenv == nil and math.randomseed == nil)
+assert(_G == _ENV and ("abc"):upper() == "ABC" and string.format("%d", 3) == "3")
+local ok, err = pcall(function() string.upper = nil end)
+assert(not ok and err:find("attempt to modify a read-only table", 1, true), err)
+assert(not pcall(rawset, math, "pi", 3) and not pcall(table.insert, table, 1))
+assert(getmetatable("") == false and getmetatable(string) == false)
+assert(select(2, pcall(setmetatable, string, {})) == "cannot change a protected metatable")
+assert(select(2, load(bin, "=bin", "b")) == "attempt to load a binary chunk (not allowed in sandbox)")
+load("x = 1")()
+assert(x == 1)
+`
+	vm, err := loadLuaScript("sandbox", script, WithSandbox(DefaultSandboxPolicy), WithCompiler(luacCompile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.global.Put("bin", string(luacDump(t, "return 1")))
+	vm.Run()
+
+	// 每个脚本使用独立的全局环境, 共享只读的库table
+	tenant, err := luacCompile([]byte("n = (n or 0) + 1; load('loaded = true')(); return n, hostfn()"), "=tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.Register("hostfn", func(api.State, ...interface{}) []interface{} { return []interface{}{"host"} })
+	env1, env2 := vm.NewSandboxEnv(), vm.NewSandboxEnv()
+	f1, f2 := vm.Load(tenant, env1), vm.Load(tenant, env2)
+	vm.CallFunction(f1)
+	if results, err := vm.CallFunction(f1); err != nil || results[0] != 2 || results[1] != "host" {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+	if results, err := vm.CallFunction(f2); err != nil || results[0] != 1 {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+	if env1.Get("loaded") != true || vm.global.Get("loaded") != nil || env1.Get("_G") != env1 {
+		t.Fatal("load in sandbox should use the caller's environment")
+	}
+	if env1.Get("string") != env2.Get("string") || env1.Get("string") != vm.global.Get("string") {
+		t.Fatal("library tables should be shared")
+	}
+
+	if !DefaultSandboxPolicy.Allowed("string.format") || DefaultSandboxPolicy.Allowed("io.open") || DefaultSandboxPolicy.Allowed("os.exit") {
+		t.Fatal("unexpected default policy")
+	}
+	policy := SandboxPolicy{Allow: []string{"string", "assert", "load"}, BinaryChunks: true}
+	if !policy.Allowed("string.rep") || policy.Allowed("print") {
+		t.Fatal("unexpected policy")
+	}
+	script = `
+assert(string.rep("a", 3) == "aaa" and print == nil and _G == nil and table == nil)
+assert(load(bin)() == 1)
+`
+	vm, err = loadLuaScript("sandbox2", script, WithSandbox(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm.global.Put("bin", string(luacDump(t, "return 1")))
+	vm.Run()
+}
+
+func TestSandboxStackOverflow(t *testing.T) {
+	script := `
+local function f() return 1 + f() end
+local ok, err = pcall(f)
+assert(not ok and err:find("stack overflow", 1, true), err)
+local t = setmetatable({}, {__index = function(t, k) return t[k] end})
+ok, err = pcall(function() return t.x end)
+assert(not ok and err:find("C stack overflow", 1, true), err)
+ok, err = xpcall(f, function(m) return "handled: " .. m end)
+assert(not ok and err:find("handled: .*stack overflow"), err)
+ok, err = xpcall(f, function() return f() end)
+assert(not ok and err == "error in error handling", err)
+local function g(n) if n == 0 then return 0 end return g(n - 1) end
+assert(g(10000) == 0)
+`
+	if err := runLuaScript("stackoverflow", script, WithSandbox(DefaultSandboxPolicy)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未捕获的栈溢出作为错误返回给宿主, 栈帧和内存统计恢复
+	vm := NewState(WithSandbox(DefaultSandboxPolicy), WithMemoryLimit(64<<20))
+	f, err := luacCompile([]byte("local function f() return f() + 1 end return f()"), "=overflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := vm.memUsed
+	if _, err := vm.CallFunction(vm.Load(f)); err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Fatalf("expected stack overflow, got %v", err)
+	}
+	if vm.stack.nCalls != 0 || vm.memUsed > used+protoOverhead*2 {
+		t.Fatalf("stack not restored: depth %d, memory %d -> %d", vm.stack.nCalls, used, vm.memUsed)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	compile := func(source string) *chunk.Prototype {
+		proto, err := luacCompile([]byte(source), "=ctx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proto
+	}
+	vm := NewState()
+	vm.Load(compile("while true do pcall(function() while true do end end) end"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := vm.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	canceled, cancel2 := context.WithCancel(context.Background())
+	cancel2()
+	if err := vm.RunContext(canceled); !errors.Is(err, context.Canceled) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if results, err := vm.CallFunction(vm.Load(compile("return 1"))); err != nil || results[0] != 1 || vm.GetTop() != 0 {
+		t.Fatalf("state should be usable after interrupt: %v %v", results, err)
+	}
+
+	// 指令数上限对每次调用分别计算, 精确到指令
+	vm = NewState(WithInstructionLimit(2))
+	f := vm.Load(compile("local a = ... return a")) // VARARG, RETURN
+	for i := 0; i < 3; i++ {
+		if results, err := vm.CallContext(context.Background(), f, i); err != nil || results[0] != i {
+			t.Fatalf("unexpected results: %v %v", results, err)
+		}
+	}
+	vm.Load(compile("local a = 1 local b = 2")) // LOADK, LOADK, RETURN
+	if err := vm.RunContext(context.Background()); err != ErrInstructionLimit {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vm = NewState(WithInstructionLimit(100000))
+	for _, script := range []string{
+		"xpcall(function() while true do end end, function() return 'handled' end)",
+		"local s = string.rep('x', 1 << 30)",
+		"local t = {} for i = 1, 1000 do t[i] = -i end for i = 1, 1000 do table.sort(t) end",
+		"string.find(string.rep('a', 40), string.rep('a-', 40) .. 'b')",
+	} {
+		vm.Load(compile(script))
+		if err := vm.RunContext(context.Background()); err != ErrInstructionLimit {
+			t.Fatalf("%s: unexpected error: %v", script, err)
+		}
+	}
+	vm.Load(compile("error('fail')"))
+	if err, ok := vm.RunContext(context.Background()).(*LuaError); !ok || err.Value != "ctx:1: fail" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	compile := func(source string) *chunk.Prototype {
+		proto, err := luacCompile([]byte(source), "=mem")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return proto
+	}
+	vm := NewState()
+	results, err := vm.CallFunction(vm.Load(compile(`
+		local before = collectgarbage("count")
+		local t = {}
+		for i = 1, 100000 do t[i] = "item" .. i end
+		local grown = collectgarbage("count")
+		t = nil
+		collectgarbage()
+		return before, grown, collectgarbage("count")`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, grown, after := results[0].(float64), results[1].(float64), results[2].(float64)
+	if before <= 0 || grown < before+1000 || after > before+10 {
+		t.Fatalf("unexpected memory usage: %v %v %v", before, grown, after)
+	}
+
+	vm = NewState(WithMemoryLimit(4 << 20))
+	for _, script := range []string{
+		"local t = {} for i = 1, 1e8 do t[i] = i end",
+		"local t = {} for i = 1, 1e8 do t['k' .. i] = true end",
+		"local t = {} while true do t[#t + 1] = {} end",
+		"local s = 'x' while true do s = s .. s end",
+		"local s = string.rep('x', 1 << 30)",
+		"local s = string.gsub(string.rep('x', 1000), 'x', string.rep('y', 10000))",
+		"local function f(...) return f(...) + 1 end f(string.byte(string.rep('x', 100), 1, -1))",
+	} {
+		vm.Load(compile(script))
+		_, err := vm.CallFunction(vm.main)
+		if e, ok := err.(*LuaError); !ok || e.Value != "not enough memory" || e.Status != api.LUA_ERRMEM {
+			t.Fatalf("%s: unexpected error: %v", script, err)
+		}
+	}
+	// 错误可以被pcall捕获, 释放引用后可以继续分配
+	results, err = vm.CallFunction(vm.Load(compile(`
+		local ok, msg = pcall(function() local t = {} while true do t[#t + 1] = "x" .. #t end end)
+		local t = {}
+		for i = 1, 1000 do t[i] = {} end
+		return ok, msg, #t`)))
+	if err != nil || results[0] != false || results[1] != "not enough memory" || results[2] != 1000 {
+		t.Fatalf("unexpected results: %v %v", results, err)
+	}
+	if vm.MemoryUsage() > 4<<20 {
+		t.Fatalf("memory usage %d exceeds limit", vm.MemoryUsage())
+	}
+
+	// go函数生成的字符串同样计入内存统计
+	mem := NewMemFS()
+	mem.WriteFile("/line.txt", []byte(strings.Repeat("x", 1<<16)+"\n"))
+	mem.WriteFile("/big.txt", make([]byte, 8<<20))
+	for _, script := range []string{
+		"local s = 'x' while true do s = table.concat({s, s}) end",
+		"local s = 'x' while true do s = table.concat({s, s}, s) end",
+		"local s = 'x' while true do s = string.format('%s%s', s, s) end",
+		"local s = 'x' while true do s = string.pack('s4s4', s, s) end",
+		"local s = string.pack('c1000000000', '')",
+		"local s = utf8.char(table.unpack(setmetatable({}, {__index = function() return 0x10000 end}), 1, 1000000))",
+		"local s = io.open('/big.txt'):read('a')",
+		"local s = io.open('/big.txt'):read(1 << 30)",
+		"local s = io.open('/big.txt'):read('l')",
+		"io.input('/big.txt') local s = io.read('L')",
+	} {
+		vm := NewState(WithMemoryLimit(4<<20), WithFileSystem(mem))
+		_, err := vm.CallFunction(vm.Load(compile(script)))
+		if e, ok := err.(*LuaError); !ok || e.Value != "not enough memory" {
+			t.Fatalf("%s: unexpected error: %v", script, err)
+		}
+	}
+	// 保留每次生成的结果, 结果占用的内存超过上限之前出错
+	for _, test := range []struct {
+		expr string
+		size int
+	}{
+		{"s:sub(#t % 1000 + 1)", 1<<16 - 1000}, // 重新统计时相同起始位置的子串只计入一次
+		{"s:upper()", 1 << 16},
+		{"s:lower()", 1 << 16},
+		{"s:reverse()", 1 << 16},
+		{"s:match('x+', #t % 1000 + 1)", 1<<16 - 1000},
+		{"string.char(table.unpack(bytes))", 1000},
+		{"utf8.char(table.unpack(codes))", 4000},
+		{"f:seek('set') and f:read('a')", 1<<16 + 1},
+		{"f:seek('set') and f:read('l')", 1 << 16},
+		{"f:seek('set') and f:read(1 << 16)", 1 << 16},
+	} {
+		vm := NewState(WithMemoryLimit(4<<20), WithFileSystem(mem))
+		results, err := vm.CallFunction(vm.Load(compile(`
+			local s, f = string.rep("x", 1 << 16), io.open("/line.txt")
+			local bytes, codes = {}, {}
+			for i = 1, 1000 do bytes[i], codes[i] = 120, 0x10000 end
+			local t = {}
+			local ok, err = pcall(function() while true do t[#t + 1] = ` + test.expr + ` end end)
+			return err, #t`)))
+		if err != nil || results[0] != "not enough memory" || results[1].(int)*test.size > 4<<20 {
+			t.Fatalf("%s: unexpected results: %v %v", test.expr, results, err)
+		}
+	}
+}
+
+func TestHook(t *testing.T) {
+	proto, err := luacCompile([]byte(`local function add(a, b)
+  return a + b
+end
+local s = 0
+for i = 1, 2 do
+  s = add(s, i)
+end
+return string.len("abc")`), "=hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := NewState()
+	main := vm.Load(proto)
+	var events []string
+	vm.SetHook(HookCall|HookReturn|HookLine, 0, func(ev HookEvent) {
+		if ev.Event == HookLine {
+			events = append(events, fmt.Sprintf("line:%d", ev.Line))
+			return
+		}
+		info := ev.Info()
+		events = append(events, fmt.Sprintf("%s:%s:%s:%d", ev.Event, info.What, info.Name, ev.State.StackDepth()))
+	})
+	if _, err := vm.CallFunction(main); err != nil {
+		t.Fatal(err)
+	}
+	expected := "call:main::1 line:3 line:4 line:5 line:6 call:Lua:add:2 line:2 return:Lua:add:2 line:5 " +
+		"line:6 call:Lua:add:2 line:2 return:Lua:add:2 line:5 line:8 call:C:len:2 return:C:len:2 return:main::1"
+	if trace := strings.Join(events, " "); trace != expected {
+		t.Fatalf("unexpected trace: %s", trace)
+	}
+
+	// count事件, 移除钩子后不再触发
+	count := 0
+	vm.SetHook(HookCount, 1, func(ev HookEvent) {
+		count++
+	})
+	vm.CallFunction(main)
+	n := count
+	vm.SetHook(0, 0, nil)
+	vm.CallFunction(main)
+	if n != 28 || count != n {
+		t.Fatalf("unexpected count events: %d %d", n, count)
+	}
+}